@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+
+	"github.com/thumperq/golib/config"
+)
+
+// envConfig is the config of the broker, it is read from the flags and environment variables instead of Vault.
+type envConfig map[string]string
+
+func (cfg envConfig) GetValue(ctx context.Context, key string) (string, error) {
+	value, ok := cfg[key]
+	if !ok {
+		return "", config.ErrKeyNotFound
+	}
+	return value, nil
+}
+
+func (cfg envConfig) GetValueOfDomainService(ctx context.Context, domain string, service string, key string) (string, error) {
+	return cfg.GetValue(ctx, domain+"."+service+"."+key)
+}
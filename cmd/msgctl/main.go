@@ -0,0 +1,304 @@
+// msgctl inspects and replays the JetStream streams of golib services.
+//
+// Usage:
+//
+//	msgctl [global flags] streams
+//	msgctl [global flags] consumers [-stream name]
+//	msgctl [global flags] tail -topic order [-event orderCreated]
+//	msgctl [global flags] find -topic order [-event orderCreated] [-since 1h] [-until 2024-01-02T15:04:05Z] [-limit 10]
+//	msgctl [global flags] republish -topic order -seq 12,13 [-to-domain wms] [-to-service ordering] [-to-topic order]
+//
+// The global flags -urls, -domain and -service default to the NATS_URLS, DOMAIN and SERVICE environment variables,
+// -env is the environment prefix of services naming their subjects with one. Encrypted messages are decrypted with -transit-key through the Vault at VAULT_ADDR, or else
+// with the MESSAGING_ENCRYPTION_KEY_* environment variables, which also encrypt republished messages. Claim checked
+// payloads are resolved from the existing -claim-bucket object store.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/thumperq/golib/config"
+	"github.com/thumperq/golib/messaging"
+)
+
+type cli struct {
+	broker  *messaging.Broker
+	domain  string
+	service string
+	out     io.Writer
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := run(ctx, os.Args[1:], os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		stop()
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("msgctl", flag.ContinueOnError)
+	urls := flags.String("urls", envOr("NATS_URLS", "nats://127.0.0.1:4222"), "comma separated nats urls")
+	env := flags.String("env", "", "environment prefix of subjects and streams")
+	domain := flags.String("domain", os.Getenv("DOMAIN"), "domain of the inspected service")
+	service := flags.String("service", os.Getenv("SERVICE"), "inspected service")
+	transitKey := flags.String("transit-key", "", "vault transit key decrypting encrypted messages")
+	claimBucket := flags.String("claim-bucket", "", "object store bucket of claim checked payloads")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("missing command, one of streams, consumers, tail, find, republish")
+	}
+	cfg := envConfig{"NATS_URLS": *urls}
+	encryptionKeys := false
+	for _, variable := range os.Environ() {
+		key, value, _ := strings.Cut(variable, "=")
+		if strings.HasPrefix(key, messaging.CfgEncryptionKeyPrefix) {
+			cfg[key] = value
+			encryptionKeys = true
+		}
+	}
+	broker, err := messaging.NewBroker(cfg, *domain, *service)
+	if err != nil {
+		return err
+	}
+	broker.WithSubjectNamer(messaging.DefaultSubjectNamer{Environment: *env})
+	err = broker.Connect()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = broker.Disconnect()
+	}()
+	switch {
+	case *transitKey != "":
+		client, err := config.NewVaultClient()
+		if err != nil {
+			return err
+		}
+		broker.WithEncryption(messaging.NewVaultTransitKeyProvider(client, "", *transitKey))
+	case encryptionKeys:
+		broker.WithEncryption(messaging.NewCfgKeyProvider(cfg))
+	}
+	if *claimBucket != "" {
+		store, err := broker.ObjectStore(*claimBucket)
+		if err != nil {
+			return err
+		}
+		broker.WithClaimCheck(messaging.ClaimCheck{Store: store})
+	}
+	c := &cli{
+		broker:  broker,
+		domain:  *domain,
+		service: *service,
+		out:     out,
+	}
+	command, commandArgs := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "streams":
+		return c.streams(ctx)
+	case "consumers":
+		return c.consumers(ctx, commandArgs)
+	case "tail":
+		return c.tail(ctx, commandArgs)
+	case "find":
+		return c.find(ctx, commandArgs)
+	case "republish":
+		return c.republish(ctx, commandArgs)
+	}
+	return fmt.Errorf("unknown command %s", command)
+}
+
+func (c *cli) streams(ctx context.Context) error {
+	streams, err := c.broker.Streams(ctx, c.domain, c.service)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STREAM\tSUBJECTS\tMESSAGES\tBYTES\tFIRST\tLAST\tCONSUMERS")
+	for _, s := range streams {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\n", s.Name, strings.Join(s.Subjects, ","), s.Messages, s.Bytes, s.FirstSeq, s.LastSeq, s.Consumers)
+	}
+	return w.Flush()
+}
+
+func (c *cli) consumers(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("consumers", flag.ContinueOnError)
+	stream := flags.String("stream", "", "stream name, defaults to every stream of the domain and service")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	streams := []string{*stream}
+	if *stream == "" {
+		infos, err := c.broker.Streams(ctx, c.domain, c.service)
+		if err != nil {
+			return err
+		}
+		streams = streams[:0]
+		for _, s := range infos {
+			streams = append(streams, s.Name)
+		}
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STREAM\tCONSUMER\tPENDING\tACK PENDING\tREDELIVERED")
+	for _, s := range streams {
+		consumers, err := c.broker.Consumers(ctx, s)
+		if err != nil {
+			return err
+		}
+		for _, consumer := range consumers {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\n", consumer.Stream, consumer.Name, consumer.NumPending, consumer.NumAckPending, consumer.NumRedelivered)
+		}
+	}
+	return w.Flush()
+}
+
+func (c *cli) tail(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ContinueOnError)
+	topic := flags.String("topic", ">", "topic to tail, defaults to every topic")
+	event := flags.String("event", "", "only print events with this name")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	err = c.broker.ReadStream(ctx, c.domain, c.service, *topic, messaging.ReadOptions{
+		Since:     time.Now(),
+		EventName: *event,
+		Follow:    true,
+	}, c.print)
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+func (c *cli) find(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("find", flag.ContinueOnError)
+	topic := flags.String("topic", ">", "topic to search, defaults to every topic")
+	event := flags.String("event", "", "only print events with this name")
+	since := flags.String("since", "", "start time as RFC3339 or a duration before now, e.g. 1h")
+	until := flags.String("until", "", "end time as RFC3339 or a duration before now")
+	limit := flags.Int("limit", 0, "maximum number of printed messages")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	opts := messaging.ReadOptions{
+		EventName: *event,
+		Limit:     *limit,
+	}
+	opts.Since, err = parseTime(*since)
+	if err != nil {
+		return err
+	}
+	opts.Until, err = parseTime(*until)
+	if err != nil {
+		return err
+	}
+	return c.broker.ReadStream(ctx, c.domain, c.service, *topic, opts, c.print)
+}
+
+func (c *cli) republish(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("republish", flag.ContinueOnError)
+	topic := flags.String("topic", "", "topic the messages are read from")
+	seqs := flags.String("seq", "", "comma separated stream sequences to republish")
+	toDomain := flags.String("to-domain", c.domain, "domain to republish to")
+	toService := flags.String("to-service", c.service, "service to republish to")
+	toTopic := flags.String("to-topic", "", "topic to republish to, defaults to -topic")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *topic == "" || *seqs == "" {
+		return errors.New("republish needs -topic and -seq")
+	}
+	if *toTopic == "" {
+		*toTopic = *topic
+	}
+	sequences := []uint64{}
+	for _, s := range strings.Split(*seqs, ",") {
+		seq, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid sequence %s: %w", s, err)
+		}
+		sequences = append(sequences, seq)
+	}
+	slices.Sort(sequences)
+	remaining := len(sequences)
+	err = c.broker.ReadStream(ctx, c.domain, c.service, *topic, messaging.ReadOptions{
+		StartSequence: sequences[0],
+	}, func(msg messaging.StoredMessage) error {
+		if !slices.Contains(sequences, msg.Sequence) {
+			return nil
+		}
+		err := c.broker.Republish(*toDomain, *toService, *toTopic, msg)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "republished %s #%d %s to %s.%s.%s\n", msg.Stream, msg.Sequence, msg.Message.Name, *toDomain, *toService, *toTopic)
+		remaining--
+		if remaining == 0 {
+			return messaging.ErrStopReading
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return fmt.Errorf("%d of %d messages not found", remaining, len(sequences))
+	}
+	return nil
+}
+
+func (c *cli) print(msg messaging.StoredMessage) error {
+	fmt.Fprintf(c.out, "#%d %s %s %s\n", msg.Sequence, msg.Time.Format(time.RFC3339Nano), msg.Subject, msg.Message.Name)
+	var data any
+	err := json.Unmarshal(msg.Message.Data, &data)
+	if err != nil {
+		fmt.Fprintf(c.out, "  %s\n", msg.Message.Data)
+		return nil
+	}
+	pretty, err := json.MarshalIndent(data, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "  %s\n", pretty)
+	return nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func envOr(key string, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	configTest "github.com/thumperq/golib/config/test"
+	"github.com/thumperq/golib/messaging"
+	"github.com/thumperq/golib/messaging/test"
+)
+
+type orderCreated struct {
+	EventName string `json:"name"`
+	OrderId   string `json:"orderId"`
+	Note      string `json:"note"`
+}
+
+func (o orderCreated) Name() string {
+	return o.EventName
+}
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	t.Setenv("ENVIRONMENT", "")
+	t.Setenv(messaging.CfgEncryptionKeyID, "v1")
+	t.Setenv(messaging.CfgEncryptionKeyPrefix+"v1", key)
+	srv := test.NewNatsServer(t)
+	cfg := configTest.NewConfigManager()
+	cfg.WithKeyValue(messaging.CfgEncryptionKeyID, "v1").WithKeyValue(messaging.CfgEncryptionKeyPrefix+"v1", key)
+	publisher := test.ConnectBroker(t, srv.ClientURL(), "wms", "ordering").
+		WithEncryption(messaging.NewCfgKeyProvider(&cfg))
+	store, err := publisher.NewObjectStore("wms-ordering-claims", time.Hour)
+	require.NoError(t, err)
+	publisher.WithClaimCheck(messaging.ClaimCheck{Threshold: 1024, Store: store})
+	require.NoError(t, publisher.WithStream([]string{"order", "replay"}))
+	require.NoError(t, publisher.PublishStream("order", orderCreated{EventName: "orderCreated", OrderId: "123"}))
+	note := strings.Repeat("fragile ", 256)
+	require.NoError(t, publisher.PublishStream("order", orderCreated{EventName: "orderCreated", OrderId: "124", Note: note}))
+
+	msgctl := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		global := []string{"-urls", srv.ClientURL(), "-domain", "wms", "-service", "ordering", "-claim-bucket", "wms-ordering-claims"}
+		err := run(ctx, append(global, args...), &out)
+		return out.String(), err
+	}
+
+	out, err := msgctl("streams")
+	require.NoError(t, err)
+	require.Regexp(t, `wms-ordering\s+wms\.ordering\.order,wms\.ordering\.replay\s+2\s`, out)
+
+	// encrypted and claim checked payloads are readable
+	out, err = msgctl("find", "-topic", "order")
+	require.NoError(t, err)
+	require.Contains(t, out, "#1 ")
+	require.Contains(t, out, `"orderId": "123"`)
+	require.Contains(t, out, `"orderId": "124"`)
+	require.Contains(t, out, strings.TrimSpace(note))
+
+	out, err = msgctl("republish", "-topic", "order", "-seq", "2", "-to-topic", "replay")
+	require.NoError(t, err)
+	require.Contains(t, out, "republished wms-ordering #2 orderCreated to wms.ordering.replay")
+	out, err = msgctl("find", "-topic", "replay", "-event", "orderCreated")
+	require.NoError(t, err)
+	require.Contains(t, out, `"orderId": "124"`)
+
+	out, err = msgctl("consumers")
+	require.NoError(t, err)
+	require.Contains(t, out, "STREAM")
+
+	_, err = msgctl("unknown")
+	require.EqualError(t, err, "unknown command unknown")
+	_, err = msgctl("republish", "-topic", "order")
+	require.EqualError(t, err, "republish needs -topic and -seq")
+	err = run(ctx, []string{"-urls", srv.ClientURL(), "-domain", "wms", "-service", "ordering"}, &bytes.Buffer{})
+	require.EqualError(t, err, "missing command, one of streams, consumers, tail, find, republish")
+}
+
+func TestRunDoesNotCreateTheClaimBucket(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	t.Setenv("ENVIRONMENT", "")
+	srv := test.NewNatsServer(t)
+	broker := test.ConnectBroker(t, srv.ClientURL(), "wms", "ordering")
+	require.NoError(t, broker.WithStream([]string{"order"}))
+
+	err := run(ctx, []string{"-urls", srv.ClientURL(), "-domain", "wms", "-service", "ordering", "-claim-bucket", "missing", "streams"}, &bytes.Buffer{})
+	require.Error(t, err)
+	_, err = broker.ObjectStore("missing")
+	require.Error(t, err)
+}
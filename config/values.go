@@ -0,0 +1,33 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// IsProduction reports whether ENVIRONMENT is prod or production.
+func IsProduction() bool {
+	switch strings.ToLower(os.Getenv("ENVIRONMENT")) {
+	case "prod", "production":
+		return true
+	}
+	return false
+}
+
+// ParseBools sets the targets of the keys which have a value, e.g. true, false, 1 or 0.
+func ParseBools(values map[string]string, targets map[string]*bool) error {
+	for key, target := range targets {
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+		*target = enabled
+	}
+	return nil
+}
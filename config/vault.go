@@ -10,6 +10,9 @@ import (
 	vault "github.com/hashicorp/vault/api"
 )
 
+// ErrKeyNotFound is returned when the key has no value in the config store.
+var ErrKeyNotFound = errors.New("secret_key_not_found")
+
 type CfgManager interface {
 	GetValue(ctx context.Context, key string) (string, error)
 	GetValueOfDomainService(ctx context.Context, domain string, service string, key string) (string, error)
@@ -19,6 +22,7 @@ type ConfigManager struct {
 	environment string
 	domain      string
 	service     string
+	client      *vault.Client
 	store       *vault.KVv2
 }
 
@@ -28,6 +32,19 @@ func NewConfigManager() (CfgManager, error) {
 		domain:      os.Getenv("DOMAIN"),
 		service:     os.Getenv("SERVICE"),
 	}
+	client, err := NewVaultClient()
+	if err != nil {
+		return nil, err
+	}
+
+	store := client.KVv2("secrets")
+	cfg.client = client
+	cfg.store = store
+	return cfg, nil
+}
+
+// NewVaultClient returns a client for the Vault server at VAULT_ADDR authenticated with VAULT_TOKEN
+func NewVaultClient() (*vault.Client, error) {
 	config := &vault.Config{Address: os.Getenv("VAULT_ADDR")}
 
 	err := config.ConfigureTLS(&vault.TLSConfig{Insecure: true})
@@ -45,10 +62,19 @@ func NewConfigManager() (CfgManager, error) {
 	// WARNING: This quickstart uses the root token for our Vault dev server.
 	// Don't do this in production!
 	client.SetToken(os.Getenv("VAULT_TOKEN"))
+	return client, nil
+}
 
-	store := client.KVv2("secrets")
-	cfg.store = store
-	return cfg, nil
+// Ping checks that Vault is reachable, initialized and unsealed, e.g. for health checks.
+func (cfg ConfigManager) Ping(ctx context.Context) error {
+	health, err := cfg.client.Sys().HealthWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !health.Initialized || health.Sealed {
+		return errors.New("vault is not initialized or sealed")
+	}
+	return nil
 }
 
 func (cfg ConfigManager) GetValue(ctx context.Context, key string) (string, error) {
@@ -57,11 +83,23 @@ func (cfg ConfigManager) GetValue(ctx context.Context, key string) (string, erro
 
 func (cfg ConfigManager) GetValueOfDomainService(ctx context.Context, domain string, service string, key string) (string, error) {
 	secret, err := cfg.store.Get(ctx, fmt.Sprintf("%s/%s/%s/%s", cfg.environment, domain, service, key))
+	if errors.Is(err, vault.ErrSecretNotFound) {
+		return "", fmt.Errorf("%w: %w", ErrKeyNotFound, err)
+	}
 	if err != nil {
 		return "", err
 	}
 	if v, ok := secret.Data["value"]; ok {
 		return v.(string), nil
 	}
-	return "", errors.New("secret_key_not_found")
+	return "", ErrKeyNotFound
+}
+
+// GetOptionalValue returns the value of the key or an empty string when the key is not set.
+func GetOptionalValue(ctx context.Context, cfg CfgManager, key string) (string, error) {
+	value, err := cfg.GetValue(ctx, key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return "", nil
+	}
+	return value, err
 }
@@ -84,3 +84,11 @@ func (db PgDB) WithConnection(ctx context.Context, fn func(*pgxpool.Conn) error)
 	defer conn.Release()
 	return fn(conn)
 }
+
+// Ping acquires a connection of the pool and checks that the database answers, e.g. for health checks.
+func (db PgDB) Ping(ctx context.Context) error {
+	if db.Pool == nil {
+		return errors.New("no_established_db_connection")
+	}
+	return db.Pool.Ping(ctx)
+}
@@ -2,14 +2,19 @@ package environment
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"reflect"
 
 	"github.com/thumperq/golib/application"
 	"github.com/thumperq/golib/config"
 	"github.com/thumperq/golib/database"
+	"github.com/thumperq/golib/health"
+	"github.com/thumperq/golib/lifecycle"
 	"github.com/thumperq/golib/logging"
 	"github.com/thumperq/golib/messaging"
+	grpcserver "github.com/thumperq/golib/servers/grpc"
 	httpserver "github.com/thumperq/golib/servers/http"
 )
 
@@ -20,19 +25,31 @@ type Env struct {
 	providers  []func(*Env) error
 	Cfg        config.CfgManager
 	ApiServer  *httpserver.ApiServer
+	GrpcServer *grpcserver.Server
 	Broker     *messaging.Broker
 	AppFactory application.AppFactory
 	DbFactory  database.DbFactory
 	Worker     messaging.Worker
+	// Lifecycle shuts the environment down, subscribers should consume with its Context.
+	Lifecycle *lifecycle.Manager
 }
 
 func NewEnv() *Env {
 	logging.SetupLogging()
-	env := &Env{}
+	env := &Env{Lifecycle: lifecycle.NewManager()}
 	env.withConfig()
 	return env
 }
 
+// NewEnvWithConfig reads the config from cfg instead of Vault, e.g. in tests.
+func NewEnvWithConfig(cfg config.CfgManager) *Env {
+	logging.SetupLogging()
+	return &Env{
+		Cfg:       cfg,
+		Lifecycle: lifecycle.NewManager(),
+	}
+}
+
 func (env *Env) withConfig() *Env {
 	env.providers = append(env.providers, func(env *Env) error {
 		cfg, err := config.NewConfigManager()
@@ -58,6 +75,16 @@ func (env *Env) WithBroker() *Env {
 		if err != nil {
 			return err
 		}
+		env.Lifecycle.OnStop(lifecycle.Flush, "broker async publishes", func(ctx context.Context) error {
+			err := env.Broker.FlushAsync(ctx)
+			if errors.Is(err, messaging.ErrNotSupported) {
+				return nil
+			}
+			return err
+		})
+		env.Lifecycle.OnStop(lifecycle.Close, "broker", func(ctx context.Context) error {
+			return env.Broker.Disconnect()
+		})
 		return nil
 	})
 	return env
@@ -71,6 +98,12 @@ func (env *Env) WithDbFactory() *Env {
 		}
 		dbFactory = dbf
 		env.DbFactory = dbFactory
+		env.Lifecycle.OnStop(lifecycle.Close, "postgres", func(ctx context.Context) error {
+			if pool := env.DbFactory.PgDb().Pool; pool != nil {
+				pool.Close()
+			}
+			return nil
+		})
 		return nil
 	})
 	return env
@@ -85,6 +118,20 @@ func (env *Env) WithAppFactory() *Env {
 	return env
 }
 
+// WithGrpcServer adds a gRPC server configured by the GRPC_* config keys, register its services on the Engine of
+// env.GrpcServer in Bootstrap. It reports the health checks of the ApiServer and shuts down with the Lifecycle.
+func (env *Env) WithGrpcServer() *Env {
+	env.providers = append(env.providers, func(env *Env) error {
+		opts, err := grpcserver.OptionsFromConfig(context.Background(), env.Cfg)
+		if err != nil {
+			return err
+		}
+		env.GrpcServer = grpcserver.NewServer(opts)
+		return nil
+	})
+	return env
+}
+
 func (env *Env) WithWorker() *Env {
 	env.providers = append(env.providers, func(env *Env) error {
 		cw := messaging.NewWorker(env.Broker)
@@ -94,25 +141,79 @@ func (env *Env) WithWorker() *Env {
 	return env
 }
 
+// Bootstrap runs the environment until SIGINT or SIGTERM. It returns an error unless the shutdown was clean and leaves
+// the exit to the caller, so its deferred cleanup runs first.
 func (env *Env) Bootstrap(b func(env *Env) error) error {
+	exitCode := env.Run(context.Background(), b)
+	if exitCode != 0 {
+		return fmt.Errorf("shut down with exit code %d", exitCode)
+	}
+	return nil
+}
+
+// Run initializes the providers, calls b to register routes and subscribers and serves until a shutdown signal or
+// the context is done. The components are shut down by the Lifecycle, Run returns its exit code.
+func (env *Env) Run(ctx context.Context, b func(env *Env) error) int {
+	opts, err := env.setup(ctx)
+	if err != nil {
+		// the hooks of the providers set up so far still run
+		env.Lifecycle.Fail(err)
+		return env.Lifecycle.Run(ctx)
+	}
+	return httpserver.Run(ctx, env.Lifecycle, opts, func(apiSrv *httpserver.ApiServer) error {
+		env.ApiServer = apiSrv
+		env.registerHealthChecks(apiSrv.Health())
+		// the broker metrics are served at /metrics together with the metrics of the server
+		if env.Broker != nil {
+			err := env.Broker.WithMeterProvider(apiSrv.MeterProvider())
+			if err != nil {
+				return err
+			}
+		}
+		if env.GrpcServer != nil {
+			env.GrpcServer.WithHealth(apiSrv.Health())
+		}
+		err := b(env)
+		if err != nil {
+			return err
+		}
+		if env.GrpcServer != nil {
+			return env.GrpcServer.Serve(env.Lifecycle, apiSrv)
+		}
+		return nil
+	})
+}
+
+func (env *Env) setup(ctx context.Context) (httpserver.Options, error) {
 	for _, provider := range env.providers {
 		err := provider(env)
 		if err != nil {
-			return err
+			return httpserver.Options{}, err
 		}
 	}
-	exitCode := <-httpserver.ListenAndServe(func(apiSrv *httpserver.ApiServer) error {
-		env.ApiServer = apiSrv
-		return b(env)
-	})
-	err := env.Broker.Disconnect()
+	err := env.Lifecycle.WithConfig(ctx, env.Cfg)
 	if err != nil {
-		logging.TraceLogger(context.Background()).
-			Err(err).
-			Msg("error disconnecting from broker")
+		return httpserver.Options{}, err
+	}
+	return httpserver.OptionsFromConfig(ctx, env.Cfg)
+}
+
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// registerHealthChecks adds the checks of the configured components, further checks can be registered in Bootstrap.
+func (env *Env) registerHealthChecks(registry *health.Registry) {
+	if vault, ok := env.Cfg.(pinger); ok {
+		// config is mostly read at startup, running replicas keep serving while Vault is unavailable
+		registry.Register(health.Check{Name: "vault", Check: vault.Ping, Criticality: health.NonCritical})
+	}
+	if env.DbFactory != nil {
+		registry.Register(health.Check{Name: "postgres", Check: env.DbFactory.PgDb().Ping})
+	}
+	if env.Broker != nil {
+		registry.Register(health.Check{Name: "broker", Check: env.Broker.Ping})
 	}
-	os.Exit(exitCode)
-	return err
 }
 
 func GetApp[T any]() T {
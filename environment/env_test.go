@@ -0,0 +1,101 @@
+package environment_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	configTest "github.com/thumperq/golib/config/test"
+	"github.com/thumperq/golib/environment"
+	"github.com/thumperq/golib/lifecycle"
+	messagingTest "github.com/thumperq/golib/messaging/test"
+	httpserver "github.com/thumperq/golib/servers/http"
+)
+
+func TestRunShutsDownWithoutExit(t *testing.T) {
+	port := messagingTest.FreePort(t)
+	cfg := configTest.NewConfigManager()
+	cfg.WithKeyValue(httpserver.CfgHttpPort, fmt.Sprint(port)).
+		WithKeyValue(httpserver.CfgHttpRoutePrefix, "/wms/ordering").
+		WithKeyValue(lifecycle.CfgShutdownGracePeriod, "1s").
+		WithKeyValue(lifecycle.CfgShutdownDrainDelay, "0s")
+
+	env := environment.NewEnvWithConfig(cfg)
+	env.Lifecycle.WithSignals()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscriberStopped := make(chan struct{})
+	exitCode := make(chan int, 1)
+	go func() {
+		exitCode <- env.Run(ctx, func(env *environment.Env) error {
+			go func() {
+				<-env.Lifecycle.Context().Done()
+				close(subscriberStopped)
+			}()
+			return nil
+		})
+	}()
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/wms/ordering/health/ready", port))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 20*time.Millisecond)
+
+	cancel()
+	require.Equal(t, 0, <-exitCode)
+	<-subscriberStopped
+}
+
+type orderCreated struct {
+	OrderId string `json:"orderId"`
+}
+
+func (o orderCreated) Name() string {
+	return "orderCreated"
+}
+
+func TestRunServesBrokerMetrics(t *testing.T) {
+	t.Setenv("DOMAIN", "wms")
+	t.Setenv("SERVICE", "ordering")
+	t.Setenv("ENVIRONMENT", "")
+	nats := messagingTest.NewNatsServer(t)
+	port := messagingTest.FreePort(t)
+	cfg := configTest.NewConfigManager()
+	cfg.WithKeyValue("NATS_URLS", nats.ClientURL()).
+		WithKeyValue(httpserver.CfgHttpPort, fmt.Sprint(port)).
+		WithKeyValue(httpserver.CfgHttpRoutePrefix, "/wms/ordering").
+		WithKeyValue(lifecycle.CfgShutdownDrainDelay, "0s")
+
+	env := environment.NewEnvWithConfig(cfg).WithBroker()
+	env.Lifecycle.WithSignals()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exitCode := make(chan int, 1)
+	go func() {
+		exitCode <- env.Run(ctx, func(env *environment.Env) error {
+			return env.Broker.Publish("order", orderCreated{OrderId: "123"})
+		})
+	}()
+	var metrics string
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/metrics", port))
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		metrics = string(body)
+		return err == nil && resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 20*time.Millisecond)
+	require.Regexp(t, `messaging_published_total\{[^}]*topic="order"[^}]*\} 1`, metrics)
+
+	cancel()
+	require.Equal(t, 0, <-exitCode)
+}
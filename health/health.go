@@ -0,0 +1,178 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatusUp       = "up"
+	StatusDegraded = "degraded"
+	StatusDown     = "down"
+
+	defaultTimeout = 2 * time.Second
+)
+
+var ErrShuttingDown = errors.New("shutting down")
+
+type Criticality int
+
+const (
+	// Critical checks take the service down when they fail.
+	Critical Criticality = iota
+	// NonCritical checks only degrade the service, e.g. an optional cache.
+	NonCritical
+)
+
+// Check is a health check of a dependency like the database, the broker or Vault.
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+	// Timeout bounds the check, 2 seconds by default.
+	Timeout     time.Duration
+	Criticality Criticality
+	// Liveness checks are also part of the liveness report. Only use them for failures restarting the process fixes,
+	// a database outage must not restart every replica.
+	Liveness bool
+}
+
+// Result is the outcome of a check.
+type Result struct {
+	Status     string `json:"status"`
+	Critical   bool   `json:"critical"`
+	DurationMs int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Report is the json response of the liveness and readiness probes.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks,omitempty"`
+}
+
+// Up is false when a critical check failed, degraded services are still up.
+func (r Report) Up() bool {
+	return r.Status != StatusDown
+}
+
+// Registry runs the registered checks for the liveness and readiness probes.
+type Registry struct {
+	mu           sync.RWMutex
+	checks       []Check
+	shuttingDown atomic.Bool
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+}
+
+func NewRegistry() *Registry {
+	return &Registry{shutdown: make(chan struct{})}
+}
+
+func (r *Registry) Register(checks ...Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks = append(r.checks, checks...)
+}
+
+// ShutDown fails the readiness from now on, so load balancers stop routing requests while the server drains.
+func (r *Registry) ShutDown() {
+	r.shuttingDown.Store(true)
+	r.shutdownOnce.Do(func() { close(r.shutdown) })
+}
+
+// Done is closed when the shutdown starts, e.g. to end streams watching the health.
+func (r *Registry) Done() <-chan struct{} {
+	return r.shutdown
+}
+
+func (r *Registry) ShuttingDown() bool {
+	return r.shuttingDown.Load()
+}
+
+// Liveness reports whether the process is alive, only the liveness checks run.
+func (r *Registry) Liveness(ctx context.Context) Report {
+	return r.run(ctx, func(check Check) bool { return check.Liveness })
+}
+
+// Readiness reports whether the service can handle requests, all checks run. It is down while shutting down.
+func (r *Registry) Readiness(ctx context.Context) Report {
+	report := r.run(ctx, func(check Check) bool { return true })
+	if r.ShuttingDown() {
+		report.Status = StatusDown
+		report.Checks["shutdown"] = Result{Status: StatusDown, Critical: true, Error: ErrShuttingDown.Error()}
+	}
+	return report
+}
+
+// run executes the selected checks concurrently, each within its timeout.
+func (r *Registry) run(ctx context.Context, selected func(Check) bool) Report {
+	r.mu.RLock()
+	var checks []Check
+	for _, check := range r.checks {
+		if selected(check) {
+			checks = append(checks, check)
+		}
+	}
+	r.mu.RUnlock()
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runCheck(ctx, check)
+		}()
+	}
+	wg.Wait()
+	report := Report{Status: StatusUp, Checks: map[string]Result{}}
+	for i, result := range results {
+		report.Checks[checks[i].Name] = result
+		switch {
+		case result.Status == StatusUp:
+		case result.Critical:
+			report.Status = StatusDown
+		case report.Status == StatusUp:
+			report.Status = StatusDegraded
+		}
+	}
+	return report
+}
+
+func runCheck(ctx context.Context, check Check) Result {
+	timeout := check.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				done <- errors.New("check panicked")
+			}
+		}()
+		done <- check.Check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// checks ignoring the context must not block the probe
+		err = ctx.Err()
+	}
+	result := Result{
+		Status:     StatusUp,
+		Critical:   check.Criticality == Critical,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		result.Status = StatusDown
+		result.Error = err.Error()
+	}
+	return result
+}
@@ -0,0 +1,80 @@
+package health_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thumperq/golib/health"
+)
+
+func TestRegistryReports(t *testing.T) {
+	registry := health.NewRegistry()
+	var cacheErr, dbErr error
+	registry.Register(
+		health.Check{Name: "postgres", Check: func(ctx context.Context) error { return dbErr }},
+		health.Check{Name: "cache", Check: func(ctx context.Context) error { return cacheErr }, Criticality: health.NonCritical},
+		health.Check{Name: "worker", Check: func(ctx context.Context) error { return nil }, Liveness: true},
+	)
+	ctx := context.Background()
+
+	report := registry.Readiness(ctx)
+	require.Equal(t, health.StatusUp, report.Status)
+	require.Len(t, report.Checks, 3)
+	require.True(t, report.Checks["postgres"].Critical)
+
+	cacheErr = errors.New("connection refused")
+	report = registry.Readiness(ctx)
+	require.Equal(t, health.StatusDegraded, report.Status)
+	require.True(t, report.Up())
+	require.Equal(t, health.Result{Status: health.StatusDown, Error: "connection refused"}, withoutDuration(report.Checks["cache"]))
+
+	dbErr = errors.New("too many connections")
+	report = registry.Readiness(ctx)
+	require.Equal(t, health.StatusDown, report.Status)
+	require.False(t, report.Up())
+
+	live := registry.Liveness(ctx)
+	require.Equal(t, health.StatusUp, live.Status, "dependency outages do not fail the liveness")
+	require.Equal(t, []string{"worker"}, keys(live.Checks))
+
+	dbErr, cacheErr = nil, nil
+	registry.ShutDown()
+	report = registry.Readiness(ctx)
+	require.Equal(t, health.StatusDown, report.Status)
+	require.Equal(t, health.ErrShuttingDown.Error(), report.Checks["shutdown"].Error)
+	require.Equal(t, health.StatusUp, registry.Liveness(ctx).Status)
+}
+
+func TestCheckTimeout(t *testing.T) {
+	registry := health.NewRegistry()
+	registry.Register(health.Check{
+		Name:    "vault",
+		Timeout: 50 * time.Millisecond,
+		Check: func(ctx context.Context) error {
+			// ignores the context like a blocking client would
+			time.Sleep(time.Second)
+			return nil
+		},
+	})
+	start := time.Now()
+	report := registry.Readiness(context.Background())
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+	require.Equal(t, health.StatusDown, report.Status)
+	require.Equal(t, context.DeadlineExceeded.Error(), report.Checks["vault"].Error)
+}
+
+func withoutDuration(result health.Result) health.Result {
+	result.DurationMs = 0
+	return result
+}
+
+func keys(checks map[string]health.Result) []string {
+	var names []string
+	for name := range checks {
+		names = append(names, name)
+	}
+	return names
+}
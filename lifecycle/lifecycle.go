@@ -0,0 +1,231 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/thumperq/golib/config"
+	"github.com/thumperq/golib/logging"
+)
+
+const (
+	CfgShutdownDrainDelay  = "SHUTDOWN_DRAIN_DELAY"
+	CfgShutdownGracePeriod = "SHUTDOWN_GRACE_PERIOD"
+
+	defaultGracePeriod = 10 * time.Second
+	defaultDrainDelay  = 5 * time.Second
+)
+
+// Phase orders the shutdown, the hooks of a phase run in the order they were registered once the previous phase
+// completed.
+type Phase int
+
+const (
+	// StopAccepting fails the readiness, the drain delay gives load balancers time to stop routing requests.
+	StopAccepting Phase = iota
+	// DrainHTTP stops the servers and waits for in-flight requests.
+	DrainHTTP
+	// StopSubscribers cancels the Context of the manager, which subscribers consume with.
+	StopSubscribers
+	// Flush publishes pending messages, e.g. asynchronous publishes or an outbox.
+	Flush
+	// Close releases connections, e.g. the database pool and the broker connection.
+	Close
+)
+
+var phases = []Phase{StopAccepting, DrainHTTP, StopSubscribers, Flush, Close}
+
+func (p Phase) String() string {
+	switch p {
+	case StopAccepting:
+		return "stop accepting"
+	case DrainHTTP:
+		return "drain http"
+	case StopSubscribers:
+		return "stop subscribers"
+	case Flush:
+		return "flush"
+	case Close:
+		return "close"
+	}
+	return fmt.Sprintf("phase %d", int(p))
+}
+
+type hook struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+// Manager runs the service until a shutdown signal, a cancelled context or a failure and then runs the shutdown
+// hooks phase by phase. Every phase has a grace period bounding its hooks.
+type Manager struct {
+	mu         sync.Mutex
+	hooks      map[Phase][]hook
+	grace      map[Phase]time.Duration
+	drainDelay time.Duration
+	signals    []os.Signal
+	failures   chan error
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// NewManager shuts down on SIGINT and SIGTERM, SIGHUP is left to the application, e.g. to reload config.
+func NewManager() *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{
+		hooks:      map[Phase][]hook{},
+		grace:      map[Phase]time.Duration{},
+		drainDelay: defaultDrainDelay,
+		signals:    []os.Signal{syscall.SIGINT, syscall.SIGTERM},
+		failures:   make(chan error, 1),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// WithGracePeriod bounds the hooks of the phase, 10 seconds by default.
+func (m *Manager) WithGracePeriod(phase Phase, grace time.Duration) *Manager {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.grace[phase] = grace
+	return m
+}
+
+// WithDrainDelay waits after the readiness failed before the servers stop, it should exceed the probe interval.
+// Defaults to 5 seconds, zero stops the servers right away.
+func (m *Manager) WithDrainDelay(delay time.Duration) *Manager {
+	m.drainDelay = delay
+	return m
+}
+
+// WithSignals replaces the signals shutting down, without signals only the context of Run does.
+func (m *Manager) WithSignals(signals ...os.Signal) *Manager {
+	m.signals = signals
+	return m
+}
+
+// WithConfig applies SHUTDOWN_DRAIN_DELAY and SHUTDOWN_GRACE_PERIOD, a duration like 30s for every phase, when set.
+func (m *Manager) WithConfig(ctx context.Context, cfg config.CfgManager) error {
+	for key, apply := range map[string]func(time.Duration){
+		CfgShutdownDrainDelay: func(d time.Duration) { m.WithDrainDelay(d) },
+		CfgShutdownGracePeriod: func(d time.Duration) {
+			for _, phase := range phases {
+				m.WithGracePeriod(phase, d)
+			}
+		},
+	} {
+		value, err := config.GetOptionalValue(ctx, cfg, key)
+		if err != nil {
+			return err
+		}
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+		apply(d)
+	}
+	return nil
+}
+
+// OnStop registers a hook running in the phase of the shutdown.
+func (m *Manager) OnStop(phase Phase, name string, stop func(ctx context.Context) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks[phase] = append(m.hooks[phase], hook{name: name, stop: stop})
+}
+
+// Context is cancelled in the StopSubscribers phase, subscribers consuming with it stop before the broker is closed.
+func (m *Manager) Context() context.Context {
+	return m.ctx
+}
+
+// Fail shuts down with exit code 1, e.g. when a server stopped serving. Only the first failure is kept.
+func (m *Manager) Fail(err error) {
+	select {
+	case m.failures <- err:
+	default:
+	}
+}
+
+// Run blocks until a shutdown signal, the context is done or Fail is called, then runs the shutdown hooks.
+// It returns exit code 0 when the shutdown was requested and every hook succeeded, and 1 otherwise.
+func (m *Manager) Run(ctx context.Context) int {
+	logger := logging.TraceLogger(ctx)
+	interrupt := make(chan os.Signal, 1)
+	if len(m.signals) > 0 {
+		signal.Notify(interrupt, m.signals...)
+		defer signal.Stop(interrupt)
+	}
+	exitCode := 0
+	select {
+	case sig := <-interrupt:
+		logger.Info().Msgf("received %s, shutting down", sig)
+	case <-ctx.Done():
+		logger.Info().Msg("context done, shutting down")
+	case err := <-m.failures:
+		logger.Error().Err(err).Msg("failure, shutting down")
+		exitCode = 1
+	}
+	if !m.shutdown() {
+		exitCode = 1
+	}
+	return exitCode
+}
+
+// shutdown runs the hooks of every phase and reports whether all of them succeeded.
+func (m *Manager) shutdown() bool {
+	logger := logging.TraceLogger(context.Background())
+	ok := true
+	for _, phase := range phases {
+		if phase == StopSubscribers {
+			m.cancel()
+		}
+		m.mu.Lock()
+		hooks := m.hooks[phase]
+		grace, found := m.grace[phase]
+		m.mu.Unlock()
+		if !found {
+			grace = defaultGracePeriod
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		for _, h := range hooks {
+			err := runHook(ctx, h)
+			if err != nil {
+				logger.Error().Err(err).Msgf("shutdown hook %s of phase %s failed", h.name, phase)
+				ok = false
+			}
+		}
+		cancel()
+		if phase == StopAccepting && m.drainDelay > 0 {
+			time.Sleep(m.drainDelay)
+		}
+	}
+	return ok
+}
+
+// runHook abandons hooks which ignore the context once the grace period is over.
+func runHook(ctx context.Context, h hook) error {
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				done <- fmt.Errorf("panic: %v", recovered)
+			}
+		}()
+		done <- h.stop(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("grace period exceeded: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,124 @@
+package lifecycle_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thumperq/golib/lifecycle"
+)
+
+func TestShutdownPhasesInOrder(t *testing.T) {
+	m := lifecycle.NewManager().WithSignals().WithDrainDelay(0)
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, name)
+			return nil
+		}
+	}
+	m.OnStop(lifecycle.Close, "postgres", record("postgres"))
+	m.OnStop(lifecycle.Close, "broker", record("broker"))
+	m.OnStop(lifecycle.Flush, "outbox", record("outbox"))
+	m.OnStop(lifecycle.StopSubscribers, "subscribers", func(ctx context.Context) error {
+		require.ErrorIs(t, m.Context().Err(), context.Canceled, "the context of subscribers is cancelled first")
+		return record("subscribers")(ctx)
+	})
+	m.OnStop(lifecycle.DrainHTTP, "http", func(ctx context.Context) error {
+		require.NoError(t, m.Context().Err())
+		return record("http")(ctx)
+	})
+	m.OnStop(lifecycle.StopAccepting, "readiness", record("readiness"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, 0, m.Run(ctx))
+	require.Equal(t, []string{"readiness", "http", "subscribers", "outbox", "postgres", "broker"}, order)
+}
+
+func TestDrainDelay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m := lifecycle.NewManager().WithSignals().WithDrainDelay(100 * time.Millisecond)
+	var notReady time.Time
+	m.OnStop(lifecycle.StopAccepting, "readiness", func(ctx context.Context) error {
+		notReady = time.Now()
+		return nil
+	})
+	m.OnStop(lifecycle.DrainHTTP, "http", func(ctx context.Context) error {
+		require.GreaterOrEqual(t, time.Since(notReady), 100*time.Millisecond, "servers stop after the drain delay")
+		return nil
+	})
+	require.Equal(t, 0, m.Run(ctx))
+}
+
+func TestExitCodes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	m := lifecycle.NewManager().WithSignals().WithDrainDelay(0)
+	closed := false
+	m.OnStop(lifecycle.Close, "broker", func(ctx context.Context) error {
+		closed = true
+		return nil
+	})
+	m.Fail(errors.New("serve failed"))
+	require.Equal(t, 1, m.Run(context.Background()))
+	require.True(t, closed, "hooks run after failures")
+
+	m = lifecycle.NewManager().WithSignals().WithDrainDelay(0)
+	m.OnStop(lifecycle.Flush, "outbox", func(ctx context.Context) error {
+		return errors.New("outbox unavailable")
+	})
+	require.Equal(t, 1, m.Run(ctx))
+
+	m = lifecycle.NewManager().WithSignals().WithDrainDelay(0).WithGracePeriod(lifecycle.DrainHTTP, 50*time.Millisecond)
+	m.OnStop(lifecycle.DrainHTTP, "stuck", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	start := time.Now()
+	require.Equal(t, 1, m.Run(ctx))
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestSignals(t *testing.T) {
+	// keep the signals away from the default handlers, which would terminate the test process
+	received := make(chan os.Signal, 8)
+	signal.Notify(received, syscall.SIGHUP, syscall.SIGTERM)
+	defer signal.Stop(received)
+
+	m := lifecycle.NewManager().WithDrainDelay(0)
+	exitCode := make(chan int, 1)
+	go func() {
+		exitCode <- m.Run(context.Background())
+	}()
+
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	select {
+	case <-exitCode:
+		t.Fatal("SIGHUP must not shut down")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case code := <-exitCode:
+			require.Equal(t, 0, code)
+			return
+		case <-ticker.C:
+			require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+		}
+	}
+}
@@ -4,13 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/nats-io/nats.go"
 	"github.com/thumperq/golib/config"
 	"github.com/thumperq/golib/logging"
+	"go.opentelemetry.io/otel/metric"
 )
 
 type Event interface {
@@ -22,14 +23,38 @@ type Message struct {
 	Data []byte `json:"data"`
 }
 
+type Publisher interface {
+	Publish(topic string, data Event) error
+	PublishStream(topic string, data Event) error
+	PublishTo(domain string, service string, topic string, data Event) error
+	PublishStreamTo(domain string, service string, topic string, data Event) error
+}
+
+// MessageSubscriber is implemented by Subscriber and the in-memory mock broker, depend on it to test subscribing code
+// without nats.
+type MessageSubscriber interface {
+	Subscribe(ctx context.Context, domain string, service string, topic string, handler func(ctx context.Context, msg Message) error) error
+	SubscribeStream(ctx context.Context, domain string, service string, topic string, handler func(ctx context.Context, msg Message) error) error
+}
+
 type Broker struct {
-	urls       string
-	connection *nats.Conn
-	stream     nats.JetStreamContext
-	domain     string
-	service    string
+	transport   Transport
+	domain      string
+	service     string
+	namer       SubjectNamer
+	compression Compression
+	// maxDecompressed bounds the decompressed payloads, zstdDecoder enforces it for zstd
+	maxDecompressed int64
+	zstdDecoder     *zstd.Decoder
+	keys            KeyProvider
+	claimCheck      *ClaimCheck
+	metrics         *BrokerMetrics
+	mu              sync.RWMutex
+	partitions      map[string]int
 }
 
+// NewBroker returns a broker connecting to the NATS_URLS of the config. Subjects and streams are not prefixed with the
+// environment, opt in with WithSubjectNamer(DefaultSubjectNamer{Environment: ...}).
 func NewBroker(cfg config.CfgManager, domain string, service string) (*Broker, error) {
 	if domain == "" {
 		return nil, errors.New("domain is empty")
@@ -41,212 +66,360 @@ func NewBroker(cfg config.CfgManager, domain string, service string) (*Broker, e
 	if err != nil {
 		return nil, err
 	}
+	return NewBrokerWithTransport(newNatsTransport(urls), domain, service)
+}
+
+// NewBrokerWithTransport returns a broker moving its messages with the transport instead of nats.
+// Work queues, partitions, asynchronous publishing, object stores and stream inspection need nats and return ErrNotSupported.
+func NewBrokerWithTransport(transport Transport, domain string, service string) (*Broker, error) {
+	if domain == "" {
+		return nil, errors.New("domain is empty")
+	}
+	if service == "" {
+		return nil, errors.New("service is empty")
+	}
+	metrics, err := NewBrokerMetrics(nil)
+	if err != nil {
+		return nil, err
+	}
+	zstdDecoder, err := newZstdDecoder(defaultMaxDecompressedSize)
+	if err != nil {
+		return nil, err
+	}
 	return &Broker{
-		urls:    urls,
-		domain:  domain,
-		service: service,
+		transport:       transport,
+		domain:          domain,
+		service:         service,
+		namer:           DefaultSubjectNamer{},
+		maxDecompressed: defaultMaxDecompressedSize,
+		zstdDecoder:     zstdDecoder,
+		metrics:         metrics,
+		partitions:      map[string]int{},
 	}, nil
 }
 
+// WithSubjectNamer replaces the naming of subjects, streams, durables and queue groups.
+func (b *Broker) WithSubjectNamer(namer SubjectNamer) *Broker {
+	b.namer = namer
+	return b
+}
+
+// WithMeterProvider records the broker and subscriber metrics with the provider instead of the global one.
+func (b *Broker) WithMeterProvider(provider metric.MeterProvider) error {
+	metrics, err := NewBrokerMetrics(provider)
+	if err != nil {
+		return err
+	}
+	err = b.metrics.unregister()
+	if err != nil {
+		return err
+	}
+	b.metrics = metrics
+	return nil
+}
+
 func (b *Broker) WithStream(topics []string) error {
 	if len(topics) <= 0 {
 		return errors.New("topics is empty")
 	}
 	domainTopics := []string{}
 	for _, t := range topics {
-		domainTopics = append(domainTopics, fmt.Sprintf("%s.%s.%s", b.domain, b.service, t))
-	}
-	if b.connection == nil {
-		err := b.Connect()
-		if err != nil {
-			return err
-		}
+		domainTopics = append(domainTopics, b.namer.Subject(b.domain, b.service, t))
 	}
-	js, err := b.connection.JetStream(nats.PublishAsyncMaxPending(256))
-	if err != nil {
-		return err
+	return b.transport.AddStream(b.namer.StreamName(b.domain, b.service), domainTopics)
+}
+
+// WithCompression compresses the payload of every published message, consumers decompress based on the Content-Encoding header.
+func (b *Broker) WithCompression(compression Compression) *Broker {
+	b.compression = compression
+	return b
+}
+
+// WithMaxDecompressedSize bounds the size of decompressed payloads, 64 MiB by default. Larger payloads fail to decode
+// with ErrDecompressedTooLarge, so small messages cannot expand into gigabytes.
+func (b *Broker) WithMaxDecompressedSize(size int64) error {
+	if size <= 0 {
+		return errors.New("max decompressed size must be positive")
 	}
-	b.stream = js
-	_, err = b.stream.AddStream(&nats.StreamConfig{
-		Name:     fmt.Sprintf("%s-%s", b.domain, b.service),
-		Subjects: domainTopics,
-	})
+	zstdDecoder, err := newZstdDecoder(size)
 	if err != nil {
 		return err
 	}
+	b.maxDecompressed = size
+	b.zstdDecoder = zstdDecoder
 	return nil
 }
 
-func (b *Broker) Connect() error {
-	nc, err := nats.Connect(b.urls, nats.MaxReconnects(10), nats.ReconnectWait(time.Second))
-	if err != nil {
-		return err
+// WithEncryption encrypts the payload of every published message with AES-GCM using data keys of the key provider.
+// Consumers need a key provider able to decrypt the data keys as well.
+func (b *Broker) WithEncryption(keys KeyProvider) *Broker {
+	b.keys = keys
+	return b
+}
+
+func (b *Broker) jetStream() (nats.JetStreamContext, error) {
+	t, ok := b.transport.(*natsTransport)
+	if !ok {
+		return nil, ErrNotSupported
 	}
-	b.connection = nc
-	return nil
+	return t.jetStream()
+}
+
+func (b *Broker) Connect() error {
+	return b.transport.Connect()
 }
 
 func (b *Broker) Disconnect() error {
-	return b.connection.Drain()
+	return b.transport.Disconnect()
+}
+
+// Ping returns an error when the transport lost its connection to the server, e.g. for health checks.
+func (b *Broker) Ping(ctx context.Context) error {
+	p, ok := b.transport.(pinger)
+	if !ok {
+		return nil
+	}
+	return p.Ping(ctx)
 }
 
 func (b *Broker) Publish(topic string, data Event) error {
+	return b.PublishTo(b.domain, b.service, topic, data)
+}
+
+// PublishTo publishes onto a topic of another domain and service, e.g. to send a command to the owning service.
+func (b *Broker) PublishTo(domain string, service string, topic string, data Event) error {
 	if topic == "" {
 		return errors.New("publish topic is empty")
 	}
 	if data == nil {
 		return errors.New("publish data is nil")
 	}
-	dataBytes, err := json.Marshal(data)
+	msg, err := b.encode(b.namer.Subject(domain, service, topic), data)
 	if err != nil {
 		return err
 	}
-	msg := &Message{
-		Name: data.Name(),
-		Data: dataBytes,
-	}
-	msgJson, err := json.Marshal(msg)
+	err = b.transport.Publish(toEnvelope(msg))
 	if err != nil {
+		b.discardClaim(context.Background(), msg)
 		return err
 	}
-	return b.connection.Publish(fmt.Sprintf("%s.%s.%s", b.domain, b.service, topic), msgJson)
+	b.metrics.recordPublished(domain, service, topic, false)
+	return nil
 }
 
 func (b *Broker) PublishStream(topic string, data Event) error {
+	return b.PublishStreamTo(b.domain, b.service, topic, data)
+}
+
+// PublishStreamTo publishes onto a topic of another domain and service which has to be captured by a stream.
+func (b *Broker) PublishStreamTo(domain string, service string, topic string, data Event) error {
 	if topic == "" {
 		return errors.New("publish stream topic is empty")
 	}
 	if data == nil {
 		return errors.New("publish stream data is nil")
 	}
-	dataBytes, err := json.Marshal(data)
+	msg, err := b.encode(b.namer.Subject(domain, service, topic), data)
+	if err != nil {
+		return err
+	}
+	err = b.transport.PublishStream(toEnvelope(msg))
 	if err != nil {
+		b.discardClaim(context.Background(), msg)
 		return err
 	}
-	msg := &Message{
+	b.metrics.recordPublished(domain, service, topic, true)
+	return nil
+}
+
+func (b *Broker) encode(subject string, data Event) (*nats.Msg, error) {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	msgJson, err := json.Marshal(&Message{
 		Name: data.Name(),
 		Data: dataBytes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	msg := nats.NewMsg(subject)
+	if b.compression != NoCompression {
+		msgJson, err = compress(b.compression, msgJson)
+		if err != nil {
+			return nil, err
+		}
+		msg.Header.Set(headerContentEncoding, string(b.compression))
+	}
+	if b.keys != nil {
+		msgJson, err = encrypt(context.Background(), b.keys, msgJson, msg.Header)
+		if err != nil {
+			return nil, err
+		}
 	}
-	msgJson, err := json.Marshal(msg)
+	msg.Data = msgJson
+	err = b.checkIn(context.Background(), msg)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = b.stream.Publish(fmt.Sprintf("%s.%s.%s", b.domain, b.service, topic), msgJson)
+	return msg, nil
+}
+
+func (b *Broker) decode(ctx context.Context, msg *nats.Msg) (Message, error) {
+	var data Message
+	payload, err := b.checkOut(ctx, msg)
 	if err != nil {
-		return err
+		return data, err
 	}
-	return nil
+	if algorithm := msg.Header.Get(headerEncryption); algorithm != "" {
+		payload, err = decrypt(ctx, b.keys, payload, algorithm, msg.Header.Get(headerKeyID), msg.Header.Get(headerDataKey))
+		if err != nil {
+			return data, err
+		}
+	}
+	if encoding := msg.Header.Get(headerContentEncoding); encoding != "" {
+		payload, err = decompress(Compression(encoding), payload, b.maxDecompressed, b.zstdDecoder)
+		if err != nil {
+			return data, err
+		}
+	}
+	err = json.Unmarshal(payload, &data)
+	return data, err
 }
 
 type Subscriber struct {
-	subscriberName string
-	broker         *Broker
+	broker     *Broker
+	middleware Middleware
+	broadcast  bool
 }
 
-func NewSubscriber(broker *Broker) *Subscriber {
+// NewSubscriber returns a subscriber wrapping every handler with the middlewares, the first one being the outermost.
+// Panics in handlers and middlewares are always recovered.
+func NewSubscriber(broker *Broker, middlewares ...Middleware) *Subscriber {
 	return &Subscriber{
-		subscriberName: fmt.Sprintf("%s-%s", broker.domain, broker.service),
-		broker:         broker,
+		broker:     broker,
+		middleware: Chain(append([]Middleware{Recovery()}, middlewares...)...),
 	}
 }
 
+// NewBroadcastSubscriber returns a subscriber delivering every message to every replica of the service instead of one,
+// e.g. to update local state like the clients connected to the replica. Subscribe receives the messages published to
+// streams as well, at most once, SubscribeStream is not supported.
+func NewBroadcastSubscriber(broker *Broker, middlewares ...Middleware) *Subscriber {
+	s := NewSubscriber(broker, middlewares...)
+	s.broadcast = true
+	return s
+}
+
 func (s *Subscriber) Subscribe(ctx context.Context, domain string, service string, topic string, handler func(ctx context.Context, msg Message) error) error {
-	msgs := make(chan *nats.Msg)
-	subject := fmt.Sprintf("%s.%s.%s", domain, service, topic)
-	queueName := fmt.Sprintf("%s-%s", s.subscriberName, strings.ReplaceAll(subject, ".", "-"))
-	sub, err := s.broker.connection.QueueSubscribeSyncWithChan(subject, queueName, msgs)
-	if err != nil {
-		return err
+	subject := s.broker.namer.Subject(domain, service, topic)
+	queueName := s.broker.namer.QueueGroup(s.broker.domain, s.broker.service, subject)
+	if s.broadcast {
+		queueName = ""
 	}
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				err := sub.Unsubscribe()
-				if err != nil {
-					logging.TraceLogger(ctx).
-						Err(err).
-						Msgf("failed to unsubscribe from subject %s", subject)
-				}
-				return
-			case msg := <-msgs:
-				var data Message
-				err := json.Unmarshal(msg.Data, &data)
-				if err != nil {
-					logging.TraceLogger(ctx).
-						Err(err).
-						Msgf("failed to unmarshal message with subject %s", msg.Subject)
-					continue
-				}
-				err = handler(ctx, data)
-				if err != nil {
-					logging.TraceLogger(ctx).
-						Err(err).
-						Msgf("handler error for subject %s", msg.Subject)
-				}
-			}
+	handle := s.middleware(handler)
+	return s.broker.transport.Subscribe(ctx, subject, queueName, func(ctx context.Context, env Envelope) {
+		delivery := Delivery{
+			Subject: env.Subject,
+			Domain:  domain,
+			Service: service,
+			Topic:   topic,
 		}
-	}()
-	return nil
+		data, err := s.broker.decode(ctx, fromEnvelope(env))
+		if err != nil {
+			logging.TraceLogger(ctx).
+				Err(err).
+				Msgf("failed to unmarshal message with subject %s", env.Subject)
+			s.broker.metrics.recordDecodeFailure(ctx, delivery)
+			return
+		}
+		start := time.Now()
+		err = handle(ContextWithDelivery(ctx, delivery), data)
+		s.broker.metrics.RecordHandled(ctx, delivery, data, time.Since(start), err)
+		if err != nil {
+			logging.TraceLogger(ctx).
+				Err(err).
+				Msgf("handler error for subject %s", env.Subject)
+		}
+	})
 }
 
 func (s *Subscriber) SubscribeStream(ctx context.Context, domain string, service string, topic string, handler func(ctx context.Context, msg Message) error) error {
-	subject := fmt.Sprintf("%s.%s.%s", domain, service, topic)
-	queueName := fmt.Sprintf("%s-%s", s.subscriberName, strings.ReplaceAll(subject, ".", "-"))
-	sub, err := s.broker.stream.PullSubscribe(subject, queueName, nats.PullMaxWaiting(128))
+	if s.broadcast {
+		return ErrNotSupported
+	}
+	subject := s.broker.namer.Subject(domain, service, topic)
+	queueName := s.broker.namer.DurableName(s.broker.domain, s.broker.service, subject)
+	handle := s.middleware(handler)
+	err := s.broker.transport.SubscribeStream(ctx, subject, queueName, func(ctx context.Context, env StreamEnvelope) {
+		s.handleStream(ctx, handle, env, domain, service, topic)
+	})
 	if err != nil {
 		return err
 	}
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				err := sub.Unsubscribe()
-				if err != nil {
-					logging.TraceLogger(ctx).
-						Err(err).
-						Msgf("failed to unsubscribe from subject stream %s", subject)
-				}
-				return
-			default:
-				msgs, _ := sub.Fetch(10, nats.Context(ctx))
-				for _, msg := range msgs {
-					var data Message
-					err := json.Unmarshal(msg.Data, &data)
-					if err != nil {
-						logging.TraceLogger(ctx).
-							Err(err).
-							Msgf("failed to unmarshal stream message with subject %s", msg.Subject)
-						err := msg.Nak()
-						if err != nil {
-							logging.TraceLogger(ctx).
-								Err(err).
-								Msgf("ack error for subject %s", msg.Subject)
-						}
-						continue
-					}
-					err = handler(ctx, data)
-					if err != nil {
-						logging.TraceLogger(ctx).
-							Err(err).
-							Msgf("stream handler error for subject %s", msg.Subject)
-						err := msg.Nak()
-						if err != nil {
-							logging.TraceLogger(ctx).
-								Err(err).
-								Msgf("ack error for subject %s", msg.Subject)
-						}
-					} else {
-						err := msg.Ack()
-						if err != nil {
-							logging.TraceLogger(ctx).
-								Err(err).
-								Msgf("ack error for subject %s", msg.Subject)
-						}
-					}
-				}
-			}
-		}
-	}()
+	if inspector, ok := s.broker.transport.(consumerInspector); ok {
+		consumer := s.broker.metrics.trackConsumer(func() (ConsumerInfo, error) {
+			return inspector.ConsumerInfo(subject, queueName)
+		}, domain, service, topic, queueName)
+		context.AfterFunc(ctx, func() {
+			s.broker.metrics.untrackConsumer(consumer)
+		})
+	}
 	return nil
 }
+
+func (s *Subscriber) handleStream(ctx context.Context, handle Handler, env StreamEnvelope, domain string, service string, topic string) {
+	msg := fromEnvelope(env.Envelope)
+	delivery := Delivery{
+		Subject:      msg.Subject,
+		Domain:       domain,
+		Service:      service,
+		Topic:        topic,
+		Stream:       true,
+		NumDelivered: env.NumDelivered,
+	}
+	data, err := s.broker.decode(ctx, msg)
+	if err != nil {
+		logging.TraceLogger(ctx).
+			Err(err).
+			Msgf("failed to unmarshal stream message with subject %s", msg.Subject)
+		s.broker.metrics.recordDecodeFailure(ctx, delivery)
+		// retried, decoding fails as well while a key or a claim check is unavailable
+		settle(ctx, s.broker.metrics, env, delivery, err)
+		return
+	}
+	start := time.Now()
+	err = handle(ContextWithDelivery(ctx, delivery), data)
+	s.broker.metrics.RecordHandled(ctx, delivery, data, time.Since(start), err)
+	if err != nil {
+		logging.TraceLogger(ctx).
+			Err(err).
+			Msgf("stream handler error for subject %s", msg.Subject)
+	}
+	if settle(ctx, s.broker.metrics, env, delivery, err) == outcomeAck {
+		s.broker.releaseClaim(ctx, msg)
+	}
+}
+
+// settle acks the envelope when the handler succeeded, terminates it when the handler returned ErrTerminate and naks
+// it otherwise. The outcome is only counted once it was acknowledged, an empty outcome is returned when that failed.
+func settle(ctx context.Context, metrics *BrokerMetrics, env StreamEnvelope, delivery Delivery, err error) string {
+	outcome, ack := outcomeAck, env.Ack
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrTerminate):
+		outcome, ack = outcomeTerm, env.Term
+	default:
+		outcome, ack = outcomeNak, env.Nak
+	}
+	err = ack()
+	if err != nil {
+		logging.TraceLogger(ctx).
+			Err(err).
+			Msgf("ack error for subject %s", delivery.Subject)
+		return ""
+	}
+	metrics.recordAck(ctx, delivery, outcome)
+	return outcome
+}
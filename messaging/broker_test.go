@@ -1,15 +1,25 @@
 package messaging_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/nats-io/nats-server/v2/server"
-	natsserver "github.com/nats-io/nats-server/v2/test"
-
+	"github.com/nats-io/nats.go"
 	"github.com/stretchr/testify/require"
+	configTest "github.com/thumperq/golib/config/test"
 	"github.com/thumperq/golib/messaging"
+	"github.com/thumperq/golib/messaging/test"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 )
 
 type orderCreated struct {
@@ -22,88 +32,725 @@ func (o orderCreated) Name() string {
 	return o.EventName
 }
 
-type mockCfgManager struct {
-	Value string
+func TestPublishAndSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := test.NewNatsBroker(t, "wms", "ordering")
+	received := make(chan messaging.Message, 1)
+	subscriber := messaging.NewSubscriber(broker)
+	err := subscriber.Subscribe(ctx, "wms", "ordering", "order", func(ctx context.Context, msg messaging.Message) error {
+		received <- msg
+		return nil
+	})
+	require.NoError(t, err)
+	err = broker.Publish("order", &orderCreated{
+		EventName: "orderCreated",
+		OrderId:   "123",
+		OrderType: "normal",
+	})
+	require.NoError(t, err)
+	requireOrderCreated(t, received)
 }
 
-func (m *mockCfgManager) GetValue(ctx context.Context, key string) (string, error) {
-	return m.Value, nil
+func TestStreamPublishAndSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := test.NewNatsBroker(t, "wms", "ordering")
+	err := broker.WithStream([]string{"order"})
+	require.NoError(t, err)
+	received := make(chan messaging.Message, 1)
+	subscriber := messaging.NewSubscriber(broker)
+	err = subscriber.SubscribeStream(ctx, "wms", "ordering", "order", func(ctx context.Context, msg messaging.Message) error {
+		received <- msg
+		return nil
+	})
+	require.NoError(t, err)
+	err = broker.PublishStream("order", &orderCreated{
+		EventName: "orderCreated",
+		OrderId:   "123",
+		OrderType: "normal",
+	})
+	require.NoError(t, err)
+	requireOrderCreated(t, received)
 }
 
-func (m *mockCfgManager) GetValueOfDomainService(ctx context.Context, domain string, service string, key string) (string, error) {
-	return m.Value, nil
-}
-func startNatsServer() *server.Server {
-	opts := natsserver.DefaultTestOptions
-	opts.Port = 4222
-	srv := natsserver.RunServer(&opts)
-	err := srv.EnableJetStream(&server.JetStreamConfig{})
-	if err != nil {
-		panic(err)
+func TestBroadcastSubscriberReceivesOnEveryReplica(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := test.NewNatsServer(t)
+	publisher := test.ConnectBroker(t, srv.ClientURL(), "wms", "ordering")
+	require.NoError(t, publisher.WithStream([]string{"order"}))
+	received := make(chan messaging.Message, 4)
+	for range 2 {
+		replica := test.ConnectBroker(t, srv.ClientURL(), "wms", "tracking")
+		subscriber := messaging.NewBroadcastSubscriber(replica)
+		err := subscriber.Subscribe(ctx, "wms", "ordering", "order", func(ctx context.Context, msg messaging.Message) error {
+			received <- msg
+			return nil
+		})
+		require.NoError(t, err)
+		err = subscriber.SubscribeStream(ctx, "wms", "ordering", "order", func(ctx context.Context, msg messaging.Message) error {
+			return nil
+		})
+		require.ErrorIs(t, err, messaging.ErrNotSupported)
 	}
-	return srv
-}
 
-func TestPublishAndSubscribe(t *testing.T) {
-	ctx, cancel := context.WithCancel(context.Background())
-	ns := startNatsServer()
-	mockCfgManager := &mockCfgManager{Value: ns.ClientURL()}
-	broker, err := messaging.NewBroker(mockCfgManager, "wms", "ordering")
-	require.NoError(t, err)
-	err = broker.Connect()
+	// messages published to streams reach the broadcast subscribers as well
+	err := publisher.PublishStream("order", &orderCreated{
+		EventName: "orderCreated",
+		OrderId:   "123",
+		OrderType: "normal",
+	})
 	require.NoError(t, err)
-	subscriber := messaging.NewSubscriber(broker)
-	err = subscriber.Subscribe(ctx, "wms", "ordering", "order", func(ctx context.Context, msg messaging.Message) error {
+	requireOrderCreated(t, received)
+	requireOrderCreated(t, received)
+}
+
+func requireOrderCreated(t *testing.T, received <-chan messaging.Message) {
+	t.Helper()
+	select {
+	case msg := <-received:
 		require.Equal(t, "orderCreated", msg.Name)
 		var event orderCreated
 		err := json.Unmarshal(msg.Data, &event)
 		require.NoError(t, err)
 		require.Equal(t, "123", event.OrderId)
 		require.Equal(t, "normal", event.OrderType)
-		cancel()
-		err = broker.Disconnect()
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "message not received")
+	}
+}
+
+func TestPublishStreamBatch(t *testing.T) {
+	srv := test.NewNatsServer(t)
+	broker := test.ConnectBroker(t, srv.ClientURL(), "wms", "ordering")
+	err := broker.WithStream([]string{"order"})
+	require.NoError(t, err)
+	events := []messaging.Event{}
+	for _, id := range []string{"1", "2", "3"} {
+		events = append(events, &orderCreated{EventName: "orderCreated", OrderId: id})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	acks, err := broker.PublishStreamBatch(ctx, "order", events)
+	require.NoError(t, err)
+	require.Len(t, acks, 3)
+	for i, ack := range acks {
+		require.Equal(t, "wms-ordering", ack.Stream)
+		require.Equal(t, uint64(i+1), ack.Sequence)
+	}
+
+	acks, err = broker.PublishStreamBatch(ctx, "invoice", events)
+	var batchErr *messaging.BatchError
+	require.ErrorAs(t, err, &batchErr)
+	require.Len(t, batchErr.Failures, 3)
+	require.Equal(t, 0, batchErr.Failures[0].Index)
+	require.Equal(t, []*messaging.PublishAck{nil, nil, nil}, acks)
+
+	// replicas publish to the existing stream without configuring it
+	replica := test.ConnectBroker(t, srv.ClientURL(), "wms", "ordering")
+	acks, err = replica.PublishStreamBatch(ctx, "order", events[:1])
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), acks[0].Sequence)
+	require.NoError(t, replica.FlushAsync(ctx))
+}
+
+func TestStreamCompressionAndEncryptionWithKeyRotation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := configTest.NewConfigManager()
+	cfg.WithKeyValue(messaging.CfgEncryptionKeyID, "v1").
+		WithKeyValue(messaging.CfgEncryptionKeyPrefix+"v1", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))).
+		WithKeyValue(messaging.CfgEncryptionKeyPrefix+"v2", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32)))
+	for _, compression := range []messaging.Compression{messaging.Gzip, messaging.Zstd, messaging.Snappy} {
+		t.Run(string(compression), func(t *testing.T) {
+			broker := test.NewNatsBroker(t, "wms", "ordering").
+				WithCompression(compression).
+				WithEncryption(messaging.NewCfgKeyProvider(cfg))
+			err := broker.WithStream([]string{"order"})
+			require.NoError(t, err)
+			cfg.WithKeyValue(messaging.CfgEncryptionKeyID, "v1")
+			err = broker.PublishStream("order", &orderCreated{EventName: "orderCreated", OrderId: "123", OrderType: "normal"})
+			require.NoError(t, err)
+			cfg.WithKeyValue(messaging.CfgEncryptionKeyID, "v2")
+			err = broker.PublishStream("order", &orderCreated{EventName: "orderCreated", OrderId: "123", OrderType: "normal"})
+			require.NoError(t, err)
+
+			received := make(chan messaging.Message, 2)
+			err = messaging.NewSubscriber(broker).SubscribeStream(ctx, "wms", "ordering", "order", func(ctx context.Context, msg messaging.Message) error {
+				received <- msg
+				return nil
+			})
+			require.NoError(t, err)
+			requireOrderCreated(t, received)
+			requireOrderCreated(t, received)
+		})
+	}
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, compression := range []messaging.Compression{messaging.Gzip, messaging.Zstd, messaging.Snappy} {
+		t.Run(string(compression), func(t *testing.T) {
+			srv := test.NewNatsServer(t)
+			publisher := test.ConnectBroker(t, srv.ClientURL(), "wms", "ordering").WithCompression(compression)
+			require.NoError(t, publisher.WithStream([]string{"order"}))
+			err := publisher.PublishStream("order", &orderCreated{EventName: "orderCreated", OrderId: "123", OrderType: strings.Repeat("x", 64<<10)})
+			require.NoError(t, err)
+			read := func(broker *messaging.Broker) error {
+				return broker.ReadStream(ctx, "wms", "ordering", "order", messaging.ReadOptions{}, func(messaging.StoredMessage) error {
+					return nil
+				})
+			}
+			require.NoError(t, read(publisher))
+
+			limited := test.ConnectBroker(t, srv.ClientURL(), "wms", "ordering")
+			require.NoError(t, limited.WithMaxDecompressedSize(32<<10))
+			require.ErrorIs(t, read(limited), messaging.ErrDecompressedTooLarge)
+		})
+	}
+}
+
+type recordingBlobStore struct {
+	messaging.BlobStore
+	mu    sync.Mutex
+	names []string
+}
+
+func (s *recordingBlobStore) Put(ctx context.Context, name string, data []byte) error {
+	s.mu.Lock()
+	s.names = append(s.names, name)
+	s.mu.Unlock()
+	return s.BlobStore.Put(ctx, name, data)
+}
+
+func TestStreamClaimCheck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := test.NewNatsBroker(t, "wms", "ordering")
+	objectStore, err := broker.NewObjectStore("wms-ordering-claims", time.Hour)
+	require.NoError(t, err)
+	store := &recordingBlobStore{BlobStore: objectStore}
+	broker.WithClaimCheck(messaging.ClaimCheck{Threshold: 1024, Store: store, DeleteOnAck: true})
+	err = broker.WithStream([]string{"order"})
+	require.NoError(t, err)
+	orderType := strings.Repeat("normal", 1024)
+	err = broker.PublishStream("order", &orderCreated{EventName: "orderCreated", OrderId: "123", OrderType: orderType})
+	require.NoError(t, err)
+	require.Len(t, store.names, 1)
+
+	received := make(chan orderCreated, 1)
+	err = messaging.NewSubscriber(broker).SubscribeStream(ctx, "wms", "ordering", "order", func(ctx context.Context, msg messaging.Message) error {
+		var event orderCreated
+		err := json.Unmarshal(msg.Data, &event)
 		require.NoError(t, err)
-		ns.Shutdown()
+		received <- event
 		return nil
 	})
 	require.NoError(t, err)
-	err = broker.Publish("order", &orderCreated{
-		EventName: "orderCreated",
-		OrderId:   "123",
-		OrderType: "normal",
+	select {
+	case event := <-received:
+		require.Equal(t, orderType, event.OrderType)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "message not received")
+	}
+	require.Eventually(t, func() bool {
+		_, err := objectStore.Get(ctx, store.names[0])
+		return errors.Is(err, nats.ErrObjectNotFound)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// no stream captures the topic, the blob of the failed publish is deleted
+	err = broker.PublishStream("invoice", &orderCreated{EventName: "orderCreated", OrderId: "124", OrderType: orderType})
+	require.Error(t, err)
+	require.Len(t, store.names, 2)
+	_, err = objectStore.Get(ctx, store.names[1])
+	require.ErrorIs(t, err, nats.ErrObjectNotFound)
+
+	// the existing bucket is bound
+	_, err = broker.NewObjectStore("wms-ordering-claims", time.Hour)
+	require.NoError(t, err)
+}
+
+func TestStreamHandlerPanicIsRedelivered(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := test.NewNatsBroker(t, "wms", "ordering")
+	err := broker.WithStream([]string{"order"})
+	require.NoError(t, err)
+	received := make(chan messaging.Message, 1)
+	deliveries := make(chan messaging.Delivery, 2)
+	subscriber := messaging.NewSubscriber(broker, messaging.Logging(), messaging.Timeout(time.Second))
+	err = subscriber.SubscribeStream(ctx, "wms", "ordering", "order", func(ctx context.Context, msg messaging.Message) error {
+		delivery, ok := messaging.DeliveryFromContext(ctx)
+		require.True(t, ok)
+		deliveries <- delivery
+		if delivery.NumDelivered == 1 {
+			panic("first delivery fails")
+		}
+		received <- msg
+		return nil
 	})
 	require.NoError(t, err)
-	ns.WaitForShutdown()
+	err = broker.PublishStream("order", &orderCreated{EventName: "orderCreated", OrderId: "123", OrderType: "normal"})
+	require.NoError(t, err)
+	requireOrderCreated(t, received)
+	first := <-deliveries
+	require.Equal(t, "wms.ordering.order", first.Subject)
+	require.Equal(t, "order", first.Topic)
+	require.Equal(t, uint64(2), (<-deliveries).NumDelivered)
 }
 
-func TestStreamPublishAndSubscribe(t *testing.T) {
+func TestBrokerMetrics(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	ns := startNatsServer()
-	mockCfgManager := &mockCfgManager{Value: ns.ClientURL()}
-	broker, err := messaging.NewBroker(mockCfgManager, "wms", "ordering")
+	reader := sdkmetric.NewManualReader()
+	srv := test.NewNatsServer(t)
+	broker := test.ConnectBroker(t, srv.ClientURL(), "wms", "ordering")
+	err := broker.WithMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
 	require.NoError(t, err)
 	err = broker.WithStream([]string{"order"})
 	require.NoError(t, err)
-	subscriber := messaging.NewSubscriber(broker)
-	err = subscriber.SubscribeStream(ctx, "wms", "ordering", "order", func(ctx context.Context, msg messaging.Message) error {
-		require.Equal(t, "orderCreated", msg.Name)
+	handled := make(chan string, 4)
+	var failed sync.Once
+	err = messaging.NewSubscriber(broker).SubscribeStream(ctx, "wms", "ordering", "order", func(ctx context.Context, msg messaging.Message) error {
 		var event orderCreated
-		err := json.Unmarshal(msg.Data, &event)
+		require.NoError(t, json.Unmarshal(msg.Data, &event))
+		handled <- event.OrderId
+		switch event.OrderId {
+		case "124":
+			return fmt.Errorf("unknown order type: %w", messaging.ErrTerminate)
+		case "125":
+			// redelivered after the nak
+			var err error
+			failed.Do(func() { err = errors.New("database unavailable") })
+			return err
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	err = messaging.NewSubscriber(broker).Subscribe(ctx, "wms", "ordering", "shipment", func(ctx context.Context, msg messaging.Message) error {
+		return nil
+	})
+	require.NoError(t, err)
+	for _, id := range []string{"123", "124", "125"} {
+		err = broker.PublishStream("order", &orderCreated{EventName: "orderCreated", OrderId: id, OrderType: "normal"})
 		require.NoError(t, err)
-		require.Equal(t, "123", event.OrderId)
-		require.Equal(t, "normal", event.OrderType)
-		err = broker.Disconnect()
+	}
+	conn, err := nats.Connect(srv.ClientURL())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.Publish("wms.ordering.shipment", []byte("not json")))
+	for range 4 {
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "message not handled")
+		}
+	}
+
+	order := []attribute.KeyValue{attribute.String("domain", "wms"), attribute.String("service", "ordering"), attribute.String("topic", "order")}
+	shipment := []attribute.KeyValue{attribute.String("domain", "wms"), attribute.String("service", "ordering"), attribute.String("topic", "shipment")}
+	require.Eventually(t, func() bool {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, reader.Collect(ctx, &rm))
+		return sumOf(rm, "messaging.acks", append(order, attribute.String("outcome", "ack"))...) == 2 &&
+			sumOf(rm, "messaging.decode_failures", shipment...) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(ctx, &rm))
+	require.Equal(t, int64(3), sumOf(rm, "messaging.published", append(order, attribute.Bool("stream", true))...))
+	require.Equal(t, int64(4), sumOf(rm, "messaging.consumed", order...))
+	require.Equal(t, int64(2), sumOf(rm, "messaging.consumed", append(order, attribute.Bool("error", true))...))
+	require.Equal(t, int64(1), sumOf(rm, "messaging.acks", append(order, attribute.String("outcome", "term"))...))
+	require.Equal(t, int64(1), sumOf(rm, "messaging.acks", append(order, attribute.String("outcome", "nak"))...))
+	require.Equal(t, int64(1), sumOf(rm, "messaging.redeliveries", order...))
+	require.Equal(t, int64(0), sumOf(rm, "messaging.decode_failures", order...))
+}
+
+// sumOf adds up the data points of the counter which carry all attributes.
+func sumOf(rm metricdata.ResourceMetrics, name string, attrs ...attribute.KeyValue) int64 {
+	var sum int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			data, ok := m.Data.(metricdata.Sum[int64])
+			if m.Name != name || !ok {
+				continue
+			}
+			for _, point := range data.DataPoints {
+				matches := true
+				for _, attr := range attrs {
+					value, found := point.Attributes.Value(attr.Key)
+					matches = matches && found && value == attr.Value
+				}
+				if matches {
+					sum += point.Value
+				}
+			}
+		}
+	}
+	return sum
+}
+
+func TestCrossDomainPublishWithEnvironment(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the environment only prefixes the subjects of brokers opting in
+	t.Setenv("ENVIRONMENT", "prod")
+	srv := test.NewNatsServer(t)
+	namer := messaging.DefaultSubjectNamer{Environment: "dev"}
+	ordering := test.ConnectBroker(t, srv.ClientURL(), "wms", "ordering").WithSubjectNamer(namer)
+	billing := test.ConnectBroker(t, srv.ClientURL(), "finance", "billing").WithSubjectNamer(namer)
+	err := ordering.WithStream([]string{"order"})
+	require.NoError(t, err)
+	plain := test.ConnectBroker(t, srv.ClientURL(), "wms", "ordering")
+	require.NoError(t, plain.WithStream([]string{"invoice"}))
+	streams, err := plain.Streams(ctx, "wms", "ordering")
+	require.NoError(t, err)
+	require.Len(t, streams, 1)
+	require.Equal(t, "wms-ordering", streams[0].Name)
+
+	received := make(chan messaging.Message, 1)
+	deliveries := make(chan messaging.Delivery, 1)
+	err = messaging.NewSubscriber(ordering).SubscribeStream(ctx, "wms", "ordering", "order", func(ctx context.Context, msg messaging.Message) error {
+		delivery, _ := messaging.DeliveryFromContext(ctx)
+		deliveries <- delivery
+		received <- msg
+		return nil
+	})
+	require.NoError(t, err)
+	err = billing.PublishStreamTo("wms", "ordering", "order", &orderCreated{EventName: "orderCreated", OrderId: "123", OrderType: "normal"})
+	require.NoError(t, err)
+	requireOrderCreated(t, received)
+	require.Equal(t, "dev.wms.ordering.order", (<-deliveries).Subject)
+}
+
+func TestReadStreamAndRepublish(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	broker := test.NewNatsBroker(t, "wms", "ordering")
+	err := broker.WithStream([]string{"order", "replay"})
+	require.NoError(t, err)
+	for _, name := range []string{"orderCreated", "orderCancelled", "orderCreated"} {
+		err = broker.PublishStream("order", &orderCreated{EventName: name, OrderId: "123", OrderType: "normal"})
 		require.NoError(t, err)
-		ns.Shutdown()
+	}
+	streams, err := broker.Streams(ctx, "wms", "ordering")
+	require.NoError(t, err)
+	require.Len(t, streams, 1)
+	require.Equal(t, uint64(3), streams[0].Messages)
+
+	found := []messaging.StoredMessage{}
+	err = broker.ReadStream(ctx, "wms", "ordering", "order", messaging.ReadOptions{EventName: "orderCreated"}, func(msg messaging.StoredMessage) error {
+		found = append(found, msg)
 		return nil
 	})
 	require.NoError(t, err)
-	err = broker.PublishStream("order", &orderCreated{
-		EventName: "orderCreated",
-		OrderId:   "123",
-		OrderType: "normal",
+	require.Len(t, found, 2)
+	require.Equal(t, []uint64{1, 3}, []uint64{found[0].Sequence, found[1].Sequence})
+
+	err = broker.Republish("wms", "ordering", "replay", found[1])
+	require.NoError(t, err)
+	replayed := []messaging.StoredMessage{}
+	err = broker.ReadStream(ctx, "wms", "ordering", "replay", messaging.ReadOptions{}, func(msg messaging.StoredMessage) error {
+		replayed = append(replayed, msg)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, replayed, 1)
+	require.Equal(t, found[1].Message, replayed[0].Message)
+}
+
+type reportGenerated struct {
+	OrderId string `json:"orderId"`
+}
+
+func (r reportGenerated) Name() string {
+	return "reportGenerated"
+}
+
+func TestWorkQueuePriorityHeartbeatAndResult(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	broker := test.NewNatsBroker(t, "wms", "ordering")
+	err := broker.WithStream([]string{"report-result"})
+	require.NoError(t, err)
+	err = broker.WithWorkQueue([]string{"report-urgent", "report"})
+	require.NoError(t, err)
+	for _, id := range []string{"1", "2"} {
+		err = broker.PublishJob("report", &orderCreated{EventName: "reportRequested", OrderId: id}, "report-result")
+		require.NoError(t, err)
+	}
+	err = broker.PublishJob("report-urgent", &orderCreated{EventName: "reportRequested", OrderId: "3"}, "report-result")
+	require.NoError(t, err)
+	err = broker.PublishJob("report", &orderCreated{EventName: "reportRequested", OrderId: "poison"}, "")
+	require.NoError(t, err)
+
+	handled := make(chan messaging.Delivery, 10)
+	order := []string{}
+	err = messaging.NewWorkQueue(broker).Subscribe(ctx, "wms", "ordering", []string{"report-urgent", "report"}, func(ctx context.Context, msg messaging.Message) (messaging.Event, error) {
+		var job orderCreated
+		require.NoError(t, json.Unmarshal(msg.Data, &job))
+		delivery, _ := messaging.DeliveryFromContext(ctx)
+		order = append(order, job.OrderId)
+		handled <- delivery
+		if job.OrderId == "poison" {
+			return nil, fmt.Errorf("unsupported report: %w", messaging.ErrTerminate)
+		}
+		if job.OrderId == "3" {
+			time.Sleep(1500 * time.Millisecond)
+		}
+		return reportGenerated{OrderId: job.OrderId}, nil
+	}, messaging.WorkQueueOptions{AckWait: time.Second})
+	require.NoError(t, err)
+
+	for range 4 {
+		select {
+		case delivery := <-handled:
+			require.Equal(t, uint64(1), delivery.NumDelivered)
+		case <-time.After(10 * time.Second):
+			require.Fail(t, "job not handled")
+		}
+	}
+	require.Equal(t, []string{"3", "1", "2", "poison"}, order)
+	select {
+	case delivery := <-handled:
+		require.Failf(t, "job redelivered", "%+v", delivery)
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	results := []string{}
+	err = broker.ReadStream(ctx, "wms", "ordering", "report-result", messaging.ReadOptions{}, func(msg messaging.StoredMessage) error {
+		var report reportGenerated
+		require.NoError(t, json.Unmarshal(msg.Message.Data, &report))
+		results = append(results, report.OrderId)
+		return nil
 	})
 	require.NoError(t, err)
-	ns.WaitForShutdown()
+	require.Equal(t, []string{"3", "1", "2"}, results)
+	streams, err := broker.Streams(ctx, "wms", "ordering")
+	require.NoError(t, err)
+	for _, s := range streams {
+		if s.Name == "wms-ordering-workqueue" {
+			require.Zero(t, s.Messages)
+		}
+	}
+}
+
+type orderUpdated struct {
+	OrderId string `json:"orderId"`
+	Version int    `json:"version"`
+}
+
+func (o orderUpdated) Name() string {
+	return "orderUpdated"
+}
+
+func TestPartitionedOrderingAndRebalance(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	srv := test.NewNatsServer(t)
+	publisher := test.ConnectBroker(t, srv.ClientURL(), "wms", "ordering")
+	err := publisher.WithPartitionedStream("order", 4)
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	versions := map[string][]int{}
+	handledBy := map[string]int{}
+	subscribe := func(ctx context.Context, replica string) {
+		broker := test.ConnectBroker(t, srv.ClientURL(), "wms", "ordering")
+		require.NoError(t, broker.WithPartitionsOf("wms", "ordering", "order", 4))
+		err := messaging.NewPartitionedSubscriber(broker).WithHeartbeat(100*time.Millisecond).Subscribe(ctx, "wms", "ordering", "order", func(ctx context.Context, msg messaging.Message) error {
+			var event orderUpdated
+			require.NoError(t, json.Unmarshal(msg.Data, &event))
+			mu.Lock()
+			defer mu.Unlock()
+			versions[event.OrderId] = append(versions[event.OrderId], event.Version)
+			handledBy[replica]++
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	publish := func(from int, to int) {
+		for v := from; v < to; v++ {
+			for _, id := range []string{"a", "b", "c", "d", "e", "f"} {
+				err := publisher.PublishPartitioned("order", id, &orderUpdated{OrderId: id, Version: v})
+				require.NoError(t, err)
+			}
+		}
+	}
+	requireInOrder := func(count int) {
+		require.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, id := range []string{"a", "b", "c", "d", "e", "f"} {
+				if len(versions[id]) < count {
+					return false
+				}
+			}
+			return true
+		}, 10*time.Second, 50*time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		for id, vs := range versions {
+			require.Len(t, vs, count, id)
+			for i, v := range vs {
+				require.Equal(t, i, v, id)
+			}
+		}
+	}
+
+	subscribe(ctx, "first")
+	secondCtx, stopSecond := context.WithCancel(ctx)
+	subscribe(secondCtx, "second")
+	time.Sleep(500 * time.Millisecond)
+	publish(0, 10)
+	requireInOrder(10)
+	require.NotZero(t, handledBy["first"])
+	require.NotZero(t, handledBy["second"])
+
+	stopSecond()
+	time.Sleep(500 * time.Millisecond)
+	mu.Lock()
+	second := handledBy["second"]
+	mu.Unlock()
+	publish(10, 20)
+	requireInOrder(20)
+	require.Equal(t, second, handledBy["second"])
+}
+
+func TestRevokedPartitionCancelsItsHandler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	srv := test.NewNatsServer(t)
+	publisher := test.ConnectBroker(t, srv.ClientURL(), "wms", "ordering")
+	err := publisher.WithPartitionedStream("order", 2)
+	require.NoError(t, err)
+	subscribe := func(handler func(ctx context.Context, msg messaging.Message) error) {
+		broker := test.ConnectBroker(t, srv.ClientURL(), "wms", "ordering")
+		require.NoError(t, broker.WithPartitionsOf("wms", "ordering", "order", 2))
+		err := messaging.NewPartitionedSubscriber(broker).WithHeartbeat(100*time.Millisecond).Subscribe(ctx, "wms", "ordering", "order", handler)
+		require.NoError(t, err)
+	}
+	started := make(chan struct{}, 2)
+	cancelled := make(chan struct{}, 2)
+	subscribe(func(ctx context.Context, msg messaging.Message) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		cancelled <- struct{}{}
+		return ctx.Err()
+	})
+	for _, id := range []string{"a", "b", "c", "d", "e", "f"} {
+		err := publisher.PublishPartitioned("order", id, &orderUpdated{OrderId: id})
+		require.NoError(t, err)
+	}
+	for range 2 {
+		select {
+		case <-started:
+		case <-time.After(10 * time.Second):
+			require.Fail(t, "partitions not consumed")
+		}
+	}
+
+	// the second replica takes over a partition, the handler of the first one on it is cancelled
+	subscribe(func(ctx context.Context, msg messaging.Message) error {
+		return nil
+	})
+	select {
+	case <-cancelled:
+	case <-time.After(10 * time.Second):
+		require.Fail(t, "handler of the revoked partition not cancelled")
+	}
+	require.NoError(t, ctx.Err())
+}
+
+func TestPartitionsConfiguredWhilePublishing(t *testing.T) {
+	broker, err := messaging.NewBrokerWithTransport(messaging.NewChannelTransport(), "wms", "ordering")
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = broker.WithPartitionsOf("wms", "ordering", fmt.Sprintf("order%d", i), 4)
+		}()
+		go func() {
+			defer wg.Done()
+			_ = broker.PublishPartitioned(fmt.Sprintf("order%d", i), "a", &orderUpdated{OrderId: "a"})
+		}()
+	}
+	wg.Wait()
+}
+
+func TestInvalidPartitions(t *testing.T) {
+	broker := test.NewNatsBroker(t, "wms", "ordering")
+	for _, partitions := range []int{0, -1} {
+		require.ErrorIs(t, broker.WithPartitionedStream("order", partitions), messaging.ErrInvalidPartitions)
+		require.ErrorIs(t, broker.WithPartitionsOf("wms", "ordering", "order", partitions), messaging.ErrInvalidPartitions)
+	}
+	err := broker.PublishPartitioned("order", "a", &orderUpdated{OrderId: "a"})
+	require.EqualError(t, err, "partitions of topic order are not configured")
+}
+
+func TestChannelTransport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	transport := messaging.NewChannelTransport()
+	ordering, err := messaging.NewBrokerWithTransport(transport, "wms", "ordering")
+	require.NoError(t, err)
+	billing, err := messaging.NewBrokerWithTransport(transport, "finance", "billing")
+	require.NoError(t, err)
+	billing.WithCompression(messaging.Gzip)
+
+	received := make(chan messaging.Message, 10)
+	for range 2 {
+		err = messaging.NewSubscriber(ordering).Subscribe(ctx, "wms", "ordering", "order", func(ctx context.Context, msg messaging.Message) error {
+			received <- msg
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	err = billing.PublishTo("wms", "ordering", "order", &orderCreated{EventName: "orderCreated", OrderId: "123", OrderType: "normal"})
+	require.NoError(t, err)
+	requireOrderCreated(t, received)
+	select {
+	case <-received:
+		require.Fail(t, "message delivered to both queue group members")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.Error(t, ordering.PublishStream("order", &orderCreated{EventName: "orderCreated", OrderId: "123", OrderType: "normal"}))
+	err = ordering.WithStream([]string{"order"})
+	require.NoError(t, err)
+	err = billing.PublishStreamTo("wms", "ordering", "order", &orderCreated{EventName: "orderCreated", OrderId: "123", OrderType: "normal"})
+	require.NoError(t, err)
+	deliveries := make(chan messaging.Delivery, 2)
+	err = messaging.NewSubscriber(ordering).SubscribeStream(ctx, "wms", "ordering", "order", func(ctx context.Context, msg messaging.Message) error {
+		delivery, _ := messaging.DeliveryFromContext(ctx)
+		deliveries <- delivery
+		if delivery.NumDelivered == 1 {
+			return errors.New("first delivery fails")
+		}
+		received <- msg
+		return nil
+	})
+	require.NoError(t, err)
+	requireOrderCreated(t, received)
+	require.Equal(t, uint64(1), (<-deliveries).NumDelivered)
+	require.Equal(t, uint64(2), (<-deliveries).NumDelivered)
+
+	require.ErrorIs(t, ordering.WithWorkQueue([]string{"report"}), messaging.ErrNotSupported)
+}
+
+func TestBrokerPing(t *testing.T) {
+	srv := test.NewNatsServer(t)
+	broker := test.ConnectBroker(t, srv.ClientURL(), "wms", "ordering")
+	require.NoError(t, broker.Ping(context.Background()))
+
+	srv.Shutdown()
+	require.Eventually(t, func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		return broker.Ping(ctx) != nil
+	}, 5*time.Second, 50*time.Millisecond)
 }
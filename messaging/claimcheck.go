@@ -0,0 +1,158 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/thumperq/golib/logging"
+)
+
+const (
+	headerClaimCheck = "Golib-Claim-Check"
+
+	// claimCheckHeadroom keeps room for headers when the threshold is derived from the server max payload
+	claimCheckHeadroom = 4 * 1024
+)
+
+type BlobStore interface {
+	Put(ctx context.Context, name string, data []byte) error
+	Get(ctx context.Context, name string) ([]byte, error)
+	Delete(ctx context.Context, name string) error
+}
+
+// ClaimCheck moves payloads larger than Threshold bytes into Store and publishes a reference instead.
+// A Threshold of zero uses the max payload announced by the server. DeleteOnAck removes the blob once a stream
+// consumer acknowledged the message, only enable it when a single consumer reads the topic and rely on the
+// store expiry otherwise.
+type ClaimCheck struct {
+	Threshold   int
+	Store       BlobStore
+	DeleteOnAck bool
+}
+
+type objectStoreBlobStore struct {
+	store nats.ObjectStore
+}
+
+// WithClaimCheck enables the claim check pattern for published and consumed messages.
+func (b *Broker) WithClaimCheck(claimCheck ClaimCheck) *Broker {
+	b.claimCheck = &claimCheck
+	return b
+}
+
+// NewObjectStore returns a blob store backed by the JetStream object store bucket, objects expire after ttl.
+func (b *Broker) NewObjectStore(bucket string, ttl time.Duration) (BlobStore, error) {
+	if bucket == "" {
+		return nil, errors.New("object store bucket is empty")
+	}
+	js, err := b.jetStream()
+	if err != nil {
+		return nil, err
+	}
+	store, err := js.CreateObjectStore(&nats.ObjectStoreConfig{
+		Bucket: bucket,
+		TTL:    ttl,
+	})
+	if errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+		store, err = js.ObjectStore(bucket)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &objectStoreBlobStore{store: store}, nil
+}
+
+// ObjectStore returns a blob store backed by an existing JetStream object store bucket, e.g. to read claim checks
+// without creating the bucket.
+func (b *Broker) ObjectStore(bucket string) (BlobStore, error) {
+	if bucket == "" {
+		return nil, errors.New("object store bucket is empty")
+	}
+	js, err := b.jetStream()
+	if err != nil {
+		return nil, err
+	}
+	store, err := js.ObjectStore(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return &objectStoreBlobStore{store: store}, nil
+}
+
+func (s *objectStoreBlobStore) Put(ctx context.Context, name string, data []byte) error {
+	_, err := s.store.PutBytes(name, data, nats.Context(ctx))
+	return err
+}
+
+func (s *objectStoreBlobStore) Get(ctx context.Context, name string) ([]byte, error) {
+	return s.store.GetBytes(name, nats.Context(ctx))
+}
+
+func (s *objectStoreBlobStore) Delete(ctx context.Context, name string) error {
+	return s.store.Delete(name)
+}
+
+func (b *Broker) checkIn(ctx context.Context, msg *nats.Msg) error {
+	if b.claimCheck == nil {
+		return nil
+	}
+	threshold := b.claimCheck.Threshold
+	if t, ok := b.transport.(*natsTransport); threshold <= 0 && ok && t.connection != nil {
+		threshold = int(t.connection.MaxPayload()) - claimCheckHeadroom
+	}
+	if threshold <= 0 || len(msg.Data) <= threshold {
+		return nil
+	}
+	if b.claimCheck.Store == nil {
+		return errors.New("claim check store is not configured")
+	}
+	name := nuid.Next()
+	err := b.claimCheck.Store.Put(ctx, name, msg.Data)
+	if err != nil {
+		return err
+	}
+	msg.Header.Set(headerClaimCheck, name)
+	msg.Data = nil
+	return nil
+}
+
+func (b *Broker) checkOut(ctx context.Context, msg *nats.Msg) ([]byte, error) {
+	name := msg.Header.Get(headerClaimCheck)
+	if name == "" {
+		return msg.Data, nil
+	}
+	if b.claimCheck == nil || b.claimCheck.Store == nil {
+		return nil, errors.New("message carries a claim check but no claim check store is configured")
+	}
+	return b.claimCheck.Store.Get(ctx, name)
+}
+
+func (b *Broker) releaseClaim(ctx context.Context, msg *nats.Msg) {
+	name := msg.Header.Get(headerClaimCheck)
+	if name == "" || b.claimCheck == nil || b.claimCheck.Store == nil || !b.claimCheck.DeleteOnAck {
+		return
+	}
+	err := b.claimCheck.Store.Delete(ctx, name)
+	if err != nil {
+		logging.TraceLogger(ctx).
+			Err(err).
+			Msgf("failed to delete claim check %s for subject %s", name, msg.Subject)
+	}
+}
+
+// discardClaim deletes the blob of a message which failed to publish, no consumer will ever check it out.
+func (b *Broker) discardClaim(ctx context.Context, msg *nats.Msg) {
+	name := msg.Header.Get(headerClaimCheck)
+	if name == "" || b.claimCheck == nil || b.claimCheck.Store == nil {
+		return
+	}
+	err := b.claimCheck.Store.Delete(ctx, name)
+	if err != nil {
+		logging.TraceLogger(ctx).
+			Err(err).
+			Msgf("failed to delete claim check %s of unpublished message with subject %s", name, msg.Subject)
+	}
+}
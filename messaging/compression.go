@@ -0,0 +1,99 @@
+package messaging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	headerContentEncoding = "Content-Encoding"
+
+	defaultMaxDecompressedSize = 64 << 20
+)
+
+// ErrDecompressedTooLarge is returned for compressed payloads expanding beyond the limit of the broker.
+var ErrDecompressedTooLarge = errors.New("decompressed payload is too large")
+
+type Compression string
+
+const (
+	NoCompression Compression = ""
+	Gzip          Compression = "gzip"
+	Zstd          Compression = "zstd"
+	Snappy        Compression = "snappy"
+)
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// newZstdDecoder returns a decoder failing with zstd.ErrDecoderSizeExceeded for payloads expanding beyond the limit.
+func newZstdDecoder(limit int64) (*zstd.Decoder, error) {
+	return zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(limit)))
+}
+
+func compress(compression Compression, data []byte) ([]byte, error) {
+	switch compression {
+	case NoCompression:
+		return data, nil
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Zstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case Snappy:
+		return s2.EncodeSnappy(nil, data), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %s", compression)
+}
+
+// decompress fails with ErrDecompressedTooLarge instead of expanding the payload beyond the limit.
+func decompress(compression Compression, data []byte, limit int64, zstdDecoder *zstd.Decoder) ([]byte, error) {
+	switch compression {
+	case NoCompression:
+		return data, nil
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		decompressed, err := io.ReadAll(io.LimitReader(r, limit+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(decompressed)) > limit {
+			return nil, ErrDecompressedTooLarge
+		}
+		return decompressed, nil
+	case Zstd:
+		decompressed, err := zstdDecoder.DecodeAll(data, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			return nil, ErrDecompressedTooLarge
+		}
+		return decompressed, err
+	case Snappy:
+		n, err := s2.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if int64(n) > limit {
+			return nil, ErrDecompressedTooLarge
+		}
+		return s2.Decode(nil, data)
+	}
+	return nil, fmt.Errorf("unsupported compression %s", compression)
+}
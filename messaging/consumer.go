@@ -11,18 +11,20 @@ type Worker interface {
 }
 
 type worker struct {
-	broker *Broker
+	broker      *Broker
+	middlewares []Middleware
 }
 
-func NewWorker(broker *Broker) Worker {
+func NewWorker(broker *Broker, middlewares ...Middleware) Worker {
 	return &worker{
-		broker: broker,
+		broker:      broker,
+		middlewares: middlewares,
 	}
 }
 
 func (cw *worker) Run(consumer Consumer) func(ctx context.Context, domain string, service string, topic string) error {
 	return func(ctx context.Context, domain string, service string, topic string) error {
-		return NewSubscriber(cw.broker).
+		return NewSubscriber(cw.broker, cw.middlewares...).
 			Subscribe(ctx, domain, service, topic, consumer.Handle)
 	}
 }
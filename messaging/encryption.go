@@ -0,0 +1,265 @@
+package messaging
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/nats-io/nats.go"
+	"github.com/thumperq/golib/config"
+)
+
+const (
+	headerEncryption = "Golib-Encryption"
+	headerKeyID      = "Golib-Key-Id"
+	headerDataKey    = "Golib-Data-Key"
+
+	encryptionAES256GCM = "AES-256-GCM"
+
+	// CfgEncryptionKeyID is the config key holding the id of the key new messages are encrypted with.
+	CfgEncryptionKeyID = "MESSAGING_ENCRYPTION_KEY_ID"
+	// CfgEncryptionKeyPrefix prefixes the config keys holding the base64 encoded 32 byte keys, e.g. MESSAGING_ENCRYPTION_KEY_v2.
+	CfgEncryptionKeyPrefix = "MESSAGING_ENCRYPTION_KEY_"
+
+	vaultDataKeyTTL    = 5 * time.Minute
+	vaultDataKeyCached = 1024
+)
+
+// DataKey is the per message key of the envelope encryption. Plaintext encrypts the payload while
+// KeyID and Wrapped travel in the message headers so consumers can recover the plaintext key.
+type DataKey struct {
+	KeyID     string
+	Plaintext []byte
+	Wrapped   []byte
+}
+
+type KeyProvider interface {
+	DataKey(ctx context.Context) (*DataKey, error)
+	DecryptDataKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// CfgKeyProvider wraps random data keys with master keys read through the config manager.
+// Rotating means adding a new MESSAGING_ENCRYPTION_KEY_<id> and pointing MESSAGING_ENCRYPTION_KEY_ID at it,
+// messages encrypted with older ids stay readable as long as their keys are kept.
+type CfgKeyProvider struct {
+	cfg  config.CfgManager
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+func NewCfgKeyProvider(cfg config.CfgManager) *CfgKeyProvider {
+	return &CfgKeyProvider{
+		cfg:  cfg,
+		keys: make(map[string][]byte),
+	}
+}
+
+func (p *CfgKeyProvider) DataKey(ctx context.Context) (*DataKey, error) {
+	keyID, err := p.cfg.GetValue(ctx, CfgEncryptionKeyID)
+	if err != nil {
+		return nil, err
+	}
+	if keyID == "" {
+		return nil, errors.New("encryption key id is empty")
+	}
+	masterKey, err := p.masterKey(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, 32)
+	_, err = rand.Read(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := seal(masterKey, plaintext, []byte(keyID))
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{
+		KeyID:     keyID,
+		Plaintext: plaintext,
+		Wrapped:   wrapped,
+	}, nil
+}
+
+func (p *CfgKeyProvider) DecryptDataKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	masterKey, err := p.masterKey(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	return open(masterKey, wrapped, []byte(keyID))
+}
+
+func (p *CfgKeyProvider) masterKey(ctx context.Context, keyID string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[keyID]; ok {
+		return key, nil
+	}
+	value, err := p.cfg.GetValue(ctx, CfgEncryptionKeyPrefix+keyID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key %s is not base64 encoded: %w", keyID, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key %s must be 32 bytes", keyID)
+	}
+	p.keys[keyID] = key
+	return key, nil
+}
+
+// VaultTransitKeyProvider generates data keys with the Vault transit secrets engine.
+// A data key is reused for five minutes and unwrapped keys are cached, so Vault is not called for every message.
+// Vault prefixes the wrapped key with the transit key version, which keeps messages readable after rotating the key.
+type VaultTransitKeyProvider struct {
+	client  *vault.Client
+	mount   string
+	keyName string
+	mu      sync.Mutex
+	current *DataKey
+	expires time.Time
+	cache   map[string][]byte
+}
+
+func NewVaultTransitKeyProvider(client *vault.Client, mount string, keyName string) *VaultTransitKeyProvider {
+	if mount == "" {
+		mount = "transit"
+	}
+	return &VaultTransitKeyProvider{
+		client:  client,
+		mount:   mount,
+		keyName: keyName,
+		cache:   make(map[string][]byte),
+	}
+}
+
+func (p *VaultTransitKeyProvider) DataKey(ctx context.Context) (*DataKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current != nil && time.Now().Before(p.expires) {
+		return p.current, nil
+	}
+	secret, err := p.client.Logical().WriteWithContext(ctx, fmt.Sprintf("%s/datakey/plaintext/%s", p.mount, p.keyName), nil)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("vault transit returned no data key")
+	}
+	plaintextB64, _ := secret.Data["plaintext"].(string)
+	ciphertext, _ := secret.Data["ciphertext"].(string)
+	plaintext, err := base64.StdEncoding.DecodeString(plaintextB64)
+	if err != nil {
+		return nil, err
+	}
+	p.current = &DataKey{
+		KeyID:     p.keyName,
+		Plaintext: plaintext,
+		Wrapped:   []byte(ciphertext),
+	}
+	p.expires = time.Now().Add(vaultDataKeyTTL)
+	return p.current, nil
+}
+
+func (p *VaultTransitKeyProvider) DecryptDataKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.cache[string(wrapped)]; ok {
+		return key, nil
+	}
+	secret, err := p.client.Logical().WriteWithContext(ctx, fmt.Sprintf("%s/decrypt/%s", p.mount, keyID), map[string]any{
+		"ciphertext": string(wrapped),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("vault transit returned no plaintext")
+	}
+	plaintextB64, _ := secret.Data["plaintext"].(string)
+	key, err := base64.StdEncoding.DecodeString(plaintextB64)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.cache) >= vaultDataKeyCached {
+		clear(p.cache)
+	}
+	p.cache[string(wrapped)] = key
+	return key, nil
+}
+
+func encrypt(ctx context.Context, keys KeyProvider, data []byte, header nats.Header) ([]byte, error) {
+	dataKey, err := keys.DataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := seal(dataKey.Plaintext, data, []byte(dataKey.KeyID))
+	if err != nil {
+		return nil, err
+	}
+	header.Set(headerEncryption, encryptionAES256GCM)
+	header.Set(headerKeyID, dataKey.KeyID)
+	header.Set(headerDataKey, base64.StdEncoding.EncodeToString(dataKey.Wrapped))
+	return ciphertext, nil
+}
+
+func decrypt(ctx context.Context, keys KeyProvider, data []byte, algorithm string, keyID string, wrappedB64 string) ([]byte, error) {
+	if algorithm != encryptionAES256GCM {
+		return nil, fmt.Errorf("unsupported encryption %s", algorithm)
+	}
+	if keys == nil {
+		return nil, errors.New("message is encrypted but no key provider is configured")
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(wrappedB64)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := keys.DecryptDataKey(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return open(dataKey, data, []byte(keyID))
+}
+
+func seal(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(key []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,98 @@
+package messaging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/require"
+	"github.com/thumperq/golib/messaging"
+)
+
+// transitStub speaks the datakey and decrypt endpoints of the Vault transit secrets engine. The wrapped keys are the
+// base64 keys prefixed with the key version, like Vault does.
+type transitStub struct {
+	mu       sync.Mutex
+	datakeys int
+	decrypts int
+}
+
+func (s *transitStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	var data map[string]any
+	switch r.URL.Path {
+	case "/v1/transit/datakey/plaintext/orders":
+		s.datakeys++
+		data = map[string]any{"plaintext": key, "ciphertext": "vault:v1:" + key}
+	case "/v1/transit/decrypt/orders":
+		s.decrypts++
+		var req struct {
+			Ciphertext string `json:"ciphertext"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || !strings.HasPrefix(req.Ciphertext, "vault:v1:") {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errors":["invalid ciphertext"]}`))
+			return
+		}
+		data = map[string]any{"plaintext": strings.TrimPrefix(req.Ciphertext, "vault:v1:")}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"errors":[]}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func (s *transitStub) calls() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.datakeys, s.decrypts
+}
+
+func TestVaultTransitKeyProvider(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stub := &transitStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	vaultCfg := vault.DefaultConfig()
+	vaultCfg.Address = server.URL
+	client, err := vault.NewClient(vaultCfg)
+	require.NoError(t, err)
+	client.SetToken("test")
+
+	broker, err := messaging.NewBrokerWithTransport(messaging.NewChannelTransport(), "wms", "ordering")
+	require.NoError(t, err)
+	broker.WithEncryption(messaging.NewVaultTransitKeyProvider(client, "", "orders"))
+	received := make(chan messaging.Message, 2)
+	err = messaging.NewSubscriber(broker).Subscribe(ctx, "wms", "ordering", "order", func(ctx context.Context, msg messaging.Message) error {
+		received <- msg
+		return nil
+	})
+	require.NoError(t, err)
+	for range 2 {
+		err = broker.Publish("order", &orderCreated{EventName: "orderCreated", OrderId: "123", OrderType: "normal"})
+		require.NoError(t, err)
+	}
+	requireOrderCreated(t, received)
+	requireOrderCreated(t, received)
+
+	// the data key is reused and its unwrapped key cached
+	datakeys, decrypts := stub.calls()
+	require.Equal(t, 1, datakeys)
+	require.Equal(t, 1, decrypts)
+
+	_, err = messaging.NewVaultTransitKeyProvider(client, "", "orders").DecryptDataKey(ctx, "orders", []byte("vault:v2:unknown"))
+	require.Error(t, err)
+}
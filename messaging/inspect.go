@@ -0,0 +1,180 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+var ErrStopReading = errors.New("stop reading")
+
+type StreamInfo struct {
+	Name      string
+	Subjects  []string
+	Messages  uint64
+	Bytes     uint64
+	FirstSeq  uint64
+	LastSeq   uint64
+	Consumers int
+}
+
+type ConsumerInfo struct {
+	Stream         string
+	Name           string
+	NumPending     uint64
+	NumAckPending  int
+	NumRedelivered int
+}
+
+// StoredMessage is a decoded message read from a stream.
+type StoredMessage struct {
+	Stream   string
+	Sequence uint64
+	Subject  string
+	Time     time.Time
+	Headers  map[string][]string
+	Message  Message
+}
+
+// ReadOptions selects the messages ReadStream passes on. Without StartSequence or Since the stream is read from the start.
+// Follow keeps waiting for new messages until the context is done, otherwise reading stops at the end of the stream.
+type ReadOptions struct {
+	StartSequence uint64
+	Since         time.Time
+	Until         time.Time
+	EventName     string
+	Limit         int
+	Follow        bool
+}
+
+// RawEvent republishes an already encoded event, its data is sent unchanged.
+type RawEvent struct {
+	EventName string
+	Data      json.RawMessage
+}
+
+func (e RawEvent) Name() string {
+	return e.EventName
+}
+
+func (e RawEvent) MarshalJSON() ([]byte, error) {
+	return e.Data, nil
+}
+
+// Streams lists the streams capturing subjects of the domain and service.
+func (b *Broker) Streams(ctx context.Context, domain string, service string) ([]StreamInfo, error) {
+	js, err := b.jetStream()
+	if err != nil {
+		return nil, err
+	}
+	streams := []StreamInfo{}
+	for info := range js.StreamsInfo(nats.Context(ctx), nats.StreamListFilter(b.namer.Subject(domain, service, ">"))) {
+		streams = append(streams, StreamInfo{
+			Name:      info.Config.Name,
+			Subjects:  info.Config.Subjects,
+			Messages:  info.State.Msgs,
+			Bytes:     info.State.Bytes,
+			FirstSeq:  info.State.FirstSeq,
+			LastSeq:   info.State.LastSeq,
+			Consumers: info.State.Consumers,
+		})
+	}
+	return streams, ctx.Err()
+}
+
+// Consumers lists the consumers of the stream.
+func (b *Broker) Consumers(ctx context.Context, stream string) ([]ConsumerInfo, error) {
+	js, err := b.jetStream()
+	if err != nil {
+		return nil, err
+	}
+	consumers := []ConsumerInfo{}
+	for info := range js.ConsumersInfo(stream, nats.Context(ctx)) {
+		consumers = append(consumers, toConsumerInfo(info))
+	}
+	return consumers, ctx.Err()
+}
+
+// ReadStream decodes the stream messages of the topic with an ephemeral ordered consumer and passes the selected ones to fn.
+// Reading stops when fn returns an error, which is returned unless it is ErrStopReading.
+func (b *Broker) ReadStream(ctx context.Context, domain string, service string, topic string, opts ReadOptions, fn func(StoredMessage) error) error {
+	js, err := b.jetStream()
+	if err != nil {
+		return err
+	}
+	subOpts := []nats.SubOpt{nats.OrderedConsumer()}
+	switch {
+	case opts.StartSequence > 0:
+		subOpts = append(subOpts, nats.StartSequence(opts.StartSequence))
+	case !opts.Since.IsZero():
+		subOpts = append(subOpts, nats.StartTime(opts.Since))
+	default:
+		subOpts = append(subOpts, nats.DeliverAll())
+	}
+	sub, err := js.SubscribeSync(b.namer.Subject(domain, service, topic), subOpts...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+	read := 0
+	for opts.Limit <= 0 || read < opts.Limit {
+		waitCtx := ctx
+		var cancel context.CancelFunc = func() {}
+		if !opts.Follow {
+			waitCtx, cancel = context.WithTimeout(ctx, time.Second)
+		}
+		msg, err := sub.NextMsgWithContext(waitCtx)
+		cancel()
+		if err != nil {
+			if !opts.Follow && ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+				return nil
+			}
+			return err
+		}
+		meta, err := msg.Metadata()
+		if err != nil {
+			return err
+		}
+		if !opts.Until.IsZero() && meta.Timestamp.After(opts.Until) {
+			return nil
+		}
+		data, err := b.decode(ctx, msg)
+		if err != nil {
+			return err
+		}
+		if opts.EventName == "" || opts.EventName == data.Name {
+			read++
+			err = fn(StoredMessage{
+				Stream:   meta.Stream,
+				Sequence: meta.Sequence.Stream,
+				Subject:  msg.Subject,
+				Time:     meta.Timestamp,
+				Headers:  msg.Header,
+				Message:  data,
+			})
+			if errors.Is(err, ErrStopReading) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if !opts.Follow && meta.NumPending == 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Republish publishes a stored message again onto the stream topic of the domain and service.
+func (b *Broker) Republish(domain string, service string, topic string, msg StoredMessage) error {
+	return b.PublishStreamTo(domain, service, topic, RawEvent{
+		EventName: msg.Message.Name,
+		Data:      msg.Message.Data,
+	})
+}
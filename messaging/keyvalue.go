@@ -0,0 +1,27 @@
+package messaging
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NewKeyValue creates the JetStream key value bucket or binds to the existing one, keys expire after ttl.
+func (b *Broker) NewKeyValue(bucket string, ttl time.Duration) (nats.KeyValue, error) {
+	if bucket == "" {
+		return nil, errors.New("key value bucket is empty")
+	}
+	js, err := b.jetStream()
+	if err != nil {
+		return nil, err
+	}
+	kv, err := js.CreateKeyValue(&nats.KeyValueConfig{
+		Bucket: bucket,
+		TTL:    ttl,
+	})
+	if errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+		kv, err = js.KeyValue(bucket)
+	}
+	return kv, err
+}
@@ -0,0 +1,184 @@
+package messaging
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const meterName = "github.com/thumperq/golib/messaging"
+
+const (
+	outcomeAck  = "ack"
+	outcomeNak  = "nak"
+	outcomeTerm = "term"
+)
+
+// BrokerMetrics records the messaging instruments, every measurement is labelled by domain, service and topic.
+// It implements MetricsRecorder so it can be used with the Metrics middleware as well.
+type BrokerMetrics struct {
+	published       metric.Int64Counter
+	consumed        metric.Int64Counter
+	handlerDuration metric.Float64Histogram
+	acks            metric.Int64Counter
+	decodeFailures  metric.Int64Counter
+	redeliveries    metric.Int64Counter
+	pending         metric.Int64ObservableGauge
+	ackPending      metric.Int64ObservableGauge
+	redelivered     metric.Int64ObservableGauge
+	registration    metric.Registration
+	mu              sync.Mutex
+	consumers       map[*trackedConsumer]struct{}
+}
+
+type trackedConsumer struct {
+	info  func() (ConsumerInfo, error)
+	attrs attribute.Set
+}
+
+// NewBrokerMetrics creates the messaging instruments, the stream consumer gauges are polled from consumer info on every collection.
+func NewBrokerMetrics(provider metric.MeterProvider) (*BrokerMetrics, error) {
+	if provider == nil {
+		provider = otel.GetMeterProvider()
+	}
+	meter := provider.Meter(meterName)
+	m := &BrokerMetrics{
+		consumers: make(map[*trackedConsumer]struct{}),
+	}
+	var err error
+	m.published, err = meter.Int64Counter("messaging.published",
+		metric.WithDescription("Number of published messages"))
+	if err != nil {
+		return nil, err
+	}
+	m.consumed, err = meter.Int64Counter("messaging.consumed",
+		metric.WithDescription("Number of consumed messages"))
+	if err != nil {
+		return nil, err
+	}
+	m.handlerDuration, err = meter.Float64Histogram("messaging.handler.duration",
+		metric.WithDescription("Duration of message handlers"),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	m.acks, err = meter.Int64Counter("messaging.acks",
+		metric.WithDescription("Number of stream message acknowledgements by outcome"))
+	if err != nil {
+		return nil, err
+	}
+	m.decodeFailures, err = meter.Int64Counter("messaging.decode_failures",
+		metric.WithDescription("Number of consumed messages which could not be decoded"))
+	if err != nil {
+		return nil, err
+	}
+	m.redeliveries, err = meter.Int64Counter("messaging.redeliveries",
+		metric.WithDescription("Number of redelivered stream messages"))
+	if err != nil {
+		return nil, err
+	}
+	m.pending, err = meter.Int64ObservableGauge("messaging.consumer.pending",
+		metric.WithDescription("Number of stream messages not yet delivered to the consumer"))
+	if err != nil {
+		return nil, err
+	}
+	m.ackPending, err = meter.Int64ObservableGauge("messaging.consumer.ack_pending",
+		metric.WithDescription("Number of delivered stream messages waiting for an acknowledgement"))
+	if err != nil {
+		return nil, err
+	}
+	m.redelivered, err = meter.Int64ObservableGauge("messaging.consumer.redelivered",
+		metric.WithDescription("Number of stream messages currently being redelivered"))
+	if err != nil {
+		return nil, err
+	}
+	m.registration, err = meter.RegisterCallback(m.observeConsumers, m.pending, m.ackPending, m.redelivered)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *BrokerMetrics) unregister() error {
+	return m.registration.Unregister()
+}
+
+func (m *BrokerMetrics) RecordHandled(ctx context.Context, delivery Delivery, msg Message, duration time.Duration, err error) {
+	attrs := metric.WithAttributes(deliveryAttributes(delivery, err)...)
+	m.consumed.Add(ctx, 1, attrs)
+	m.handlerDuration.Record(ctx, duration.Seconds(), attrs)
+	if delivery.NumDelivered > 1 {
+		m.redeliveries.Add(ctx, 1, metric.WithAttributes(topicAttributes(delivery.Domain, delivery.Service, delivery.Topic)...))
+	}
+}
+
+func (m *BrokerMetrics) recordPublished(domain string, service string, topic string, stream bool) {
+	attrs := append(topicAttributes(domain, service, topic), attribute.Bool("stream", stream))
+	m.published.Add(context.Background(), 1, metric.WithAttributes(attrs...))
+}
+
+func (m *BrokerMetrics) recordAck(ctx context.Context, delivery Delivery, outcome string) {
+	attrs := append(topicAttributes(delivery.Domain, delivery.Service, delivery.Topic), attribute.String("outcome", outcome))
+	m.acks.Add(ctx, 1, metric.WithAttributes(attrs...))
+}
+
+func (m *BrokerMetrics) recordDecodeFailure(ctx context.Context, delivery Delivery) {
+	attrs := append(topicAttributes(delivery.Domain, delivery.Service, delivery.Topic), attribute.Bool("stream", delivery.Stream))
+	m.decodeFailures.Add(ctx, 1, metric.WithAttributes(attrs...))
+}
+
+func (m *BrokerMetrics) trackConsumer(info func() (ConsumerInfo, error), domain string, service string, topic string, consumer string) *trackedConsumer {
+	attrs := append(topicAttributes(domain, service, topic), attribute.String("consumer", consumer))
+	tracked := &trackedConsumer{
+		info:  info,
+		attrs: attribute.NewSet(attrs...),
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.consumers[tracked] = struct{}{}
+	return tracked
+}
+
+func (m *BrokerMetrics) untrackConsumer(consumer *trackedConsumer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.consumers, consumer)
+}
+
+func (m *BrokerMetrics) observeConsumers(ctx context.Context, o metric.Observer) error {
+	m.mu.Lock()
+	consumers := make([]*trackedConsumer, 0, len(m.consumers))
+	for consumer := range m.consumers {
+		consumers = append(consumers, consumer)
+	}
+	m.mu.Unlock()
+	for _, consumer := range consumers {
+		info, err := consumer.info()
+		if err != nil {
+			continue
+		}
+		set := metric.WithAttributeSet(consumer.attrs)
+		o.ObserveInt64(m.pending, int64(info.NumPending), set)
+		o.ObserveInt64(m.ackPending, int64(info.NumAckPending), set)
+		o.ObserveInt64(m.redelivered, int64(info.NumRedelivered), set)
+	}
+	return nil
+}
+
+func topicAttributes(domain string, service string, topic string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("domain", domain),
+		attribute.String("service", service),
+		attribute.String("topic", topic),
+	}
+}
+
+func deliveryAttributes(delivery Delivery, err error) []attribute.KeyValue {
+	return append(topicAttributes(delivery.Domain, delivery.Service, delivery.Topic),
+		attribute.Bool("stream", delivery.Stream),
+		attribute.Bool("error", err != nil))
+}
@@ -0,0 +1,133 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/thumperq/golib/logging"
+)
+
+var ErrHandlerTimeout = errors.New("handler timed out")
+
+type Handler func(ctx context.Context, msg Message) error
+
+type Middleware func(next Handler) Handler
+
+// Delivery describes the message a handler is called for, middlewares read it with DeliveryFromContext.
+type Delivery struct {
+	Subject      string
+	Domain       string
+	Service      string
+	Topic        string
+	Stream       bool
+	NumDelivered uint64
+}
+
+type deliveryKey struct{}
+
+func ContextWithDelivery(ctx context.Context, delivery Delivery) context.Context {
+	return context.WithValue(ctx, deliveryKey{}, delivery)
+}
+
+func DeliveryFromContext(ctx context.Context) (Delivery, bool) {
+	delivery, ok := ctx.Value(deliveryKey{}).(Delivery)
+	return delivery, ok
+}
+
+// Chain composes the middlewares so the first one is the outermost.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// Recovery turns a panicking handler into an error, subscribers always apply it as the outermost middleware.
+func Recovery() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					delivery, _ := DeliveryFromContext(ctx)
+					logging.TraceLogger(ctx).
+						Error().
+						Str("stack", string(debug.Stack())).
+						Msgf("handler panic for subject %s: %v", delivery.Subject, r)
+					err = fmt.Errorf("handler panic: %v", r)
+				}
+			}()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Timeout cancels the handler context after d and returns ErrHandlerTimeout without waiting for a handler that
+// ignores the cancellation.
+func Timeout(d time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg Message) error {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			done := make(chan error, 1)
+			go func() {
+				done <- Recovery()(next)(ctx, msg)
+			}()
+			select {
+			case err := <-done:
+				return err
+			case <-ctx.Done():
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					return ErrHandlerTimeout
+				}
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// Logging writes a structured log entry for every handled message.
+func Logging() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg Message) error {
+			start := time.Now()
+			err := next(ctx, msg)
+			delivery, _ := DeliveryFromContext(ctx)
+			level := zerolog.InfoLevel
+			if err != nil {
+				level = zerolog.ErrorLevel
+			}
+			logging.TraceLogger(ctx).
+				WithLevel(level).
+				Err(err).
+				Str("subject", delivery.Subject).
+				Str("event", msg.Name).
+				Uint64("delivered", delivery.NumDelivered).
+				Dur("duration", time.Since(start)).
+				Msg("message handled")
+			return err
+		}
+	}
+}
+
+type MetricsRecorder interface {
+	RecordHandled(ctx context.Context, delivery Delivery, msg Message, duration time.Duration, err error)
+}
+
+// Metrics reports the outcome and duration of every handled message to the recorder.
+func Metrics(recorder MetricsRecorder) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg Message) error {
+			start := time.Now()
+			err := next(ctx, msg)
+			delivery, _ := DeliveryFromContext(ctx)
+			recorder.RecordHandled(ctx, delivery, msg, time.Since(start), err)
+			return err
+		}
+	}
+}
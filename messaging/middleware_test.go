@@ -0,0 +1,80 @@
+package messaging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/require"
+	"github.com/thumperq/golib/messaging"
+)
+
+func TestChainOrder(t *testing.T) {
+	calls := []string{}
+	trace := func(name string) messaging.Middleware {
+		return func(next messaging.Handler) messaging.Handler {
+			return func(ctx context.Context, msg messaging.Message) error {
+				calls = append(calls, name+":before")
+				err := next(ctx, msg)
+				calls = append(calls, name+":after")
+				return err
+			}
+		}
+	}
+	handler := messaging.Chain(trace("outer"), trace("inner"))(func(ctx context.Context, msg messaging.Message) error {
+		calls = append(calls, "handler")
+		return nil
+	})
+	require.NoError(t, handler(context.Background(), messaging.Message{}))
+	require.Equal(t, []string{"outer:before", "inner:before", "handler", "inner:after", "outer:after"}, calls)
+}
+
+func TestRecoveryAndTimeout(t *testing.T) {
+	handler := messaging.Recovery()(func(ctx context.Context, msg messaging.Message) error {
+		panic("boom")
+	})
+	require.ErrorContains(t, handler(context.Background(), messaging.Message{}), "boom")
+
+	handler = messaging.Timeout(10 * time.Millisecond)(func(ctx context.Context, msg messaging.Message) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	require.ErrorIs(t, handler(context.Background(), messaging.Message{}), messaging.ErrHandlerTimeout)
+
+	handler = messaging.Timeout(time.Second)(func(ctx context.Context, msg messaging.Message) error {
+		return errors.New("failed")
+	})
+	require.EqualError(t, handler(context.Background(), messaging.Message{}), "failed")
+}
+
+func TestLogging(t *testing.T) {
+	var out bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&out)
+	t.Cleanup(func() { log.Logger = logger })
+	var handlerErr error
+	handler := messaging.Logging()(func(ctx context.Context, msg messaging.Message) error {
+		return handlerErr
+	})
+
+	require.NoError(t, handler(context.Background(), messaging.Message{Name: "orderCreated"}))
+	handlerErr = errors.New("order not found")
+	require.Error(t, handler(context.Background(), messaging.Message{Name: "orderCreated"}))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	var handled, failed map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &handled))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &failed))
+	require.Equal(t, "info", handled["level"])
+	require.NotContains(t, handled, "error")
+	require.Equal(t, "error", failed["level"])
+	require.Equal(t, "order not found", failed["error"])
+	require.Equal(t, "orderCreated", failed["event"])
+}
@@ -0,0 +1,264 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/thumperq/golib/logging"
+)
+
+const defaultPartitionHeartbeat = 2 * time.Second
+
+// ErrInvalidPartitions is returned for a number of partitions which is not positive.
+var ErrInvalidPartitions = errors.New("partitions must be positive")
+
+// PartitionOf maps a partition key onto one of the partitions, the same key always maps onto the same partition.
+// The number of partitions has to be positive.
+func PartitionOf(key string, partitions int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(partitions))
+}
+
+// WithPartitionedStream creates a stream capturing the partitions topic.0 to topic.<partitions-1> of the broker's
+// domain and service. Messages with the same partition key are handled in publishing order by PartitionedSubscriber.
+func (b *Broker) WithPartitionedStream(topic string, partitions int) error {
+	if topic == "" {
+		return errors.New("topic is empty")
+	}
+	if partitions <= 0 {
+		return ErrInvalidPartitions
+	}
+	js, err := b.jetStream()
+	if err != nil {
+		return err
+	}
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:     b.namer.StreamName(b.domain, b.service) + "-" + strings.ReplaceAll(topic, ".", "-"),
+		Subjects: []string{b.namer.Subject(b.domain, b.service, topic) + ".*"},
+	})
+	if err != nil {
+		return err
+	}
+	return b.WithPartitionsOf(b.domain, b.service, topic, partitions)
+}
+
+// WithPartitionsOf sets the number of partitions of a partitioned topic of another domain and service,
+// it has to match the number the stream was created with.
+func (b *Broker) WithPartitionsOf(domain string, service string, topic string, partitions int) error {
+	if partitions <= 0 {
+		return ErrInvalidPartitions
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.partitions[b.namer.Subject(domain, service, topic)] = partitions
+	return nil
+}
+
+func (b *Broker) partitionsOf(subject string) (int, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	partitions, ok := b.partitions[subject]
+	return partitions, ok
+}
+
+func (b *Broker) PublishPartitioned(topic string, key string, data Event) error {
+	return b.PublishPartitionedTo(b.domain, b.service, topic, key, data)
+}
+
+// PublishPartitionedTo publishes onto the partition of the key of a partitioned topic of another domain and service.
+func (b *Broker) PublishPartitionedTo(domain string, service string, topic string, key string, data Event) error {
+	partitions, ok := b.partitionsOf(b.namer.Subject(domain, service, topic))
+	if !ok {
+		return fmt.Errorf("partitions of topic %s are not configured", topic)
+	}
+	if partitions <= 0 {
+		return ErrInvalidPartitions
+	}
+	return b.PublishStreamTo(domain, service, fmt.Sprintf("%s.%d", topic, PartitionOf(key, partitions)), data)
+}
+
+// PartitionedSubscriber consumes partitioned topics, every partition is consumed by one replica at a time and
+// one message at a time. Replicas announce themselves in a key value bucket, the partitions are rebalanced
+// between the live replicas whenever one joins or leaves.
+type PartitionedSubscriber struct {
+	subscriber *Subscriber
+	heartbeat  time.Duration
+}
+
+func NewPartitionedSubscriber(broker *Broker, middlewares ...Middleware) *PartitionedSubscriber {
+	return &PartitionedSubscriber{
+		subscriber: &Subscriber{
+			broker:     broker,
+			middleware: Chain(append([]Middleware{Recovery()}, middlewares...)...),
+		},
+		heartbeat: defaultPartitionHeartbeat,
+	}
+}
+
+// WithHeartbeat sets how often a replica announces itself and checks the membership, a replica is considered
+// gone after three missed heartbeats.
+func (s *PartitionedSubscriber) WithHeartbeat(heartbeat time.Duration) *PartitionedSubscriber {
+	s.heartbeat = heartbeat
+	return s
+}
+
+type partitionConsumer struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Subscribe consumes the partitions of the topic assigned to this replica until the context is done.
+func (s *PartitionedSubscriber) Subscribe(ctx context.Context, domain string, service string, topic string, handler func(ctx context.Context, msg Message) error) error {
+	broker := s.subscriber.broker
+	subject := broker.namer.Subject(domain, service, topic)
+	partitions, ok := broker.partitionsOf(subject)
+	if !ok {
+		return fmt.Errorf("partitions of topic %s are not configured", topic)
+	}
+	js, err := broker.jetStream()
+	if err != nil {
+		return err
+	}
+	durable := broker.namer.DurableName(broker.domain, broker.service, subject)
+	kv, err := broker.NewKeyValue("partitions-"+durable, 3*s.heartbeat)
+	if err != nil {
+		return err
+	}
+	member := nuid.Next()
+	_, err = kv.Put(member, nil)
+	if err != nil {
+		return err
+	}
+	handle := s.subscriber.middleware(handler)
+	go func() {
+		running := map[int]*partitionConsumer{}
+		ticker := time.NewTicker(s.heartbeat)
+		defer ticker.Stop()
+		for {
+			assigned, err := s.assignment(kv, member, partitions)
+			if err != nil {
+				logging.TraceLogger(ctx).
+					Err(err).
+					Msgf("failed to read partition members of subject %s", subject)
+			} else {
+				for p, consumer := range running {
+					if !slices.Contains(assigned, p) {
+						consumer.cancel()
+						<-consumer.done
+						delete(running, p)
+					}
+				}
+				for _, p := range assigned {
+					if _, ok := running[p]; ok {
+						continue
+					}
+					consumer, err := s.consume(ctx, js, handle, domain, service, topic, p)
+					if err != nil {
+						logging.TraceLogger(ctx).
+							Err(err).
+							Msgf("failed to consume partition %d of subject %s", p, subject)
+						continue
+					}
+					running[p] = consumer
+				}
+			}
+			select {
+			case <-ctx.Done():
+				for _, consumer := range running {
+					consumer.cancel()
+					<-consumer.done
+				}
+				err := kv.Delete(member)
+				if err != nil {
+					logging.TraceLogger(ctx).
+						Err(err).
+						Msgf("failed to leave partition members of subject %s", subject)
+				}
+				return
+			case <-ticker.C:
+				_, err := kv.Put(member, nil)
+				if err != nil {
+					logging.TraceLogger(ctx).
+						Err(err).
+						Msgf("failed to renew partition membership of subject %s", subject)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// assignment returns the partitions of the member, the i-th of the sorted members gets every partition p with
+// p modulo the number of members equal to i.
+func (s *PartitionedSubscriber) assignment(kv nats.KeyValue, member string, partitions int) ([]int, error) {
+	members, err := kv.Keys()
+	if err != nil && !errors.Is(err, nats.ErrNoKeysFound) {
+		return nil, err
+	}
+	slices.Sort(members)
+	index := slices.Index(members, member)
+	if index < 0 {
+		return nil, nil
+	}
+	assigned := []int{}
+	for p := index; p < partitions; p += len(members) {
+		assigned = append(assigned, p)
+	}
+	return assigned, nil
+}
+
+// consume binds to the durable consumer of the partition, it is created with a single pending ack so a partition
+// handed over between replicas is still handled in order.
+func (s *PartitionedSubscriber) consume(ctx context.Context, js nats.JetStreamContext, handle Handler, domain string, service string, topic string, partition int) (*partitionConsumer, error) {
+	broker := s.subscriber.broker
+	subject := fmt.Sprintf("%s.%d", broker.namer.Subject(domain, service, topic), partition)
+	durable := broker.namer.DurableName(broker.domain, broker.service, subject)
+	stream, err := js.StreamNameBySubject(subject)
+	if err != nil {
+		return nil, err
+	}
+	_, err = js.AddConsumer(stream, &nats.ConsumerConfig{
+		Durable:       durable,
+		FilterSubject: subject,
+		AckPolicy:     nats.AckExplicitPolicy,
+		MaxAckPending: 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	sub, err := js.PullSubscribe(subject, durable, nats.Bind(stream, durable))
+	if err != nil {
+		return nil, err
+	}
+	partitionCtx, cancel := context.WithCancel(ctx)
+	consumer := &partitionConsumer{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	tracked := broker.metrics.trackConsumer(subscriptionInfo(sub), domain, service, topic, durable)
+	go func() {
+		defer close(consumer.done)
+		for partitionCtx.Err() == nil {
+			msgs, _ := sub.Fetch(1, nats.Context(partitionCtx))
+			for _, msg := range msgs {
+				s.subscriber.handleStream(partitionCtx, handle, toStreamEnvelope(msg), domain, service, topic)
+			}
+		}
+		broker.metrics.untrackConsumer(tracked)
+		err := sub.Unsubscribe()
+		if err != nil {
+			logging.TraceLogger(ctx).
+				Err(err).
+				Msgf("failed to unsubscribe from partition subject %s", subject)
+		}
+	}()
+	return consumer, nil
+}
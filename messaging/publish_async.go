@@ -0,0 +1,168 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const batchPublishTimeout = 30 * time.Second
+
+type PublishAck struct {
+	Stream    string
+	Sequence  uint64
+	Duplicate bool
+}
+
+// PublishFuture resolves to the stream acknowledgement of a message published with PublishStreamAsync.
+type PublishFuture struct {
+	Topic  string
+	Event  Event
+	future nats.PubAckFuture
+	mu     sync.Mutex
+	ack    *PublishAck
+	err    error
+	done   bool
+}
+
+// Ack waits until the stream acknowledged the message, the publish failed or the context is done.
+// It can be called multiple times and returns the same result once the future is resolved.
+func (f *PublishFuture) Ack(ctx context.Context) (*PublishAck, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done {
+		return f.ack, f.err
+	}
+	select {
+	case pa := <-f.future.Ok():
+		f.ack = &PublishAck{
+			Stream:    pa.Stream,
+			Sequence:  pa.Sequence,
+			Duplicate: pa.Duplicate,
+		}
+	case err := <-f.future.Err():
+		f.err = err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	f.done = true
+	return f.ack, f.err
+}
+
+type PublishFailure struct {
+	Index int
+	Event Event
+	Err   error
+}
+
+// BatchError reports every message of a batch which was not acknowledged by the stream.
+type BatchError struct {
+	Total    int
+	Failures []PublishFailure
+}
+
+func (e *BatchError) Error() string {
+	if len(e.Failures) == 0 {
+		return "batch publish failed"
+	}
+	return fmt.Sprintf("%d of %d messages failed to publish, first error: %v", len(e.Failures), e.Total, e.Failures[0].Err)
+}
+
+func (e *BatchError) Unwrap() []error {
+	errs := []error{}
+	for _, f := range e.Failures {
+		errs = append(errs, f.Err)
+	}
+	return errs
+}
+
+// PublishStreamAsync publishes to the stream without waiting for the acknowledgement, at most 256 acks are pending at once.
+func (b *Broker) PublishStreamAsync(topic string, data Event) (*PublishFuture, error) {
+	if topic == "" {
+		return nil, errors.New("publish stream topic is empty")
+	}
+	if data == nil {
+		return nil, errors.New("publish stream data is nil")
+	}
+	js, err := b.jetStream()
+	if err != nil {
+		return nil, err
+	}
+	msg, err := b.encode(b.namer.Subject(b.domain, b.service, topic), data)
+	if err != nil {
+		return nil, err
+	}
+	future, err := js.PublishMsgAsync(msg)
+	if err != nil {
+		b.discardClaim(context.Background(), msg)
+		return nil, err
+	}
+	b.metrics.recordPublished(b.domain, b.service, topic, true)
+	return &PublishFuture{
+		Topic:  topic,
+		Event:  data,
+		future: future,
+	}, nil
+}
+
+// FlushAsync waits until every pending asynchronous publish is acknowledged or the context is done.
+func (b *Broker) FlushAsync(ctx context.Context) error {
+	js, err := b.jetStream()
+	if err != nil {
+		return err
+	}
+	select {
+	case <-js.PublishAsyncComplete():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PublishStreamBatch publishes every event asynchronously and waits for all acknowledgements.
+// Without a context deadline it waits at most 30 seconds. When some messages fail a *BatchError is
+// returned, the acks slice then holds nil for every failed message.
+func (b *Broker) PublishStreamBatch(ctx context.Context, topic string, events []Event) ([]*PublishAck, error) {
+	if len(events) <= 0 {
+		return nil, errors.New("publish batch is empty")
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, batchPublishTimeout)
+		defer cancel()
+	}
+	batchErr := &BatchError{Total: len(events)}
+	futures := make([]*PublishFuture, len(events))
+	for i, event := range events {
+		future, err := b.PublishStreamAsync(topic, event)
+		if err != nil {
+			batchErr.Failures = append(batchErr.Failures, PublishFailure{Index: i, Event: event, Err: err})
+			continue
+		}
+		futures[i] = future
+	}
+	acks := make([]*PublishAck, len(events))
+	for i, future := range futures {
+		if future == nil {
+			continue
+		}
+		ack, err := future.Ack(ctx)
+		if err != nil {
+			batchErr.Failures = append(batchErr.Failures, PublishFailure{Index: i, Event: events[i], Err: err})
+			continue
+		}
+		acks[i] = ack
+	}
+	if len(batchErr.Failures) > 0 {
+		slices.SortFunc(batchErr.Failures, func(a, b PublishFailure) int {
+			return a.Index - b.Index
+		})
+		return acks, batchErr
+	}
+	return acks, nil
+}
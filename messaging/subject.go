@@ -0,0 +1,44 @@
+package messaging
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SubjectNamer derives every nats name from domain, service and topic so publishers, streams and consumers agree on them.
+type SubjectNamer interface {
+	Subject(domain string, service string, topic string) string
+	StreamName(domain string, service string) string
+	// DurableName names the durable stream consumer of the consuming domain and service on the subject.
+	DurableName(domain string, service string, subject string) string
+	// QueueGroup names the queue group of the consuming domain and service on the subject.
+	QueueGroup(domain string, service string, subject string) string
+}
+
+// DefaultSubjectNamer names subjects domain.service.topic and streams domain-service.
+// A non-empty Environment prefixes both, e.g. prod.domain.service.topic, so environments can share a nats cluster.
+type DefaultSubjectNamer struct {
+	Environment string
+}
+
+func (n DefaultSubjectNamer) Subject(domain string, service string, topic string) string {
+	if n.Environment != "" {
+		return fmt.Sprintf("%s.%s.%s.%s", n.Environment, domain, service, topic)
+	}
+	return fmt.Sprintf("%s.%s.%s", domain, service, topic)
+}
+
+func (n DefaultSubjectNamer) StreamName(domain string, service string) string {
+	if n.Environment != "" {
+		return fmt.Sprintf("%s-%s-%s", n.Environment, domain, service)
+	}
+	return fmt.Sprintf("%s-%s", domain, service)
+}
+
+func (n DefaultSubjectNamer) DurableName(domain string, service string, subject string) string {
+	return fmt.Sprintf("%s-%s-%s", domain, service, strings.ReplaceAll(subject, ".", "-"))
+}
+
+func (n DefaultSubjectNamer) QueueGroup(domain string, service string, subject string) string {
+	return n.DurableName(domain, service, subject)
+}
@@ -0,0 +1,440 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thumperq/golib/messaging"
+)
+
+type PublishedMessage struct {
+	Subject string
+	Stream  bool
+	Message messaging.Message
+}
+
+type mockSubscription struct {
+	ctx      context.Context
+	handler  messaging.Handler
+	delivery messaging.Delivery
+}
+
+type mockQueue struct {
+	subscriptions []*mockSubscription
+	next          int
+}
+
+type mockStreamMessage struct {
+	sequence uint64
+	subject  string
+	message  messaging.Message
+}
+
+type mockConsumer struct {
+	subject    string
+	queue      mockQueue
+	acked      map[uint64]bool
+	terminated map[uint64]bool
+	delivered  map[uint64]int
+}
+
+type mockStream struct {
+	subjects  []string
+	messages  []*mockStreamMessage
+	consumers map[string]*mockConsumer
+}
+
+// MockBroker is an in-memory messaging.Publisher and messaging.MessageSubscriber for unit tests.
+// Deliveries happen synchronously on the publishing goroutine, so once Publish or PublishStream
+// returns every subscribed handler has already run.
+type MockBroker struct {
+	domain     string
+	service    string
+	maxDeliver int
+	namer      messaging.SubjectNamer
+	middleware messaging.Middleware
+	mu         sync.Mutex
+	published  []PublishedMessage
+	queues     map[string]map[string]*mockQueue
+	streams    []*mockStream
+}
+
+func NewBroker(domain string, service string) *MockBroker {
+	return &MockBroker{
+		domain:     domain,
+		service:    service,
+		maxDeliver: 5,
+		namer:      messaging.DefaultSubjectNamer{},
+		middleware: messaging.Recovery(),
+		queues:     make(map[string]map[string]*mockQueue),
+	}
+}
+
+// WithMaxDeliver limits how many times a nacked stream message is redelivered before it is left unacked.
+// Messages whose handler returns messaging.ErrTerminate are never redelivered, like with nats.
+func (b *MockBroker) WithMaxDeliver(maxDeliver int) *MockBroker {
+	b.maxDeliver = maxDeliver
+	return b
+}
+
+func (b *MockBroker) WithSubjectNamer(namer messaging.SubjectNamer) *MockBroker {
+	b.namer = namer
+	return b
+}
+
+// Use wraps every handler subscribed afterwards with the middlewares like messaging.NewSubscriber does.
+func (b *MockBroker) Use(middlewares ...messaging.Middleware) *MockBroker {
+	b.middleware = messaging.Chain(append([]messaging.Middleware{messaging.Recovery()}, middlewares...)...)
+	return b
+}
+
+func (b *MockBroker) WithStream(topics []string) error {
+	return b.WithStreamOf(b.domain, b.service, topics)
+}
+
+// WithStreamOf adds the stream of another domain and service, so PublishStreamTo can be tested.
+func (b *MockBroker) WithStreamOf(domain string, service string, topics []string) error {
+	if len(topics) <= 0 {
+		return errors.New("topics is empty")
+	}
+	subjects := []string{}
+	for _, t := range topics {
+		subjects = append(subjects, b.namer.Subject(domain, service, t))
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.streams = append(b.streams, &mockStream{
+		subjects:  subjects,
+		consumers: make(map[string]*mockConsumer),
+	})
+	return nil
+}
+
+func (b *MockBroker) Publish(topic string, data messaging.Event) error {
+	return b.PublishTo(b.domain, b.service, topic, data)
+}
+
+func (b *MockBroker) PublishTo(domain string, service string, topic string, data messaging.Event) error {
+	if topic == "" {
+		return errors.New("publish topic is empty")
+	}
+	msg, err := newMessage(data)
+	if err != nil {
+		return err
+	}
+	subject := b.namer.Subject(domain, service, topic)
+	b.mu.Lock()
+	b.published = append(b.published, PublishedMessage{Subject: subject, Message: msg})
+	receivers := []*mockSubscription{}
+	for _, q := range b.queues[subject] {
+		if sub := q.pick(); sub != nil {
+			receivers = append(receivers, sub)
+		}
+	}
+	b.mu.Unlock()
+	for _, sub := range receivers {
+		// core subscriptions have no acknowledgement, handler errors are dropped like in the nats subscriber
+		_ = sub.handler(messaging.ContextWithDelivery(sub.ctx, sub.delivery), msg)
+	}
+	return nil
+}
+
+func (b *MockBroker) PublishStream(topic string, data messaging.Event) error {
+	return b.PublishStreamTo(b.domain, b.service, topic, data)
+}
+
+func (b *MockBroker) PublishStreamTo(domain string, service string, topic string, data messaging.Event) error {
+	if topic == "" {
+		return errors.New("publish stream topic is empty")
+	}
+	msg, err := newMessage(data)
+	if err != nil {
+		return err
+	}
+	subject := b.namer.Subject(domain, service, topic)
+	b.mu.Lock()
+	stream := b.streamOf(subject)
+	if stream == nil {
+		b.mu.Unlock()
+		return fmt.Errorf("no stream matches subject %s", subject)
+	}
+	b.published = append(b.published, PublishedMessage{Subject: subject, Stream: true, Message: msg})
+	streamMsg := &mockStreamMessage{
+		sequence: uint64(len(stream.messages) + 1),
+		subject:  subject,
+		message:  msg,
+	}
+	stream.messages = append(stream.messages, streamMsg)
+	consumers := []*mockConsumer{}
+	for _, c := range stream.consumers {
+		if c.subject == subject {
+			consumers = append(consumers, c)
+		}
+	}
+	b.mu.Unlock()
+	for _, c := range consumers {
+		b.deliver(c, streamMsg)
+	}
+	return nil
+}
+
+func (b *MockBroker) Subscribe(ctx context.Context, domain string, service string, topic string, handler func(ctx context.Context, msg messaging.Message) error) error {
+	subject := b.namer.Subject(domain, service, topic)
+	queueName := b.queueName(subject)
+	sub := &mockSubscription{
+		ctx:     ctx,
+		handler: b.middleware(handler),
+		delivery: messaging.Delivery{
+			Subject: subject,
+			Domain:  domain,
+			Service: service,
+			Topic:   topic,
+		},
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.queues[subject] == nil {
+		b.queues[subject] = make(map[string]*mockQueue)
+	}
+	q, ok := b.queues[subject][queueName]
+	if !ok {
+		q = &mockQueue{}
+		b.queues[subject][queueName] = q
+	}
+	q.subscriptions = append(q.subscriptions, sub)
+	context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		q.remove(sub)
+	})
+	return nil
+}
+
+func (b *MockBroker) SubscribeStream(ctx context.Context, domain string, service string, topic string, handler func(ctx context.Context, msg messaging.Message) error) error {
+	subject := b.namer.Subject(domain, service, topic)
+	queueName := b.queueName(subject)
+	sub := &mockSubscription{
+		ctx:     ctx,
+		handler: b.middleware(handler),
+		delivery: messaging.Delivery{
+			Subject: subject,
+			Domain:  domain,
+			Service: service,
+			Topic:   topic,
+			Stream:  true,
+		},
+	}
+	b.mu.Lock()
+	stream := b.streamOf(subject)
+	if stream == nil {
+		b.mu.Unlock()
+		return fmt.Errorf("no stream matches subject %s", subject)
+	}
+	c, ok := stream.consumers[queueName]
+	if !ok {
+		c = &mockConsumer{
+			subject:    subject,
+			acked:      make(map[uint64]bool),
+			terminated: make(map[uint64]bool),
+			delivered:  make(map[uint64]int),
+		}
+		stream.consumers[queueName] = c
+	}
+	c.queue.subscriptions = append(c.queue.subscriptions, sub)
+	backlog := []*mockStreamMessage{}
+	for _, m := range stream.messages {
+		if m.subject == subject && !c.acked[m.sequence] && !c.terminated[m.sequence] && c.delivered[m.sequence] < b.maxDeliver {
+			backlog = append(backlog, m)
+		}
+	}
+	context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		c.queue.remove(sub)
+	})
+	b.mu.Unlock()
+	for _, m := range backlog {
+		b.deliver(c, m)
+	}
+	return nil
+}
+
+// Published returns every message published on the topic of this broker's domain and service.
+func (b *MockBroker) Published(topic string) []messaging.Message {
+	return b.PublishedTo(b.domain, b.service, topic)
+}
+
+// PublishedTo returns every message published on the topic of the domain and service.
+func (b *MockBroker) PublishedTo(domain string, service string, topic string) []messaging.Message {
+	subject := b.namer.Subject(domain, service, topic)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msgs := []messaging.Message{}
+	for _, p := range b.published {
+		if p.Subject == subject {
+			msgs = append(msgs, p.Message)
+		}
+	}
+	return msgs
+}
+
+// Unacked returns the stream messages of the subject which this broker's durable consumer has not acknowledged.
+func (b *MockBroker) Unacked(domain string, service string, topic string) []messaging.Message {
+	subject := b.namer.Subject(domain, service, topic)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stream := b.streamOf(subject)
+	if stream == nil {
+		return nil
+	}
+	c := stream.consumers[b.queueName(subject)]
+	msgs := []messaging.Message{}
+	for _, m := range stream.messages {
+		if m.subject == subject && (c == nil || !c.acked[m.sequence]) {
+			msgs = append(msgs, m.message)
+		}
+	}
+	return msgs
+}
+
+// Reset forgets every published message while keeping streams and subscriptions.
+func (b *MockBroker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = nil
+}
+
+// RequirePublished asserts that an event with the given name was published on the topic and returns the first match.
+func (b *MockBroker) RequirePublished(t testing.TB, topic string, eventName string) messaging.Message {
+	t.Helper()
+	for _, msg := range b.Published(topic) {
+		if msg.Name == eventName {
+			return msg
+		}
+	}
+	require.Failf(t, "event not published", "expected event %s to be published on topic %s", eventName, topic)
+	return messaging.Message{}
+}
+
+// RequirePublishedEvent asserts that an event equal to the given one, compared by its JSON encoding, was published on the topic.
+func (b *MockBroker) RequirePublishedEvent(t testing.TB, topic string, event messaging.Event) {
+	t.Helper()
+	expected, err := json.Marshal(event)
+	require.NoError(t, err)
+	for _, msg := range b.Published(topic) {
+		if msg.Name != event.Name() {
+			continue
+		}
+		var want, got any
+		if json.Unmarshal(expected, &want) == nil && json.Unmarshal(msg.Data, &got) == nil && jsonEqual(want, got) {
+			return
+		}
+	}
+	require.Failf(t, "event not published", "expected event %s to be published on topic %s with data %s", event.Name(), topic, expected)
+}
+
+// RequireNotPublished asserts that no event with the given name was published on the topic.
+func (b *MockBroker) RequireNotPublished(t testing.TB, topic string, eventName string) {
+	t.Helper()
+	for _, msg := range b.Published(topic) {
+		if msg.Name == eventName {
+			require.Failf(t, "event published", "expected event %s not to be published on topic %s", eventName, topic)
+		}
+	}
+}
+
+func (b *MockBroker) deliver(c *mockConsumer, m *mockStreamMessage) {
+	for {
+		b.mu.Lock()
+		if c.acked[m.sequence] || c.terminated[m.sequence] || c.delivered[m.sequence] >= b.maxDeliver {
+			b.mu.Unlock()
+			return
+		}
+		sub := c.queue.pick()
+		if sub == nil {
+			b.mu.Unlock()
+			return
+		}
+		c.delivered[m.sequence]++
+		delivery := sub.delivery
+		delivery.NumDelivered = uint64(c.delivered[m.sequence])
+		b.mu.Unlock()
+		err := sub.handler(messaging.ContextWithDelivery(sub.ctx, delivery), m.message)
+		if err == nil {
+			b.mu.Lock()
+			c.acked[m.sequence] = true
+			b.mu.Unlock()
+			return
+		}
+		if errors.Is(err, messaging.ErrTerminate) {
+			b.mu.Lock()
+			c.terminated[m.sequence] = true
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (b *MockBroker) streamOf(subject string) *mockStream {
+	for _, s := range b.streams {
+		if slices.Contains(s.subjects, subject) {
+			return s
+		}
+	}
+	return nil
+}
+
+func (b *MockBroker) queueName(subject string) string {
+	return b.namer.DurableName(b.domain, b.service, subject)
+}
+
+func (q *mockQueue) pick() *mockSubscription {
+	for len(q.subscriptions) > 0 {
+		q.next = q.next % len(q.subscriptions)
+		sub := q.subscriptions[q.next]
+		q.next++
+		if sub.ctx.Err() == nil {
+			return sub
+		}
+		q.remove(sub)
+	}
+	return nil
+}
+
+func (q *mockQueue) remove(sub *mockSubscription) {
+	q.subscriptions = slices.DeleteFunc(q.subscriptions, func(s *mockSubscription) bool {
+		return s == sub
+	})
+}
+
+func newMessage(data messaging.Event) (messaging.Message, error) {
+	if data == nil {
+		return messaging.Message{}, errors.New("publish data is nil")
+	}
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return messaging.Message{}, err
+	}
+	return messaging.Message{
+		Name: data.Name(),
+		Data: dataBytes,
+	}, nil
+}
+
+func jsonEqual(a any, b any) bool {
+	ab, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(ab) == string(bb)
+}
@@ -0,0 +1,94 @@
+package test_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thumperq/golib/messaging"
+	"github.com/thumperq/golib/messaging/test"
+)
+
+type orderCreated struct {
+	EventName string `json:"name"`
+	OrderId   string `json:"orderId"`
+}
+
+func (o orderCreated) Name() string {
+	return o.EventName
+}
+
+func TestMockPublishAndSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := test.NewBroker("wms", "ordering")
+	var publisher messaging.Publisher = broker
+	var subscriber messaging.MessageSubscriber = broker
+	received := []string{}
+	err := subscriber.Subscribe(ctx, "wms", "ordering", "order", func(ctx context.Context, msg messaging.Message) error {
+		var event orderCreated
+		require.NoError(t, json.Unmarshal(msg.Data, &event))
+		received = append(received, event.OrderId)
+		return nil
+	})
+	require.NoError(t, err)
+	err = publisher.Publish("order", &orderCreated{EventName: "orderCreated", OrderId: "123"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"123"}, received)
+	broker.RequirePublished(t, "order", "orderCreated")
+	broker.RequirePublishedEvent(t, "order", &orderCreated{EventName: "orderCreated", OrderId: "123"})
+	broker.RequireNotPublished(t, "order", "orderCancelled")
+
+	cancel()
+	err = publisher.Publish("order", &orderCreated{EventName: "orderCreated", OrderId: "456"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"123"}, received)
+}
+
+func TestMockStreamRedelivery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := test.NewBroker("wms", "ordering").WithMaxDeliver(3)
+	require.Error(t, broker.PublishStream("order", &orderCreated{EventName: "orderCreated", OrderId: "1"}))
+	require.NoError(t, broker.WithStream([]string{"order"}))
+
+	require.NoError(t, broker.PublishStream("order", &orderCreated{EventName: "orderCreated", OrderId: "1"}))
+	require.NoError(t, broker.PublishStream("order", &orderCreated{EventName: "orderCreated", OrderId: "2"}))
+
+	attempts := map[string]int{}
+	err := broker.SubscribeStream(ctx, "wms", "ordering", "order", func(ctx context.Context, msg messaging.Message) error {
+		var event orderCreated
+		require.NoError(t, json.Unmarshal(msg.Data, &event))
+		attempts[event.OrderId]++
+		if event.OrderId == "2" {
+			return errors.New("cannot handle order")
+		}
+		if event.OrderId == "3" && attempts["3"] < 2 {
+			return errors.New("temporary failure")
+		}
+		if event.OrderId == "4" {
+			return fmt.Errorf("order is cancelled: %w", messaging.ErrTerminate)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, broker.PublishStream("order", &orderCreated{EventName: "orderCreated", OrderId: "3"}))
+	// terminated messages are not redelivered
+	require.NoError(t, broker.PublishStream("order", &orderCreated{EventName: "orderCreated", OrderId: "4"}))
+
+	require.Equal(t, map[string]int{"1": 1, "2": 3, "3": 2, "4": 1}, attempts)
+	unacked := broker.Unacked("wms", "ordering", "order")
+	require.Len(t, unacked, 2)
+	require.Len(t, broker.Published("order"), 4)
+}
+
+func TestMockPublishTo(t *testing.T) {
+	broker := test.NewBroker("finance", "billing")
+	require.NoError(t, broker.WithStreamOf("wms", "ordering", []string{"order"}))
+	require.NoError(t, broker.PublishStreamTo("wms", "ordering", "order", &orderCreated{EventName: "orderCreated", OrderId: "1"}))
+	require.Len(t, broker.PublishedTo("wms", "ordering", "order"), 1)
+	require.Empty(t, broker.Published("order"))
+}
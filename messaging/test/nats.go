@@ -0,0 +1,159 @@
+package test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	configTest "github.com/thumperq/golib/config/test"
+	"github.com/thumperq/golib/messaging"
+)
+
+// NatsCluster is a set of embedded JetStream enabled nats servers routed to each other.
+type NatsCluster struct {
+	Servers []*server.Server
+}
+
+// NewNatsServer starts an embedded JetStream enabled nats server on a random port with a temporary store dir.
+// The server is shut down when the test finishes.
+func NewNatsServer(t testing.TB) *server.Server {
+	t.Helper()
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	srv := natsserver.RunServer(&opts)
+	t.Cleanup(func() {
+		srv.Shutdown()
+		srv.WaitForShutdown()
+	})
+	return srv
+}
+
+// NewNatsCluster starts a cluster of embedded JetStream enabled nats servers and waits until a meta leader is elected.
+// Every server is shut down when the test finishes.
+func NewNatsCluster(t testing.TB, nodes int) *NatsCluster {
+	t.Helper()
+	if nodes <= 0 {
+		t.Fatalf("cluster needs at least one node, got %d", nodes)
+	}
+	ports := make([]int, nodes)
+	routes := make([]string, nodes)
+	for i := range ports {
+		ports[i] = FreePort(t)
+		routes[i] = fmt.Sprintf("nats://127.0.0.1:%d", ports[i])
+	}
+	cluster := &NatsCluster{}
+	for i := 0; i < nodes; i++ {
+		opts := natsserver.DefaultTestOptions
+		opts.Port = -1
+		opts.ServerName = fmt.Sprintf("node-%d", i+1)
+		opts.JetStream = true
+		opts.StoreDir = t.TempDir()
+		opts.Cluster.Name = "golib-test"
+		opts.Cluster.Host = "127.0.0.1"
+		opts.Cluster.Port = ports[i]
+		opts.Routes = server.RoutesFromStr(strings.Join(routes, ","))
+		srv, err := server.NewServer(&opts)
+		if err != nil {
+			t.Fatalf("failed to create nats server %s: %v", opts.ServerName, err)
+		}
+		go srv.Start()
+		if !srv.ReadyForConnections(10 * time.Second) {
+			t.Fatalf("nats server %s is not ready for connections", opts.ServerName)
+		}
+		cluster.Servers = append(cluster.Servers, srv)
+	}
+	t.Cleanup(func() {
+		for _, srv := range cluster.Servers {
+			srv.Shutdown()
+			srv.WaitForShutdown()
+		}
+	})
+	if nodes > 1 {
+		cluster.waitForLeader(t, 20*time.Second)
+	}
+	return cluster
+}
+
+// ClientURLs returns the comma separated client urls of every running server in the cluster.
+func (c *NatsCluster) ClientURLs() string {
+	urls := []string{}
+	for _, srv := range c.Servers {
+		if srv.Running() {
+			urls = append(urls, srv.ClientURL())
+		}
+	}
+	return strings.Join(urls, ",")
+}
+
+// StopNode shuts the server at the given index down, the remaining nodes elect a new leader.
+func (c *NatsCluster) StopNode(t testing.TB, index int) {
+	t.Helper()
+	srv := c.Servers[index]
+	srv.Shutdown()
+	srv.WaitForShutdown()
+	running := 0
+	for _, s := range c.Servers {
+		if s.Running() {
+			running++
+		}
+	}
+	if running > 1 {
+		c.waitForLeader(t, 20*time.Second)
+	}
+}
+
+func (c *NatsCluster) waitForLeader(t testing.TB, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, srv := range c.Servers {
+			if srv.Running() && srv.JetStreamIsLeader() {
+				return
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("no jetstream meta leader elected within %s", timeout)
+}
+
+// NewNatsBroker starts an embedded nats server and returns a broker connected to it.
+func NewNatsBroker(t testing.TB, domain string, service string) *messaging.Broker {
+	t.Helper()
+	srv := NewNatsServer(t)
+	return ConnectBroker(t, srv.ClientURL(), domain, service)
+}
+
+// ConnectBroker returns a broker connected to the given nats urls which is disconnected when the test finishes.
+func ConnectBroker(t testing.TB, urls string, domain string, service string) *messaging.Broker {
+	t.Helper()
+	cfg := configTest.NewConfigManager()
+	broker, err := messaging.NewBroker(cfg.WithKeyValue("NATS_URLS", urls), domain, service)
+	if err != nil {
+		t.Fatalf("failed to create broker: %v", err)
+	}
+	err = broker.Connect()
+	if err != nil {
+		t.Fatalf("failed to connect broker: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = broker.Disconnect()
+	})
+	return broker
+}
+
+// FreePort returns a port of 127.0.0.1 which is free to listen on.
+func FreePort(t testing.TB) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
@@ -0,0 +1,47 @@
+package test_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thumperq/golib/messaging"
+	"github.com/thumperq/golib/messaging/test"
+)
+
+func TestNatsServersInParallel(t *testing.T) {
+	for _, name := range []string{"first", "second"} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			broker := test.NewNatsBroker(t, "wms", name)
+			require.NoError(t, broker.WithStream([]string{"order"}))
+			require.NoError(t, broker.PublishStream("order", &orderCreated{EventName: "orderCreated", OrderId: name}))
+		})
+	}
+}
+
+func TestNatsClusterFailover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cluster := test.NewNatsCluster(t, 3)
+	require.Len(t, cluster.Servers, 3)
+	broker := test.ConnectBroker(t, cluster.ClientURLs(), "wms", "ordering")
+	received := make(chan messaging.Message, 10)
+	err := messaging.NewSubscriber(broker).Subscribe(ctx, "wms", "ordering", "order", func(ctx context.Context, msg messaging.Message) error {
+		received <- msg
+		return nil
+	})
+	require.NoError(t, err)
+
+	cluster.StopNode(t, 0)
+	require.Eventually(t, func() bool {
+		_ = broker.Publish("order", &orderCreated{EventName: "orderCreated", OrderId: "1"})
+		select {
+		case <-received:
+			return true
+		default:
+			return false
+		}
+	}, 10*time.Second, 100*time.Millisecond)
+}
@@ -0,0 +1,69 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ErrNotSupported is returned by broker features the transport cannot provide, e.g. work queues on a non-nats transport.
+var ErrNotSupported = errors.New("not supported by the transport")
+
+// Envelope is an encoded message as it is carried by a transport.
+type Envelope struct {
+	Subject string
+	Header  map[string][]string
+	Data    []byte
+}
+
+// StreamEnvelope is an envelope delivered from a stream, it is redelivered until it is acknowledged.
+type StreamEnvelope struct {
+	Envelope
+	NumDelivered uint64
+	Ack          func() error
+	Nak          func() error
+	// Term stops redelivering an envelope which can never be handled.
+	Term func() error
+}
+
+// Transport moves envelopes between brokers. Encoding, compression, encryption and claim checks are done by the broker,
+// so a transport only has to deliver subjects, headers and payloads.
+type Transport interface {
+	Connect() error
+	Disconnect() error
+	Publish(env Envelope) error
+	// PublishStream stores the envelope in the stream capturing its subject, it fails when there is none.
+	PublishStream(env Envelope) error
+	AddStream(name string, subjects []string) error
+	// Subscribe delivers every envelope published on the subject at most once to one subscriber of the queue group.
+	Subscribe(ctx context.Context, subject string, queue string, fn func(ctx context.Context, env Envelope)) error
+	// SubscribeStream delivers every stored envelope of the subject at least once to one subscriber of the durable consumer.
+	SubscribeStream(ctx context.Context, subject string, durable string, fn func(ctx context.Context, env StreamEnvelope)) error
+}
+
+// consumerInspector is implemented by transports able to report the backlog of durable consumers.
+type consumerInspector interface {
+	ConsumerInfo(subject string, durable string) (ConsumerInfo, error)
+}
+
+// pinger is implemented by transports connected to a server which can be unreachable.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+func toEnvelope(msg *nats.Msg) Envelope {
+	return Envelope{
+		Subject: msg.Subject,
+		Header:  msg.Header,
+		Data:    msg.Data,
+	}
+}
+
+func fromEnvelope(env Envelope) *nats.Msg {
+	return &nats.Msg{
+		Subject: env.Subject,
+		Header:  nats.Header(env.Header),
+		Data:    env.Data,
+	}
+}
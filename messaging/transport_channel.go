@@ -0,0 +1,295 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const channelSubscriptionBuffer = 256
+
+// ChannelTransport is an in-process transport, brokers sharing one ChannelTransport exchange messages through channels.
+// Streams are kept in memory, stream messages are redelivered when they are nacked. Like with nats, plain subscribers
+// which fall more than 256 messages behind miss messages.
+type ChannelTransport struct {
+	mu        sync.Mutex
+	subs      map[*channelSubscription]struct{}
+	rotation  map[string]int
+	streams   map[string]*channelStream
+	consumers map[string]*channelConsumer
+	changed   chan struct{}
+}
+
+type channelSubscription struct {
+	subject string
+	queue   string
+	msgs    chan Envelope
+}
+
+type channelStream struct {
+	subjects []string
+	log      []Envelope
+}
+
+type channelConsumer struct {
+	stream    *channelStream
+	subject   string
+	next      int
+	redeliver []int
+	inflight  map[int]struct{}
+	delivered map[int]uint64
+}
+
+func NewChannelTransport() *ChannelTransport {
+	return &ChannelTransport{
+		subs:      map[*channelSubscription]struct{}{},
+		rotation:  map[string]int{},
+		streams:   map[string]*channelStream{},
+		consumers: map[string]*channelConsumer{},
+		changed:   make(chan struct{}),
+	}
+}
+
+func (t *ChannelTransport) Connect() error {
+	return nil
+}
+
+func (t *ChannelTransport) Disconnect() error {
+	return nil
+}
+
+func (t *ChannelTransport) Publish(env Envelope) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.publish(env)
+	return nil
+}
+
+// publish delivers the envelope to the subscribers of its subject, t.mu has to be held.
+func (t *ChannelTransport) publish(env Envelope) {
+	groups := map[string][]*channelSubscription{}
+	for sub := range t.subs {
+		if !subjectMatches(sub.subject, env.Subject) {
+			continue
+		}
+		if sub.queue == "" {
+			t.deliver(sub, env)
+			continue
+		}
+		groups[sub.queue] = append(groups[sub.queue], sub)
+	}
+	for queue, members := range groups {
+		t.deliver(members[t.rotation[queue]%len(members)], env)
+		t.rotation[queue]++
+	}
+}
+
+func (t *ChannelTransport) deliver(sub *channelSubscription, env Envelope) {
+	select {
+	case sub.msgs <- env:
+	default:
+	}
+}
+
+func (t *ChannelTransport) PublishStream(env Envelope) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stream := t.streamOf(env.Subject)
+	if stream == nil {
+		return fmt.Errorf("no stream captures subject %s", env.Subject)
+	}
+	stream.log = append(stream.log, env)
+	t.notify()
+	// like on nats, subscribers of the subject receive the messages published to streams as well
+	t.publish(env)
+	return nil
+}
+
+func (t *ChannelTransport) AddStream(name string, subjects []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if stream, ok := t.streams[name]; ok {
+		stream.subjects = subjects
+		return nil
+	}
+	t.streams[name] = &channelStream{subjects: subjects}
+	return nil
+}
+
+func (t *ChannelTransport) Subscribe(ctx context.Context, subject string, queue string, fn func(ctx context.Context, env Envelope)) error {
+	sub := &channelSubscription{
+		subject: subject,
+		queue:   queue,
+		msgs:    make(chan Envelope, channelSubscriptionBuffer),
+	}
+	t.mu.Lock()
+	t.subs[sub] = struct{}{}
+	t.mu.Unlock()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				t.mu.Lock()
+				delete(t.subs, sub)
+				t.mu.Unlock()
+				return
+			case env := <-sub.msgs:
+				fn(ctx, env)
+			}
+		}
+	}()
+	return nil
+}
+
+// SubscribeStream delivers the stream messages of the subject to the subscribers of the durable consumer one at a time.
+// A durable consumer keeps its position for as long as the transport lives.
+func (t *ChannelTransport) SubscribeStream(ctx context.Context, subject string, durable string, fn func(ctx context.Context, env StreamEnvelope)) error {
+	t.mu.Lock()
+	stream := t.streamOf(subject)
+	if stream == nil {
+		t.mu.Unlock()
+		return fmt.Errorf("no stream captures subject %s", subject)
+	}
+	consumer, ok := t.consumers[durable]
+	if !ok {
+		consumer = &channelConsumer{
+			stream:    stream,
+			subject:   subject,
+			inflight:  map[int]struct{}{},
+			delivered: map[int]uint64{},
+		}
+		t.consumers[durable] = consumer
+	}
+	t.mu.Unlock()
+	go func() {
+		for ctx.Err() == nil {
+			t.mu.Lock()
+			index, ok := consumer.take()
+			if !ok {
+				changed := t.changed
+				t.mu.Unlock()
+				select {
+				case <-ctx.Done():
+					return
+				case <-changed:
+					continue
+				}
+			}
+			consumer.delivered[index]++
+			env := StreamEnvelope{
+				Envelope:     stream.log[index],
+				NumDelivered: consumer.delivered[index],
+				Ack: func() error {
+					t.mu.Lock()
+					defer t.mu.Unlock()
+					delete(consumer.inflight, index)
+					delete(consumer.delivered, index)
+					return nil
+				},
+				Nak: func() error {
+					t.mu.Lock()
+					defer t.mu.Unlock()
+					delete(consumer.inflight, index)
+					consumer.redeliver = append(consumer.redeliver, index)
+					t.notify()
+					return nil
+				},
+				Term: func() error {
+					t.mu.Lock()
+					defer t.mu.Unlock()
+					delete(consumer.inflight, index)
+					delete(consumer.delivered, index)
+					return nil
+				},
+			}
+			t.mu.Unlock()
+			fn(ctx, env)
+		}
+	}()
+	return nil
+}
+
+func (t *ChannelTransport) ConsumerInfo(subject string, durable string) (ConsumerInfo, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	consumer, ok := t.consumers[durable]
+	if !ok {
+		return ConsumerInfo{}, fmt.Errorf("consumer %s not found", durable)
+	}
+	info := ConsumerInfo{
+		Name:          durable,
+		NumPending:    uint64(len(consumer.redeliver)),
+		NumAckPending: len(consumer.inflight),
+	}
+	for name, stream := range t.streams {
+		if stream == consumer.stream {
+			info.Stream = name
+		}
+	}
+	for _, env := range consumer.stream.log[consumer.next:] {
+		if subjectMatches(consumer.subject, env.Subject) {
+			info.NumPending++
+		}
+	}
+	for index := range consumer.inflight {
+		if consumer.delivered[index] > 1 {
+			info.NumRedelivered++
+		}
+	}
+	return info, nil
+}
+
+// take returns the next stream message of the consumer, nacked messages first.
+func (c *channelConsumer) take() (int, bool) {
+	if len(c.redeliver) > 0 {
+		index := c.redeliver[0]
+		c.redeliver = c.redeliver[1:]
+		c.inflight[index] = struct{}{}
+		return index, true
+	}
+	for c.next < len(c.stream.log) {
+		index := c.next
+		c.next++
+		if subjectMatches(c.subject, c.stream.log[index].Subject) {
+			c.inflight[index] = struct{}{}
+			return index, true
+		}
+	}
+	return 0, false
+}
+
+func (t *ChannelTransport) streamOf(subject string) *channelStream {
+	for _, stream := range t.streams {
+		for _, s := range stream.subjects {
+			if subjectMatches(s, subject) {
+				return stream
+			}
+		}
+	}
+	return nil
+}
+
+// notify wakes up every stream consumer waiting for messages.
+func (t *ChannelTransport) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// subjectMatches reports whether the subject matches the pattern, * matches one token and a trailing > the remaining ones.
+func subjectMatches(pattern string, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+	for i, p := range patternTokens {
+		if p == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) {
+			return false
+		}
+		if p != "*" && p != subjectTokens[i] {
+			return false
+		}
+	}
+	return len(patternTokens) == len(subjectTokens)
+}
@@ -0,0 +1,215 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/thumperq/golib/logging"
+)
+
+// pingTimeout bounds pings without deadline, the nats client requires one
+const pingTimeout = 2 * time.Second
+
+// natsTransport is the default transport, streams are JetStream streams and durable consumers are pull consumers.
+type natsTransport struct {
+	urls       string
+	connection *nats.Conn
+	stream     nats.JetStreamContext
+}
+
+func newNatsTransport(urls string) *natsTransport {
+	return &natsTransport{urls: urls}
+}
+
+func (t *natsTransport) Connect() error {
+	nc, err := nats.Connect(t.urls, nats.MaxReconnects(10), nats.ReconnectWait(time.Second))
+	if err != nil {
+		return err
+	}
+	t.connection = nc
+	return nil
+}
+
+func (t *natsTransport) Disconnect() error {
+	return t.connection.Drain()
+}
+
+// Ping fails unless the connection is established and the server answers a round trip.
+func (t *natsTransport) Ping(ctx context.Context) error {
+	if t.connection == nil {
+		return errors.New("broker is not connected")
+	}
+	if status := t.connection.Status(); status != nats.CONNECTED {
+		return fmt.Errorf("broker connection is %s", status)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pingTimeout)
+		defer cancel()
+	}
+	return t.connection.FlushWithContext(ctx)
+}
+
+func (t *natsTransport) jetStream() (nats.JetStreamContext, error) {
+	if t.stream != nil {
+		return t.stream, nil
+	}
+	if t.connection == nil {
+		err := t.Connect()
+		if err != nil {
+			return nil, err
+		}
+	}
+	js, err := t.connection.JetStream(nats.PublishAsyncMaxPending(256))
+	if err != nil {
+		return nil, err
+	}
+	t.stream = js
+	return js, nil
+}
+
+func (t *natsTransport) Publish(env Envelope) error {
+	if t.connection == nil {
+		return errors.New("broker is not connected")
+	}
+	return t.connection.PublishMsg(fromEnvelope(env))
+}
+
+func (t *natsTransport) PublishStream(env Envelope) error {
+	js, err := t.jetStream()
+	if err != nil {
+		return err
+	}
+	_, err = js.PublishMsg(fromEnvelope(env))
+	return err
+}
+
+func (t *natsTransport) AddStream(name string, subjects []string) error {
+	js, err := t.jetStream()
+	if err != nil {
+		return err
+	}
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:     name,
+		Subjects: subjects,
+	})
+	return err
+}
+
+func (t *natsTransport) Subscribe(ctx context.Context, subject string, queue string, fn func(ctx context.Context, env Envelope)) error {
+	if t.connection == nil {
+		return errors.New("broker is not connected")
+	}
+	msgs := make(chan *nats.Msg)
+	sub, err := t.connection.QueueSubscribeSyncWithChan(subject, queue, msgs)
+	if err != nil {
+		return err
+	}
+	// the subscription is registered by the server once Subscribe returns, so it receives the messages published after
+	err = t.connection.Flush()
+	if err != nil {
+		_ = sub.Unsubscribe()
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				err := sub.Unsubscribe()
+				if err != nil {
+					logging.TraceLogger(ctx).
+						Err(err).
+						Msgf("failed to unsubscribe from subject %s", subject)
+				}
+				return
+			case msg := <-msgs:
+				fn(ctx, toEnvelope(msg))
+			}
+		}
+	}()
+	return nil
+}
+
+func (t *natsTransport) SubscribeStream(ctx context.Context, subject string, durable string, fn func(ctx context.Context, env StreamEnvelope)) error {
+	js, err := t.jetStream()
+	if err != nil {
+		return err
+	}
+	sub, err := js.PullSubscribe(subject, durable, nats.PullMaxWaiting(128))
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				err := sub.Unsubscribe()
+				if err != nil {
+					logging.TraceLogger(ctx).
+						Err(err).
+						Msgf("failed to unsubscribe from subject stream %s", subject)
+				}
+				return
+			default:
+				msgs, _ := sub.Fetch(10, nats.Context(ctx))
+				for _, msg := range msgs {
+					fn(ctx, toStreamEnvelope(msg))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (t *natsTransport) ConsumerInfo(subject string, durable string) (ConsumerInfo, error) {
+	js, err := t.jetStream()
+	if err != nil {
+		return ConsumerInfo{}, err
+	}
+	stream, err := js.StreamNameBySubject(subject)
+	if err != nil {
+		return ConsumerInfo{}, err
+	}
+	info, err := js.ConsumerInfo(stream, durable)
+	if err != nil {
+		return ConsumerInfo{}, err
+	}
+	return toConsumerInfo(info), nil
+}
+
+func toStreamEnvelope(msg *nats.Msg) StreamEnvelope {
+	env := StreamEnvelope{
+		Envelope: toEnvelope(msg),
+		Ack:      func() error { return msg.Ack() },
+		Nak:      func() error { return msg.Nak() },
+		Term:     func() error { return msg.Term() },
+	}
+	if meta, err := msg.Metadata(); err == nil {
+		env.NumDelivered = meta.NumDelivered
+	}
+	return env
+}
+
+// subscriptionInfo polls the consumer info of a subscription for the consumer metrics.
+func subscriptionInfo(sub *nats.Subscription) func() (ConsumerInfo, error) {
+	return func() (ConsumerInfo, error) {
+		info, err := sub.ConsumerInfo()
+		if err != nil {
+			return ConsumerInfo{}, err
+		}
+		return toConsumerInfo(info), nil
+	}
+}
+
+func toConsumerInfo(info *nats.ConsumerInfo) ConsumerInfo {
+	return ConsumerInfo{
+		Stream:         info.Stream,
+		Name:           info.Name,
+		NumPending:     info.NumPending,
+		NumAckPending:  info.NumAckPending,
+		NumRedelivered: info.NumRedelivered,
+	}
+}
@@ -0,0 +1,259 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/thumperq/golib/logging"
+)
+
+const (
+	headerResultSubject = "Golib-Result-Subject"
+
+	defaultJobAckWait   = 30 * time.Second
+	priorityFetchWait   = 50 * time.Millisecond
+	lowestPriorityFetch = time.Second
+)
+
+// ErrTerminate is returned, possibly wrapped, by a job or stream handler to stop redelivering a message which can
+// never succeed.
+var ErrTerminate = errors.New("terminate message")
+
+// JobHandler handles a job, a non-nil result is published onto the result topic the job was published with.
+type JobHandler func(ctx context.Context, msg Message) (Event, error)
+
+type WorkQueueOptions struct {
+	// AckWait is how long a job is kept by a worker without a heartbeat before it is redelivered, defaults to 30 seconds.
+	// Heartbeats are sent every third of it while the handler runs.
+	AckWait time.Duration
+	// MaxDeliver limits how often a job is attempted, zero means unlimited.
+	MaxDeliver int
+}
+
+// WorkQueue consumes jobs of work queue retention streams, every job is handled by exactly one worker replica.
+type WorkQueue struct {
+	broker     *Broker
+	middleware Middleware
+}
+
+func NewWorkQueue(broker *Broker, middlewares ...Middleware) *WorkQueue {
+	return &WorkQueue{
+		broker:     broker,
+		middleware: Chain(append([]Middleware{Recovery()}, middlewares...)...),
+	}
+}
+
+// WithWorkQueue creates the work queue stream of the topics, jobs are removed from it once acknowledged.
+// The topics must not be part of the stream created by WithStream.
+func (b *Broker) WithWorkQueue(topics []string) error {
+	if len(topics) <= 0 {
+		return errors.New("topics is empty")
+	}
+	subjects := []string{}
+	for _, t := range topics {
+		subjects = append(subjects, b.namer.Subject(b.domain, b.service, t))
+	}
+	js, err := b.jetStream()
+	if err != nil {
+		return err
+	}
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:      b.namer.StreamName(b.domain, b.service) + "-workqueue",
+		Subjects:  subjects,
+		Retention: nats.WorkQueuePolicy,
+	})
+	return err
+}
+
+// PublishJob publishes a job onto the work queue topic of the broker's domain and service.
+// A non-empty resultTopic of the broker's domain and service receives the result of the job, it has to be captured by a stream.
+func (b *Broker) PublishJob(topic string, job Event, resultTopic string) error {
+	return b.PublishJobTo(b.domain, b.service, topic, job, resultTopic)
+}
+
+// PublishJobTo publishes a job onto the work queue topic of another domain and service.
+func (b *Broker) PublishJobTo(domain string, service string, topic string, job Event, resultTopic string) error {
+	if topic == "" {
+		return errors.New("publish job topic is empty")
+	}
+	if job == nil {
+		return errors.New("publish job data is nil")
+	}
+	js, err := b.jetStream()
+	if err != nil {
+		return err
+	}
+	msg, err := b.encode(b.namer.Subject(domain, service, topic), job)
+	if err != nil {
+		return err
+	}
+	if resultTopic != "" {
+		msg.Header.Set(headerResultSubject, b.namer.Subject(b.domain, b.service, resultTopic))
+	}
+	_, err = js.PublishMsg(msg)
+	if err != nil {
+		b.discardClaim(context.Background(), msg)
+		return err
+	}
+	b.metrics.recordPublished(domain, service, topic, true)
+	return nil
+}
+
+// Subscribe handles the jobs of the topics one at a time, the topics are ordered by priority with the first one being
+// the highest. A job of a lower priority topic is only fetched when every higher priority topic is empty.
+func (q *WorkQueue) Subscribe(ctx context.Context, domain string, service string, topics []string, handler JobHandler, opts WorkQueueOptions) error {
+	if len(topics) <= 0 {
+		return errors.New("topics is empty")
+	}
+	if opts.AckWait <= 0 {
+		opts.AckWait = defaultJobAckWait
+	}
+	js, err := q.broker.jetStream()
+	if err != nil {
+		return err
+	}
+	subOpts := []nats.SubOpt{nats.AckWait(opts.AckWait), nats.PullMaxWaiting(128)}
+	if opts.MaxDeliver > 0 {
+		subOpts = append(subOpts, nats.MaxDeliver(opts.MaxDeliver))
+	}
+	subs := []*nats.Subscription{}
+	tracked := []*trackedConsumer{}
+	for _, topic := range topics {
+		subject := q.broker.namer.Subject(domain, service, topic)
+		durable := q.broker.namer.DurableName(q.broker.domain, q.broker.service, subject)
+		sub, err := js.PullSubscribe(subject, durable, subOpts...)
+		if err != nil {
+			for _, s := range subs {
+				_ = s.Unsubscribe()
+			}
+			return err
+		}
+		tracked = append(tracked, q.broker.metrics.trackConsumer(subscriptionInfo(sub), domain, service, topic, durable))
+		subs = append(subs, sub)
+	}
+	go func() {
+		for ctx.Err() == nil {
+			for i, sub := range subs {
+				wait := priorityFetchWait
+				if i == len(subs)-1 {
+					wait = lowestPriorityFetch
+				}
+				fetchCtx, cancel := context.WithTimeout(ctx, wait)
+				msgs, _ := sub.Fetch(1, nats.Context(fetchCtx))
+				cancel()
+				if len(msgs) > 0 {
+					q.handle(ctx, msgs[0], domain, service, topics[i], handler, opts)
+					break
+				}
+			}
+		}
+		for _, consumer := range tracked {
+			q.broker.metrics.untrackConsumer(consumer)
+		}
+		for _, sub := range subs {
+			err := sub.Unsubscribe()
+			if err != nil {
+				logging.TraceLogger(ctx).
+					Err(err).
+					Msgf("failed to unsubscribe from work queue subject %s", sub.Subject)
+			}
+		}
+	}()
+	return nil
+}
+
+func (q *WorkQueue) handle(ctx context.Context, msg *nats.Msg, domain string, service string, topic string, handler JobHandler, opts WorkQueueOptions) {
+	delivery := Delivery{
+		Subject: msg.Subject,
+		Domain:  domain,
+		Service: service,
+		Topic:   topic,
+		Stream:  true,
+	}
+	if meta, err := msg.Metadata(); err == nil {
+		delivery.NumDelivered = meta.NumDelivered
+	}
+	data, err := q.broker.decode(ctx, msg)
+	if err != nil {
+		logging.TraceLogger(ctx).
+			Err(err).
+			Msgf("failed to unmarshal job with subject %s", msg.Subject)
+		q.broker.metrics.recordDecodeFailure(ctx, delivery)
+		q.settle(ctx, msg, delivery, err)
+		return
+	}
+	stopHeartbeat := heartbeat(ctx, msg, opts.AckWait/3)
+	var result Event
+	start := time.Now()
+	err = q.middleware(func(ctx context.Context, msg Message) error {
+		var err error
+		result, err = handler(ctx, msg)
+		return err
+	})(ContextWithDelivery(ctx, delivery), data)
+	stopHeartbeat()
+	q.broker.metrics.RecordHandled(ctx, delivery, data, time.Since(start), err)
+	if err == nil && result != nil {
+		err = q.publishResult(msg, result)
+	}
+	if err != nil {
+		logging.TraceLogger(ctx).
+			Err(err).
+			Msgf("job handler error for subject %s", msg.Subject)
+	}
+	q.settle(ctx, msg, delivery, err)
+}
+
+func (q *WorkQueue) publishResult(msg *nats.Msg, result Event) error {
+	subject := msg.Header.Get(headerResultSubject)
+	if subject == "" {
+		return nil
+	}
+	js, err := q.broker.jetStream()
+	if err != nil {
+		return err
+	}
+	resultMsg, err := q.broker.encode(subject, result)
+	if err != nil {
+		return err
+	}
+	_, err = js.PublishMsg(resultMsg)
+	if err != nil {
+		q.broker.discardClaim(context.Background(), resultMsg)
+	}
+	return err
+}
+
+func (q *WorkQueue) settle(ctx context.Context, msg *nats.Msg, delivery Delivery, err error) {
+	if settle(ctx, q.broker.metrics, toStreamEnvelope(msg), delivery, err) == outcomeAck {
+		q.broker.releaseClaim(ctx, msg)
+	}
+}
+
+// heartbeat tells the server the job is still in progress until the returned func is called.
+func heartbeat(ctx context.Context, msg *nats.Msg, interval time.Duration) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := msg.InProgress()
+				if err != nil {
+					logging.TraceLogger(ctx).
+						Err(err).
+						Msgf("failed to send in progress for subject %s", msg.Subject)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
@@ -0,0 +1,149 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/thumperq/golib/servers/http/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// public services are not authenticated, probes and grpcurl call them without credentials
+var public = []string{
+	healthpb.Health_ServiceDesc.ServiceName,
+	"grpc.reflection.v1.ServerReflection",
+	"grpc.reflection.v1alpha.ServerReflection",
+}
+
+// Authenticate puts the identity of the first authenticator finding credentials in the call into the context, calls
+// without valid credentials fail with Unauthenticated. The authenticators of the auth package work unchanged, they
+// see the metadata as headers, e.g. authorization or x-api-key, and the client certificate of the connection.
+// The health and reflection services are not authenticated.
+func Authenticate(authenticators ...auth.Authenticator) Interceptor {
+	authenticate := func(ctx context.Context, fullMethod string) (context.Context, error) {
+		if service, _ := splitMethod(fullMethod); slices.Contains(public, service) {
+			return ctx, nil
+		}
+		r := httpRequest(ctx, fullMethod)
+		for _, authenticator := range authenticators {
+			id, err := authenticator.Authenticate(r)
+			if errors.Is(err, auth.ErrNoCredentials) {
+				continue
+			}
+			if errors.Is(err, auth.ErrUnauthenticated) {
+				return nil, status.Error(codes.Unauthenticated, err.Error())
+			}
+			if err != nil {
+				return nil, status.Error(codes.Internal, "authentication failed")
+			}
+			return auth.WithIdentity(ctx, id), nil
+		}
+		return nil, status.Error(codes.Unauthenticated, auth.ErrNoCredentials.Error())
+	}
+	return Interceptor{
+		Unary: func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			ctx, err := authenticate(ctx, info.FullMethod)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		},
+		Stream: func(server any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := authenticate(ss.Context(), info.FullMethod)
+			if err != nil {
+				return err
+			}
+			return handler(server, &contextStream{ServerStream: ss, ctx: ctx})
+		},
+	}
+}
+
+// RequireScopes fails calls whose identity lacks any of the scopes with PermissionDenied.
+func RequireScopes(scopes ...string) Interceptor {
+	return require(func(id *auth.Identity) bool {
+		for _, scope := range scopes {
+			if !id.HasScope(scope) {
+				return false
+			}
+		}
+		return true
+	}, "missing required scope")
+}
+
+// RequireRoles fails calls whose identity has none of the roles with PermissionDenied.
+func RequireRoles(roles ...string) Interceptor {
+	return require(func(id *auth.Identity) bool {
+		return slices.ContainsFunc(roles, id.HasRole)
+	}, "missing required role")
+}
+
+func require(allowed func(*auth.Identity) bool, message string) Interceptor {
+	authorize := func(ctx context.Context, fullMethod string) error {
+		if service, _ := splitMethod(fullMethod); slices.Contains(public, service) {
+			return nil
+		}
+		id, ok := auth.IdentityFromContext(ctx)
+		if !ok {
+			return status.Error(codes.Unauthenticated, auth.ErrNoCredentials.Error())
+		}
+		if !allowed(id) {
+			return status.Error(codes.PermissionDenied, message)
+		}
+		return nil
+	}
+	return Interceptor{
+		Unary: func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			err := authorize(ctx, info.FullMethod)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		},
+		Stream: func(server any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			err := authorize(ss.Context(), info.FullMethod)
+			if err != nil {
+				return err
+			}
+			return handler(server, ss)
+		},
+	}
+}
+
+// httpRequest describes the call as request for the authenticators, with the metadata as headers and the TLS state
+// of the connection.
+func httpRequest(ctx context.Context, fullMethod string) *http.Request {
+	r := &http.Request{
+		Method: http.MethodPost,
+		URL:    &url.URL{Path: fullMethod},
+		Header: http.Header{},
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		if strings.HasPrefix(key, ":") {
+			continue
+		}
+		for _, value := range values {
+			r.Header.Add(key, value)
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if p.Addr != nil {
+			r.RemoteAddr = p.Addr.String()
+		}
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state := tlsInfo.State
+			r.TLS = &state
+		}
+	}
+	return r.WithContext(ctx)
+}
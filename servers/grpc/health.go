@@ -0,0 +1,74 @@
+package grpcserver
+
+import (
+	"context"
+	"time"
+
+	"github.com/thumperq/golib/health"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// ServiceLiveness is the service name of the liveness in health checks, e.g. of a Kubernetes gRPC liveness probe.
+// The empty service name and the names of the registered services report the readiness.
+const ServiceLiveness = "liveness"
+
+const watchInterval = 5 * time.Second
+
+// healthServer implements the gRPC health protocol with the checks of the health registry.
+type healthServer struct {
+	healthpb.UnimplementedHealthServer
+	srv *Server
+}
+
+func (h *healthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	servingStatus := h.status(ctx, req.GetService())
+	if servingStatus == healthpb.HealthCheckResponse_SERVICE_UNKNOWN {
+		return nil, status.Errorf(codes.NotFound, "unknown service %s", req.GetService())
+	}
+	return &healthpb.HealthCheckResponse{Status: servingStatus}, nil
+}
+
+// Watch sends the status whenever it changes, the checks run every 5 seconds. The stream ends once the shutdown
+// started, so it does not hold up the graceful stop.
+func (h *healthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	ctx := stream.Context()
+	registry := h.srv.Health()
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	last := healthpb.HealthCheckResponse_ServingStatus(-1)
+	for {
+		servingStatus := h.status(ctx, req.GetService())
+		if servingStatus != last {
+			err := stream.Send(&healthpb.HealthCheckResponse{Status: servingStatus})
+			if err != nil {
+				return err
+			}
+			last = servingStatus
+		}
+		select {
+		case <-ticker.C:
+		case <-registry.Done():
+			return stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING})
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+func (h *healthServer) status(ctx context.Context, service string) healthpb.HealthCheckResponse_ServingStatus {
+	var report health.Report
+	switch _, registered := h.srv.Engine.GetServiceInfo()[service]; {
+	case service == ServiceLiveness:
+		report = h.srv.Health().Liveness(ctx)
+	case service == "" || registered:
+		report = h.srv.Health().Readiness(ctx)
+	default:
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN
+	}
+	if !report.Up() {
+		return healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	return healthpb.HealthCheckResponse_SERVING
+}
@@ -0,0 +1,168 @@
+package grpcserver
+
+import (
+	"context"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/thumperq/golib/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const instrumentationName = "github.com/thumperq/golib/servers/grpc"
+
+// Telemetry continues the W3C trace context of the call metadata in a server span per method, like the Telemetry
+// middleware of the ApiServer. Without tracer provider the global one is used.
+func Telemetry(provider trace.TracerProvider) Interceptor {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	tracer := provider.Tracer(instrumentationName)
+	propagator := propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+	start := func(ctx context.Context, fullMethod string) (context.Context, trace.Span) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		ctx = propagator.Extract(ctx, metadataCarrier(md))
+		service, method := splitMethod(fullMethod)
+		return tracer.Start(ctx, strings.TrimPrefix(fullMethod, "/"),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("rpc.system", "grpc"),
+				attribute.String("rpc.service", service),
+				attribute.String("rpc.method", method)))
+	}
+	end := func(span trace.Span, err error) {
+		code := status.Code(err)
+		span.SetAttributes(attribute.Int("rpc.grpc.status_code", int(code)))
+		if serverError(code) {
+			span.SetStatus(otelcodes.Error, code.String())
+		}
+		span.End()
+	}
+	return Interceptor{
+		Unary: func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			ctx, span := start(ctx, info.FullMethod)
+			resp, err := handler(ctx, req)
+			end(span, err)
+			return resp, err
+		},
+		Stream: func(server any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, span := start(ss.Context(), info.FullMethod)
+			err := handler(server, &contextStream{ServerStream: ss, ctx: ctx})
+			end(span, err)
+			return err
+		},
+	}
+}
+
+// AccessLog logs method, status code and duration of every call.
+func AccessLog() Interceptor {
+	log := func(ctx context.Context, fullMethod string, start time.Time, err error) {
+		code := status.Code(err)
+		logger := logging.TraceLogger(ctx)
+		event := logger.Info()
+		if serverError(code) {
+			event = logger.Error().Err(err)
+		}
+		event.
+			Str("method", fullMethod).
+			Str("code", code.String()).
+			Dur("duration", time.Since(start)).
+			Msg("grpc call")
+	}
+	return Interceptor{
+		Unary: func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			start := time.Now()
+			resp, err := handler(ctx, req)
+			log(ctx, info.FullMethod, start, err)
+			return resp, err
+		},
+		Stream: func(server any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			start := time.Now()
+			err := handler(server, ss)
+			log(ss.Context(), info.FullMethod, start, err)
+			return err
+		},
+	}
+}
+
+// Recover fails calls whose handler panics with Internal, the panic is logged with its stack but not exposed.
+func Recover() Interceptor {
+	recovered := func(ctx context.Context, fullMethod string, err *error) {
+		r := recover()
+		if r == nil {
+			return
+		}
+		logging.TraceLogger(ctx).
+			Error().
+			Str("stack", string(debug.Stack())).
+			Msgf("%s panicked: %v", fullMethod, r)
+		*err = status.Error(codes.Internal, "internal error")
+	}
+	return Interceptor{
+		Unary: func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+			defer recovered(ctx, info.FullMethod, &err)
+			return handler(ctx, req)
+		},
+		Stream: func(server any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+			defer recovered(ss.Context(), info.FullMethod, &err)
+			return handler(server, ss)
+		},
+	}
+}
+
+// serverError reports whether the code is a failure of the server rather than of the call, like a 5xx status.
+func serverError(code codes.Code) bool {
+	switch code {
+	case codes.Unknown, codes.DeadlineExceeded, codes.Unimplemented, codes.Internal, codes.Unavailable, codes.DataLoss:
+		return true
+	}
+	return false
+}
+
+// splitMethod splits /package.Service/Method into the service and the method.
+func splitMethod(fullMethod string) (string, string) {
+	service, method, _ := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	return service, method
+}
+
+// contextStream replaces the context of the stream, e.g. with the context of the span.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// metadataCarrier adapts incoming metadata to the propagators.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (c metadataCarrier) Set(key string, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
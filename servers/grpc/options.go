@@ -0,0 +1,71 @@
+package grpcserver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/thumperq/golib/config"
+)
+
+const (
+	CfgGrpcPort            = "GRPC_PORT"
+	CfgGrpcShutdownTimeout = "GRPC_SHUTDOWN_TIMEOUT"
+	CfgGrpcReflection      = "GRPC_REFLECTION"
+	CfgGrpcSharedPort      = "GRPC_SHARED_PORT"
+)
+
+// Options configures the Server.
+type Options struct {
+	Port uint16
+	// ShutdownTimeout bounds the graceful stop, calls still running afterwards are cancelled.
+	ShutdownTimeout time.Duration
+	// Reflection registers the reflection service, e.g. for grpcurl. It is enabled outside of production by default.
+	Reflection bool
+	// SharedPort serves gRPC on the port of the ApiServer instead of Port.
+	SharedPort bool
+}
+
+// DefaultOptions listens on port 9090, reflection is enabled unless ENVIRONMENT is prod or production.
+func DefaultOptions() Options {
+	return Options{
+		Port:            9090,
+		ShutdownTimeout: 10 * time.Second,
+		Reflection:      !config.IsProduction(),
+	}
+}
+
+// OptionsFromConfig overrides the default options with the values of the GRPC_* config keys which are set.
+func OptionsFromConfig(ctx context.Context, cfg config.CfgManager) (Options, error) {
+	opts := DefaultOptions()
+	values := map[string]string{}
+	for _, key := range []string{CfgGrpcPort, CfgGrpcShutdownTimeout, CfgGrpcReflection, CfgGrpcSharedPort} {
+		value, err := config.GetOptionalValue(ctx, cfg, key)
+		if err != nil {
+			return opts, err
+		}
+		if value != "" {
+			values[key] = value
+		}
+	}
+	if value, ok := values[CfgGrpcPort]; ok {
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s: %w", CfgGrpcPort, err)
+		}
+		opts.Port = uint16(port)
+	}
+	if value, ok := values[CfgGrpcShutdownTimeout]; ok {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s: %w", CfgGrpcShutdownTimeout, err)
+		}
+		opts.ShutdownTimeout = d
+	}
+	err := config.ParseBools(values, map[string]*bool{
+		CfgGrpcReflection: &opts.Reflection,
+		CfgGrpcSharedPort: &opts.SharedPort,
+	})
+	return opts, err
+}
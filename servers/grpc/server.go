@@ -0,0 +1,200 @@
+package grpcserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/thumperq/golib/health"
+	"github.com/thumperq/golib/lifecycle"
+	httpserver "github.com/thumperq/golib/servers/http"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+// Server serves gRPC services, either on its own port or on the port of the ApiServer. Services are registered on the
+// Engine, e.g. orderpb.RegisterOrderServiceServer(srv.Engine, orders).
+type Server struct {
+	Engine   *grpc.Server
+	options  Options
+	listener net.Listener
+	mu       sync.RWMutex
+	health   *health.Registry
+	unary    []grpc.UnaryServerInterceptor
+	stream   []grpc.StreamServerInterceptor
+	// calls are the calls in flight on the port of the ApiServer, which does not track the h2c connections
+	callsMu  sync.Mutex
+	calls    sync.WaitGroup
+	draining bool
+}
+
+// Interceptor intercepts unary and streaming calls like a middleware of the ApiServer.
+type Interceptor struct {
+	Unary  grpc.UnaryServerInterceptor
+	Stream grpc.StreamServerInterceptor
+}
+
+// NewServer returns a server with the gRPC health service, and the reflection service when enabled. Calls are traced
+// and logged and panics in handlers are recovered. The server options are passed on to grpc.NewServer.
+func NewServer(opts Options, serverOptions ...grpc.ServerOption) *Server {
+	srv := &Server{
+		options: opts,
+		health:  health.NewRegistry(),
+	}
+	serverOptions = append(serverOptions,
+		grpc.ChainUnaryInterceptor(srv.interceptUnary),
+		grpc.ChainStreamInterceptor(srv.interceptStream))
+	srv.Engine = grpc.NewServer(serverOptions...)
+	healthpb.RegisterHealthServer(srv.Engine, &healthServer{srv: srv})
+	if opts.Reflection {
+		reflection.Register(srv.Engine)
+	}
+	srv.Use(Telemetry(nil), AccessLog(), Recover())
+	return srv
+}
+
+// Use intercepts every call of the server with the interceptors, the first interceptor is the outermost.
+// It has to be called before the server is started.
+func (srv *Server) Use(interceptors ...Interceptor) {
+	for _, interceptor := range interceptors {
+		if interceptor.Unary != nil {
+			srv.unary = append(srv.unary, interceptor.Unary)
+		}
+		if interceptor.Stream != nil {
+			srv.stream = append(srv.stream, interceptor.Stream)
+		}
+	}
+}
+
+func (srv *Server) interceptUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	for i := len(srv.unary) - 1; i >= 0; i-- {
+		interceptor, next := srv.unary[i], handler
+		handler = func(ctx context.Context, req any) (any, error) {
+			return interceptor(ctx, req, info, next)
+		}
+	}
+	return handler(ctx, req)
+}
+
+func (srv *Server) interceptStream(server any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	for i := len(srv.stream) - 1; i >= 0; i-- {
+		interceptor, next := srv.stream[i], handler
+		handler = func(server any, ss grpc.ServerStream) error {
+			return interceptor(server, ss, info, next)
+		}
+	}
+	return handler(server, ss)
+}
+
+// Health returns the registry of the health service, share it with WithHealth.
+func (srv *Server) Health() *health.Registry {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.health
+}
+
+// WithHealth reports the checks of the registry, e.g. of the ApiServer, in the health service.
+func (srv *Server) WithHealth(registry *health.Registry) *Server {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.health = registry
+	return srv
+}
+
+// Addr returns the address the server listens on, it is only set once the server is started on its own port.
+func (srv *Server) Addr() net.Addr {
+	if srv.listener == nil {
+		return nil
+	}
+	return srv.listener.Addr()
+}
+
+// Mount serves the gRPC calls on the port of the ApiServer. Like Start it fails the health checks when the shutdown
+// starts, the DrainHTTP phase waits for the calls in flight and rejects new ones as unavailable.
+func (srv *Server) Mount(m *lifecycle.Manager, api *httpserver.ApiServer) {
+	api.HandleGRPC(http.HandlerFunc(srv.serveHTTP))
+	m.OnStop(lifecycle.StopAccepting, "grpc health", func(ctx context.Context) error {
+		srv.Health().ShutDown()
+		return nil
+	})
+	m.OnStop(lifecycle.DrainHTTP, "grpc calls", func(ctx context.Context) error {
+		return srv.stop(ctx, func() {
+			srv.callsMu.Lock()
+			srv.draining = true
+			srv.callsMu.Unlock()
+			srv.calls.Wait()
+		})
+	})
+}
+
+func (srv *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.callsMu.Lock()
+	if srv.draining {
+		srv.callsMu.Unlock()
+		// clients map the status to codes.Unavailable and retry on another replica
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	srv.calls.Add(1)
+	srv.callsMu.Unlock()
+	defer srv.calls.Done()
+	srv.Engine.ServeHTTP(w, r)
+}
+
+// Start serves on the port of the options until the manager shuts down. Like the ApiServer it fails the health
+// checks when the shutdown starts and stops gracefully in the DrainHTTP phase.
+func (srv *Server) Start(m *lifecycle.Manager) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", srv.options.Port))
+	if err != nil {
+		return err
+	}
+	srv.listener = listener
+	m.OnStop(lifecycle.StopAccepting, "grpc health", func(ctx context.Context) error {
+		srv.Health().ShutDown()
+		return nil
+	})
+	m.OnStop(lifecycle.DrainHTTP, "grpc server", func(ctx context.Context) error {
+		return srv.stop(ctx, srv.Engine.GracefulStop)
+	})
+	go func() {
+		err := srv.Engine.Serve(listener)
+		if err != nil {
+			m.Fail(fmt.Errorf("grpc server failed: %w", err))
+		}
+	}()
+	return nil
+}
+
+// stop waits for the graceful stop until the ShutdownTimeout.
+func (srv *Server) stop(ctx context.Context, gracefulStop func()) error {
+	if srv.options.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, srv.options.ShutdownTimeout)
+		defer cancel()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		gracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		// cancels the calls still running, e.g. streams which never end
+		srv.Engine.Stop()
+		return fmt.Errorf("grpc calls cancelled: %w", ctx.Err())
+	}
+}
+
+// Serve serves on the port of the ApiServer with SharedPort and on its own port otherwise.
+func (srv *Server) Serve(m *lifecycle.Manager, api *httpserver.ApiServer) error {
+	if srv.options.SharedPort {
+		srv.Mount(m, api)
+		return nil
+	}
+	return srv.Start(m)
+}
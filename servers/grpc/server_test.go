@@ -0,0 +1,186 @@
+package grpcserver_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thumperq/golib/health"
+	"github.com/thumperq/golib/lifecycle"
+	messagingTest "github.com/thumperq/golib/messaging/test"
+	grpcserver "github.com/thumperq/golib/servers/grpc"
+	httpserver "github.com/thumperq/golib/servers/http"
+	"github.com/thumperq/golib/servers/http/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// whoAmI answers the subject of the caller, it is registered without generated code.
+var whoAmI = grpc.ServiceDesc{
+	ServiceName: "test.WhoAmI",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Subject",
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := &emptypb.Empty{}
+			err := dec(req)
+			if err != nil {
+				return nil, err
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/test.WhoAmI/Subject"}
+			return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+				id, _ := auth.IdentityFromContext(ctx)
+				return wrapperspb.String(id.Subject), nil
+			})
+		},
+	}},
+}
+
+// slowService answers after the delay, started and finished receive the calls once they are in flight and answered.
+func slowService(started chan<- struct{}, finished chan<- struct{}, delay time.Duration) *grpc.ServiceDesc {
+	return &grpc.ServiceDesc{
+		ServiceName: "test.Slow",
+		HandlerType: (*any)(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Wait",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+				req := &emptypb.Empty{}
+				err := dec(req)
+				if err != nil {
+					return nil, err
+				}
+				started <- struct{}{}
+				time.Sleep(delay)
+				finished <- struct{}{}
+				return &emptypb.Empty{}, nil
+			},
+		}},
+	}
+}
+
+func dial(t *testing.T, port uint16) *grpc.ClientConn {
+	conn, err := grpc.Dial(fmt.Sprintf("127.0.0.1:%d", port), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestServer(t *testing.T) {
+	opts := grpcserver.DefaultOptions()
+	opts.Port = uint16(messagingTest.FreePort(t))
+	opts.Reflection = true
+	srv := grpcserver.NewServer(opts)
+	srv.Use(grpcserver.Authenticate(auth.NewAPIKeyAuthenticator("", auth.APIKeys{"secret": {Subject: "picking"}})))
+	srv.Engine.RegisterService(&whoAmI, struct{}{})
+	var dbErr error
+	srv.Health().Register(health.Check{Name: "postgres", Check: func(ctx context.Context) error { return dbErr }})
+	require.Contains(t, srv.Engine.GetServiceInfo(), "grpc.reflection.v1.ServerReflection")
+
+	m := lifecycle.NewManager().WithSignals().WithDrainDelay(0)
+	require.NoError(t, srv.Start(m))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exitCode := make(chan int, 1)
+	go func() { exitCode <- m.Run(ctx) }()
+	conn := dial(t, opts.Port)
+	client := healthpb.NewHealthClient(conn)
+
+	resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+	dbErr = errors.New("connection refused")
+	resp, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "test.WhoAmI"})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.Status)
+	resp, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: grpcserver.ServiceLiveness})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+	_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "test.Unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	dbErr = nil
+
+	subject := &wrapperspb.StringValue{}
+	err = conn.Invoke(context.Background(), "/test.WhoAmI/Subject", &emptypb.Empty{}, subject)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	ctxWithKey := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "secret")
+	require.NoError(t, conn.Invoke(ctxWithKey, "/test.WhoAmI/Subject", &emptypb.Empty{}, subject))
+	require.Equal(t, "picking", subject.Value)
+
+	// watches end once the shutdown starts, they do not hold up the graceful stop
+	watch, err := client.Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	resp, err = watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+	cancel()
+	resp, err = watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.Status)
+	_, err = watch.Recv()
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, 0, <-exitCode)
+}
+
+func TestSharedPort(t *testing.T) {
+	httpOpts := httpserver.DefaultOptions()
+	httpOpts.Port = uint16(messagingTest.FreePort(t))
+	httpOpts.RoutePrefix = "/wms/ordering"
+	// the calls outlast the write timeout of the ApiServer
+	httpOpts.WriteTimeout = 100 * time.Millisecond
+	opts := grpcserver.DefaultOptions()
+	opts.SharedPort = true
+	started, finished := make(chan struct{}, 2), make(chan struct{}, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exitCode := make(chan int, 1)
+	go func() {
+		m := lifecycle.NewManager().WithSignals().WithDrainDelay(0)
+		exitCode <- httpserver.Run(ctx, m, httpOpts, func(api *httpserver.ApiServer) error {
+			srv := grpcserver.NewServer(opts).WithHealth(api.Health())
+			srv.Engine.RegisterService(slowService(started, finished, 300*time.Millisecond), struct{}{})
+			return srv.Serve(m, api)
+		})
+	}()
+
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/wms/ordering/health/live", httpOpts.Port))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 20*time.Millisecond)
+	conn := dial(t, httpOpts.Port)
+	resp, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+	require.NoError(t, conn.Invoke(context.Background(), "/test.Slow/Wait", &emptypb.Empty{}, &emptypb.Empty{}))
+	<-started
+	<-finished
+
+	// the shutdown waits for the calls in flight and rejects new ones
+	result := make(chan error, 1)
+	go func() {
+		result <- conn.Invoke(context.Background(), "/test.Slow/Wait", &emptypb.Empty{}, &emptypb.Empty{})
+	}()
+	<-started
+	cancel()
+	require.Eventually(t, func() bool {
+		_, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+		return status.Code(err) == codes.Unavailable
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 0, <-exitCode)
+	require.Len(t, finished, 1, "the shutdown waits for the call in flight")
+	require.NoError(t, <-result)
+}
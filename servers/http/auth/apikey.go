@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const HeaderAPIKey = "X-Api-Key"
+
+// APIKeyStore looks up the identity owning an api key, unknown keys return ErrUnauthenticated.
+type APIKeyStore interface {
+	Lookup(ctx context.Context, key string) (*Identity, error)
+}
+
+// APIKeys is a static APIKeyStore of the identities by their api key.
+type APIKeys map[string]Identity
+
+func (keys APIKeys) Lookup(ctx context.Context, key string) (*Identity, error) {
+	var found *Identity
+	for candidate, id := range keys {
+		// compare every key in constant time so the response time does not reveal valid prefixes
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(key)) == 1 {
+			found = &id
+		}
+	}
+	if found == nil {
+		return nil, ErrUnauthenticated
+	}
+	return found, nil
+}
+
+type apiKeyAuthenticator struct {
+	header string
+	store  APIKeyStore
+}
+
+// NewAPIKeyAuthenticator authenticates requests with the api key in the header, X-Api-Key when empty.
+func NewAPIKeyAuthenticator(header string, store APIKeyStore) Authenticator {
+	if header == "" {
+		header = HeaderAPIKey
+	}
+	return &apiKeyAuthenticator{header: header, store: store}
+}
+
+func (a *apiKeyAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	key := r.Header.Get(a.header)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	id, err := a.store.Lookup(r.Context(), key)
+	if errors.Is(err, ErrUnauthenticated) {
+		return nil, fmt.Errorf("%w: invalid api key", ErrUnauthenticated)
+	}
+	if err != nil {
+		return nil, err
+	}
+	id.Method = MethodAPIKey
+	return id, nil
+}
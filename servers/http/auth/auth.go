@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+
+	httpserver "github.com/thumperq/golib/servers/http"
+)
+
+const (
+	MethodJWT    = "jwt"
+	MethodAPIKey = "apikey"
+	MethodMTLS   = "mtls"
+)
+
+var (
+	// ErrNoCredentials is returned by authenticators when the request carries none of their credentials.
+	ErrNoCredentials   = errors.New("no credentials")
+	ErrUnauthenticated = errors.New("unauthenticated")
+	ErrForbidden       = errors.New("forbidden")
+)
+
+func init() {
+	httpserver.RegisterError(ErrUnauthenticated, http.StatusUnauthorized)
+	httpserver.RegisterError(ErrForbidden, http.StatusForbidden)
+}
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	// Method is the authenticator which identified the caller, one of jwt, apikey or mtls.
+	Method  string
+	Subject string
+	Scopes  []string
+	Roles   []string
+	// Claims are all claims of a jwt, or the attributes of api keys and client certificates.
+	Claims map[string]any
+}
+
+func (id *Identity) HasScope(scope string) bool {
+	return slices.Contains(id.Scopes, scope)
+}
+
+func (id *Identity) HasRole(role string) bool {
+	return slices.Contains(id.Roles, role)
+}
+
+// Authenticator identifies the caller of a request. It returns ErrNoCredentials when the request carries none of
+// its credentials and an error wrapping ErrUnauthenticated when they are invalid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFromContext returns the identity set by the Authenticate middleware.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
+
+// Authenticate puts the identity of the first authenticator finding credentials in the request into the context.
+// Requests without valid credentials are answered with 401.
+func Authenticate(authenticators ...Authenticator) httpserver.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, authenticator := range authenticators {
+				id, err := authenticator.Authenticate(r)
+				if errors.Is(err, ErrNoCredentials) {
+					continue
+				}
+				if errors.Is(err, ErrUnauthenticated) {
+					unauthorized(w, r, err)
+					return
+				}
+				if err != nil {
+					httpserver.WriteError(w, r, err)
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
+				return
+			}
+			unauthorized(w, r, ErrNoCredentials)
+		})
+	}
+}
+
+// RequireScopes answers requests whose identity lacks any of the scopes with 403.
+func RequireScopes(scopes ...string) httpserver.Middleware {
+	return require(func(id *Identity) bool {
+		for _, scope := range scopes {
+			if !id.HasScope(scope) {
+				return false
+			}
+		}
+		return true
+	}, "missing required scope")
+}
+
+// RequireRoles answers requests whose identity has none of the roles with 403.
+func RequireRoles(roles ...string) httpserver.Middleware {
+	return require(func(id *Identity) bool {
+		return slices.ContainsFunc(roles, id.HasRole)
+	}, "missing required role")
+}
+
+func require(allowed func(*Identity) bool, detail string) httpserver.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, ok := IdentityFromContext(r.Context())
+			if !ok {
+				unauthorized(w, r, ErrNoCredentials)
+				return
+			}
+			if !allowed(id) {
+				httpserver.WriteError(w, r, httpserver.NewProblem(http.StatusForbidden, detail))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	httpserver.WriteError(w, r, httpserver.NewProblem(http.StatusUnauthorized, err.Error()))
+}
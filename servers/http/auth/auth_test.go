@@ -0,0 +1,187 @@
+package auth_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	httpserver "github.com/thumperq/golib/servers/http"
+	"github.com/thumperq/golib/servers/http/auth"
+	authTest "github.com/thumperq/golib/servers/http/auth/test"
+)
+
+func identityHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := auth.IdentityFromContext(r.Context())
+	_ = httpserver.Json(http.StatusOK, w, id)
+}
+
+func serve(handler http.Handler, configure func(r *http.Request)) (*httptest.ResponseRecorder, httpserver.Problem) {
+	req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	configure(req)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var problem httpserver.Problem
+	if w.Header().Get("Content-Type") == httpserver.ProblemContentType {
+		_ = json.Unmarshal(w.Body.Bytes(), &problem)
+	}
+	return w, problem
+}
+
+func bearer(token string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func TestOIDCAuthenticationAndScopes(t *testing.T) {
+	provider := authTest.NewOIDCProvider(t)
+	authenticator, err := auth.NewOIDCAuthenticator(context.Background(), provider.Issuer, auth.JWTOptions{
+		Audience:   []string{"ordering"},
+		RolesClaim: "realm_access.roles",
+	})
+	require.NoError(t, err)
+	handler := httpserver.Chain(
+		auth.Authenticate(authenticator),
+		auth.RequireScopes("orders:read"),
+		auth.RequireRoles("clerk", "admin"),
+	)(http.HandlerFunc(identityHandler))
+
+	token := provider.Token(t, map[string]any{
+		"sub":          "user-1",
+		"aud":          "ordering",
+		"scope":        "orders:read orders:write",
+		"realm_access": map[string]any{"roles": []string{"clerk"}},
+	})
+	for i := 0; i < 3; i++ {
+		w, _ := serve(handler, bearer(token))
+		require.Equal(t, http.StatusOK, w.Code)
+		var id auth.Identity
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &id))
+		require.Equal(t, auth.MethodJWT, id.Method)
+		require.Equal(t, "user-1", id.Subject)
+		require.Equal(t, []string{"orders:read", "orders:write"}, id.Scopes)
+		require.Equal(t, []string{"clerk"}, id.Roles)
+	}
+	require.Equal(t, 1, provider.JWKSRequests(), "keys are cached")
+
+	w, problem := serve(handler, func(r *http.Request) {})
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+	require.Equal(t, "no credentials", problem.Detail)
+
+	w, _ = serve(handler, bearer(provider.Token(t, map[string]any{"sub": "user-1", "aud": "ordering", "realm_access": map[string]any{"roles": []string{"clerk"}}})))
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	w, _ = serve(handler, bearer(provider.Token(t, map[string]any{"sub": "user-1", "aud": "ordering", "scope": "orders:read"})))
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	w, problem = serve(handler, bearer(provider.Token(t, map[string]any{"sub": "user-1", "aud": "billing", "scope": "orders:read"})))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Equal(t, "unauthenticated: invalid audience", problem.Detail)
+
+	w, problem = serve(handler, bearer(provider.Token(t, map[string]any{"sub": "user-1", "aud": "ordering", "exp": time.Now().Add(-time.Hour).Unix()})))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Equal(t, "unauthenticated: token is expired", problem.Detail)
+
+	w, _ = serve(handler, bearer(token[:len(token)-4]+"AAAA"))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// tokens of an unknown key are rejected until the keys are refetched, which happens at most once per minute
+	provider.RotateKey(t)
+	rotated := provider.Token(t, map[string]any{"sub": "user-1", "aud": "ordering", "scope": "orders:read", "realm_access": map[string]any{"roles": []string{"admin"}}})
+	w, problem = serve(handler, bearer(rotated))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Equal(t, "unauthenticated: unknown signing key", problem.Detail)
+	require.Equal(t, 1, provider.JWKSRequests())
+
+	keys, err := auth.NewOIDCKeySet(context.Background(), provider.Issuer)
+	require.NoError(t, err)
+	refreshing := auth.Authenticate(auth.NewJWTAuthenticator(keys.WithMinRefreshInterval(0), auth.JWTOptions{Issuer: provider.Issuer}))(http.HandlerFunc(identityHandler))
+	w, _ = serve(refreshing, bearer(rotated))
+	require.Equal(t, http.StatusOK, w.Code)
+	provider.RotateKey(t)
+	w, _ = serve(refreshing, bearer(provider.Token(t, map[string]any{"sub": "user-2"})))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, 3, provider.JWKSRequests())
+}
+
+func TestJWKSFileAuthentication(t *testing.T) {
+	provider := authTest.NewOIDCProvider(t)
+	data, err := json.Marshal(provider.JWKS())
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	keys, err := auth.NewFileKeySet(path)
+	require.NoError(t, err)
+	handler := auth.Authenticate(auth.NewJWTAuthenticator(keys, auth.JWTOptions{Issuer: provider.Issuer}))(http.HandlerFunc(identityHandler))
+
+	w, _ := serve(handler, bearer(provider.Token(t, map[string]any{"sub": "user-1", "scp": []string{"orders:read"}})))
+	require.Equal(t, http.StatusOK, w.Code)
+	var id auth.Identity
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &id))
+	require.Equal(t, []string{"orders:read"}, id.Scopes)
+
+	w, problem := serve(handler, bearer(provider.Token(t, map[string]any{"sub": "user-1", "iss": "https://other.example.com"})))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Equal(t, "unauthenticated: invalid issuer", problem.Detail)
+
+	// tokens without expiry are only accepted when allowed
+	unexpiring := provider.Token(t, map[string]any{"sub": "user-1", "exp": nil})
+	w, problem = serve(handler, bearer(unexpiring))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Equal(t, "unauthenticated: token has no expiry", problem.Detail)
+	allowing := auth.Authenticate(auth.NewJWTAuthenticator(keys, auth.JWTOptions{Issuer: provider.Issuer, AllowMissingExpiry: true}))(http.HandlerFunc(identityHandler))
+	w, _ = serve(allowing, bearer(unexpiring))
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestAPIKeyAndMTLSAuthentication(t *testing.T) {
+	handler := httpserver.Chain(
+		auth.Authenticate(
+			auth.NewMTLSAuthenticator(),
+			auth.NewAPIKeyAuthenticator("", auth.APIKeys{
+				"secret-1": {Subject: "reporting", Scopes: []string{"orders:read"}},
+			}),
+		),
+		auth.RequireScopes("orders:read"),
+	)(http.HandlerFunc(identityHandler))
+
+	w, _ := serve(handler, func(r *http.Request) { r.Header.Set(auth.HeaderAPIKey, "secret-1") })
+	require.Equal(t, http.StatusOK, w.Code)
+	var id auth.Identity
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &id))
+	require.Equal(t, auth.MethodAPIKey, id.Method)
+	require.Equal(t, "reporting", id.Subject)
+
+	w, problem := serve(handler, func(r *http.Request) { r.Header.Set(auth.HeaderAPIKey, "secret-2") })
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Equal(t, "unauthenticated: invalid api key", problem.Detail)
+
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "picking-service", OrganizationalUnit: []string{"warehouse"}},
+		DNSNames:     []string{"picking.internal"},
+	}
+	client := func(r *http.Request) {
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	w, _ = serve(handler, client)
+	require.Equal(t, http.StatusForbidden, w.Code, "client certificates carry no scopes")
+
+	roles := auth.Authenticate(auth.NewMTLSAuthenticator())(auth.RequireRoles("warehouse")(http.HandlerFunc(identityHandler)))
+	w, _ = serve(roles, client)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &id))
+	require.Equal(t, auth.MethodMTLS, id.Method)
+	require.Equal(t, "picking-service", id.Subject)
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	defaultKeyRefreshInterval    = time.Hour
+	defaultKeyMinRefreshInterval = time.Minute
+)
+
+var ErrKeyNotFound = errors.New("signing key not found")
+
+// KeySet provides the keys verifying the signatures of jwts, kid is the key id of the token header and may be empty.
+type KeySet interface {
+	Key(ctx context.Context, kid string) (*jose.JSONWebKey, error)
+}
+
+type staticKeySet struct {
+	keys jose.JSONWebKeySet
+}
+
+func NewStaticKeySet(keys jose.JSONWebKeySet) KeySet {
+	return &staticKeySet{keys: keys}
+}
+
+// NewFileKeySet reads a JWKS document from the file.
+func NewFileKeySet(path string) (KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys jose.JSONWebKeySet
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwks file %s: %w", path, err)
+	}
+	return NewStaticKeySet(keys), nil
+}
+
+func (s *staticKeySet) Key(ctx context.Context, kid string) (*jose.JSONWebKey, error) {
+	return findKey(s.keys, kid)
+}
+
+// RemoteKeySet fetches a JWKS document from a url and caches its keys. The keys are fetched again when they are
+// older than the refresh interval, or when a token is signed by an unknown key, e.g. after the provider rotated
+// its keys, at most once per min refresh interval.
+type RemoteKeySet struct {
+	url                string
+	client             *http.Client
+	refreshInterval    time.Duration
+	minRefreshInterval time.Duration
+	mu                 sync.Mutex
+	keys               jose.JSONWebKeySet
+	fetchedAt          time.Time
+}
+
+func NewRemoteKeySet(url string) *RemoteKeySet {
+	return &RemoteKeySet{
+		url:                url,
+		client:             &http.Client{Timeout: 10 * time.Second},
+		refreshInterval:    defaultKeyRefreshInterval,
+		minRefreshInterval: defaultKeyMinRefreshInterval,
+	}
+}
+
+// NewOIDCKeySet discovers the jwks_uri of the OpenID Connect issuer from its /.well-known/openid-configuration.
+func NewOIDCKeySet(ctx context.Context, issuer string) (*RemoteKeySet, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JwksURI string `json:"jwks_uri"`
+	}
+	err := getJson(ctx, client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery of %s failed: %w", issuer, err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("oidc discovery of %s returned issuer %s", issuer, discovery.Issuer)
+	}
+	if discovery.JwksURI == "" {
+		return nil, fmt.Errorf("oidc discovery of %s returned no jwks_uri", issuer)
+	}
+	keys := NewRemoteKeySet(discovery.JwksURI)
+	keys.client = client
+	return keys, nil
+}
+
+func (s *RemoteKeySet) WithRefreshInterval(interval time.Duration) *RemoteKeySet {
+	s.refreshInterval = interval
+	return s
+}
+
+func (s *RemoteKeySet) WithMinRefreshInterval(interval time.Duration) *RemoteKeySet {
+	s.minRefreshInterval = interval
+	return s
+}
+
+func (s *RemoteKeySet) Key(ctx context.Context, kid string) (*jose.JSONWebKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sinceFetch := time.Since(s.fetchedAt)
+	if !s.fetchedAt.IsZero() && sinceFetch < s.refreshInterval {
+		key, err := findKey(s.keys, kid)
+		if err == nil || sinceFetch < s.minRefreshInterval {
+			return key, err
+		}
+	}
+	var keys jose.JSONWebKeySet
+	err := getJson(ctx, s.client, s.url, &keys)
+	if err != nil {
+		if !s.fetchedAt.IsZero() {
+			// keep verifying with the cached keys while the provider is unavailable
+			if key, findErr := findKey(s.keys, kid); findErr == nil {
+				return key, nil
+			}
+		}
+		return nil, fmt.Errorf("failed to fetch jwks from %s: %w", s.url, err)
+	}
+	s.keys = keys
+	s.fetchedAt = time.Now()
+	return findKey(s.keys, kid)
+}
+
+// findKey returns the signing key with the id, tokens without key id are verified by the only signing key of the set.
+func findKey(keys jose.JSONWebKeySet, kid string) (*jose.JSONWebKey, error) {
+	var found []jose.JSONWebKey
+	for _, key := range keys.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if kid == "" || key.KeyID == kid {
+			found = append(found, key)
+		}
+	}
+	if len(found) != 1 {
+		return nil, fmt.Errorf("%w: kid %q", ErrKeyNotFound, kid)
+	}
+	return &found[0], nil
+}
+
+func getJson(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/thumperq/golib/config"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	CfgAuthJwksFile   = "AUTH_JWKS_FILE"
+	CfgAuthOidcIssuer = "AUTH_OIDC_ISSUER"
+	CfgAuthIssuer     = "AUTH_ISSUER"
+	CfgAuthAudience   = "AUTH_AUDIENCE"
+	CfgAuthRolesClaim = "AUTH_ROLES_CLAIM"
+)
+
+// JWTOptions configures the validation of jwts, empty values are not validated.
+type JWTOptions struct {
+	Issuer string
+	// Audience accepts tokens issued for any of the audiences.
+	Audience []string
+	// Leeway is the allowed clock skew when validating exp, nbf and iat, 1 minute by default.
+	Leeway time.Duration
+	// AllowMissingExpiry accepts tokens without exp claim, which are valid forever. They are rejected by default.
+	AllowMissingExpiry bool
+	// RolesClaim is the claim holding the roles, nested claims are separated by dots, e.g. realm_access.roles.
+	// Defaults to roles.
+	RolesClaim string
+}
+
+type jwtAuthenticator struct {
+	keys KeySet
+	opts JWTOptions
+}
+
+// NewJWTAuthenticator authenticates requests with a bearer jwt signed by a key of the key set.
+// Scopes are read from the space separated scope claim or the scp claim.
+func NewJWTAuthenticator(keys KeySet, opts JWTOptions) Authenticator {
+	if opts.Leeway == 0 {
+		opts.Leeway = jwt.DefaultLeeway
+	}
+	if opts.RolesClaim == "" {
+		opts.RolesClaim = "roles"
+	}
+	return &jwtAuthenticator{keys: keys, opts: opts}
+}
+
+// NewOIDCAuthenticator authenticates requests with bearer jwts of the OpenID Connect issuer, its keys are discovered.
+func NewOIDCAuthenticator(ctx context.Context, issuer string, opts JWTOptions) (Authenticator, error) {
+	keys, err := NewOIDCKeySet(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Issuer == "" {
+		opts.Issuer = issuer
+	}
+	return NewJWTAuthenticator(keys, opts), nil
+}
+
+// NewJWTAuthenticatorFromConfig verifies tokens with the keys of AUTH_JWKS_FILE, or discovers the keys of
+// AUTH_OIDC_ISSUER. AUTH_ISSUER, AUTH_AUDIENCE as comma separated list and AUTH_ROLES_CLAIM are optional.
+func NewJWTAuthenticatorFromConfig(ctx context.Context, cfg config.CfgManager) (Authenticator, error) {
+	values := map[string]string{}
+	for _, key := range []string{CfgAuthJwksFile, CfgAuthOidcIssuer, CfgAuthIssuer, CfgAuthAudience, CfgAuthRolesClaim} {
+		value, err := config.GetOptionalValue(ctx, cfg, key)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	opts := JWTOptions{
+		Issuer:     values[CfgAuthIssuer],
+		RolesClaim: values[CfgAuthRolesClaim],
+	}
+	for _, audience := range strings.Split(values[CfgAuthAudience], ",") {
+		if audience = strings.TrimSpace(audience); audience != "" {
+			opts.Audience = append(opts.Audience, audience)
+		}
+	}
+	if values[CfgAuthJwksFile] != "" {
+		keys, err := NewFileKeySet(values[CfgAuthJwksFile])
+		if err != nil {
+			return nil, err
+		}
+		return NewJWTAuthenticator(keys, opts), nil
+	}
+	if values[CfgAuthOidcIssuer] != "" {
+		return NewOIDCAuthenticator(ctx, values[CfgAuthOidcIssuer], opts)
+	}
+	return nil, fmt.Errorf("%s or %s is required", CfgAuthJwksFile, CfgAuthOidcIssuer)
+}
+
+func (a *jwtAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	scheme, raw, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return nil, ErrNoCredentials
+	}
+	token, err := jwt.ParseSigned(strings.TrimSpace(raw))
+	if err != nil || len(token.Headers) != 1 {
+		return nil, fmt.Errorf("%w: malformed token", ErrUnauthenticated)
+	}
+	header := token.Headers[0]
+	key, err := a.keys.Key(r.Context(), header.KeyID)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: unknown signing key", ErrUnauthenticated)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.Algorithm != "" && key.Algorithm != header.Algorithm {
+		return nil, fmt.Errorf("%w: unexpected signing algorithm %s", ErrUnauthenticated, header.Algorithm)
+	}
+	var standard jwt.Claims
+	claims := map[string]any{}
+	err = token.Claims(key, &standard, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid signature", ErrUnauthenticated)
+	}
+	if standard.Expiry == nil && !a.opts.AllowMissingExpiry {
+		return nil, fmt.Errorf("%w: token has no expiry", ErrUnauthenticated)
+	}
+	err = standard.ValidateWithLeeway(jwt.Expected{Issuer: a.opts.Issuer, Time: time.Now()}, a.opts.Leeway)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnauthenticated, validationReason(err))
+	}
+	if len(a.opts.Audience) > 0 && !slices.ContainsFunc(a.opts.Audience, standard.Audience.Contains) {
+		return nil, fmt.Errorf("%w: %s", ErrUnauthenticated, validationReason(jwt.ErrInvalidAudience))
+	}
+	return &Identity{
+		Method:  MethodJWT,
+		Subject: standard.Subject,
+		Scopes:  append(stringsOf(claims["scope"]), stringsOf(claims["scp"])...),
+		Roles:   stringsOf(claimAt(claims, a.opts.RolesClaim)),
+		Claims:  claims,
+	}, nil
+}
+
+func validationReason(err error) string {
+	switch {
+	case errors.Is(err, jwt.ErrExpired):
+		return "token is expired"
+	case errors.Is(err, jwt.ErrNotValidYet), errors.Is(err, jwt.ErrIssuedInTheFuture):
+		return "token is not valid yet"
+	case errors.Is(err, jwt.ErrInvalidIssuer):
+		return "invalid issuer"
+	case errors.Is(err, jwt.ErrInvalidAudience):
+		return "invalid audience"
+	}
+	return "invalid token"
+}
+
+// claimAt returns the claim at the dot separated path.
+func claimAt(claims map[string]any, path string) any {
+	var value any = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
+
+// stringsOf returns the values of a claim which is either a space separated string or an array of strings.
+func stringsOf(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"net/http"
+)
+
+type mtlsAuthenticator struct{}
+
+// NewMTLSAuthenticator identifies callers by the verified client certificate, see Options.TLSClientCAFile of the
+// ApiServer. The subject is the common name of the certificate and its organizational units are the roles.
+func NewMTLSAuthenticator() Authenticator {
+	return &mtlsAuthenticator{}
+}
+
+func (a *mtlsAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	return &Identity{
+		Method:  MethodMTLS,
+		Subject: cert.Subject.CommonName,
+		Roles:   cert.Subject.OrganizationalUnit,
+		Claims: map[string]any{
+			"subject":      cert.Subject.String(),
+			"issuer":       cert.Issuer.String(),
+			"serialNumber": cert.SerialNumber.String(),
+			"dnsNames":     cert.DNSNames,
+			"emails":       cert.EmailAddresses,
+		},
+	}, nil
+}
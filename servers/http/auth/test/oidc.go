@@ -0,0 +1,107 @@
+package test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nuid"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// OIDCProvider is a local OpenID Connect provider serving discovery and JWKS documents and issuing RS256 tokens.
+type OIDCProvider struct {
+	Issuer       string
+	server       *httptest.Server
+	mu           sync.Mutex
+	key          jose.JSONWebKey
+	jwksRequests atomic.Int32
+}
+
+// NewOIDCProvider starts the provider on a random port, it is closed when the test finishes.
+func NewOIDCProvider(t testing.TB) *OIDCProvider {
+	t.Helper()
+	p := &OIDCProvider{}
+	p.RotateKey(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, map[string]any{
+			"issuer":                                p.Issuer,
+			"jwks_uri":                              p.Issuer + "/jwks",
+			"id_token_signing_alg_values_supported": []string{string(jose.RS256)},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.jwksRequests.Add(1)
+		writeJson(w, p.JWKS())
+	})
+	p.server = httptest.NewServer(mux)
+	p.Issuer = p.server.URL
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+// RotateKey replaces the signing key, tokens of the previous key no longer verify.
+func (p *OIDCProvider) RotateKey(t testing.TB) {
+	t.Helper()
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate signing key: %v", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.key = jose.JSONWebKey{Key: private, KeyID: nuid.Next(), Algorithm: string(jose.RS256), Use: "sig"}
+}
+
+// JWKS returns the public signing key, e.g. to write a JWKS file.
+func (p *OIDCProvider) JWKS() jose.JSONWebKeySet {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return jose.JSONWebKeySet{Keys: []jose.JSONWebKey{p.key.Public()}}
+}
+
+// JWKSRequests returns how often the JWKS document was fetched.
+func (p *OIDCProvider) JWKSRequests() int {
+	return int(p.jwksRequests.Load())
+}
+
+// Token signs the claims, iss, iat and an exp one hour from now are added unless set. Nil claims are left out.
+func (p *OIDCProvider) Token(t testing.TB, claims map[string]any) string {
+	t.Helper()
+	p.mu.Lock()
+	key := p.key
+	p.mu.Unlock()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	now := time.Now()
+	all := map[string]any{
+		"iss": p.Issuer,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	for name, value := range claims {
+		all[name] = value
+		if value == nil {
+			delete(all, name)
+		}
+	}
+	token, err := jwt.Signed(signer).Claims(all).CompactSerialize()
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return token
+}
+
+func writeJson(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,156 @@
+package httpserver
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+var textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+
+// BindError is returned when a request value cannot be bound, Source is one of body, path, query or header.
+type BindError struct {
+	Source string
+	Field  string
+	Err    error
+}
+
+func (e *BindError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("invalid request %s: %v", e.Source, e.Err)
+	}
+	return fmt.Sprintf("invalid %s parameter %s: %v", e.Source, e.Field, e.Err)
+}
+
+func (e *BindError) Unwrap() error {
+	return e.Err
+}
+
+// Bind decodes the json body into v, a pointer to a struct, and sets the fields tagged with path, query or header
+// from the path values, query parameters and headers of the request, e.g.
+//
+//	type getOrder struct {
+//		ID     string `path:"id"`
+//		Expand []string `query:"expand"`
+//		Tenant string `header:"X-Tenant"`
+//	}
+//
+// Fields can be strings, booleans, numbers, slices of them for repeated values, or implement encoding.TextUnmarshaler.
+func Bind(r *http.Request, v any) error {
+	if r.Body != nil && r.Body != http.NoBody {
+		err := json.NewDecoder(r.Body).Decode(v)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return &BindError{Source: "body", Err: err}
+		}
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	return bindFields(r, rv.Elem())
+}
+
+func bindFields(r *http.Request, rv reflect.Value) error {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			err := bindFields(r, rv.Field(i))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		source, name, values := fieldValues(r, field)
+		if len(values) == 0 {
+			continue
+		}
+		err := setField(rv.Field(i), values)
+		if err != nil {
+			return &BindError{Source: source, Field: name, Err: err}
+		}
+	}
+	return nil
+}
+
+func fieldValues(r *http.Request, field reflect.StructField) (string, string, []string) {
+	if name, ok := field.Tag.Lookup("path"); ok {
+		if value := r.PathValue(name); value != "" {
+			return "path", name, []string{value}
+		}
+		return "path", name, nil
+	}
+	if name, ok := field.Tag.Lookup("query"); ok {
+		return "query", name, r.URL.Query()[name]
+	}
+	if name, ok := field.Tag.Lookup("header"); ok {
+		return "header", name, r.Header.Values(name)
+	}
+	return "", "", nil
+}
+
+func setField(field reflect.Value, values []string) error {
+	if field.Kind() == reflect.Slice && !field.Addr().Type().Implements(textUnmarshalerType) {
+		slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i, value := range values {
+			err := setValue(slice.Index(i), value)
+			if err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+		return nil
+	}
+	return setValue(field, values[0])
+}
+
+func setValue(field reflect.Value, value string) error {
+	if field.Kind() == reflect.Pointer {
+		if field.IsNil() {
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+		return setValue(field.Elem(), value)
+	}
+	if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package httpserver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rs/cors"
+	"github.com/thumperq/golib/config"
+)
+
+const (
+	CfgHttpCorsAllowedOrigins   = "HTTP_CORS_ALLOWED_ORIGINS"
+	CfgHttpCorsAllowedMethods   = "HTTP_CORS_ALLOWED_METHODS"
+	CfgHttpCorsAllowedHeaders   = "HTTP_CORS_ALLOWED_HEADERS"
+	CfgHttpCorsExposedHeaders   = "HTTP_CORS_EXPOSED_HEADERS"
+	CfgHttpCorsAllowCredentials = "HTTP_CORS_ALLOW_CREDENTIALS"
+	CfgHttpCorsMaxAge           = "HTTP_CORS_MAX_AGE"
+)
+
+type CORSOptions struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	// MaxAge is how many seconds browsers may cache preflight responses.
+	MaxAge int
+}
+
+// CORS answers preflight requests and sets the CORS headers of the allowed origins.
+func CORS(opts CORSOptions) Middleware {
+	c := cors.New(cors.Options{
+		AllowedOrigins:   opts.AllowedOrigins,
+		AllowedMethods:   opts.AllowedMethods,
+		AllowedHeaders:   opts.AllowedHeaders,
+		ExposedHeaders:   opts.ExposedHeaders,
+		AllowCredentials: opts.AllowCredentials,
+		MaxAge:           opts.MaxAge,
+	})
+	return c.Handler
+}
+
+// CORSOptionsFromConfig reads the HTTP_CORS_* config keys, lists are comma separated. It returns nil when
+// HTTP_CORS_ALLOWED_ORIGINS is not set, methods and headers default to the common ones.
+func CORSOptionsFromConfig(ctx context.Context, cfg config.CfgManager) (*CORSOptions, error) {
+	values := map[string]string{}
+	for _, key := range []string{
+		CfgHttpCorsAllowedOrigins, CfgHttpCorsAllowedMethods, CfgHttpCorsAllowedHeaders, CfgHttpCorsExposedHeaders,
+		CfgHttpCorsAllowCredentials, CfgHttpCorsMaxAge,
+	} {
+		value, err := config.GetOptionalValue(ctx, cfg, key)
+		if err != nil {
+			return nil, err
+		}
+		if value != "" {
+			values[key] = value
+		}
+	}
+	if values[CfgHttpCorsAllowedOrigins] == "" {
+		return nil, nil
+	}
+	opts := &CORSOptions{
+		AllowedOrigins: splitList(values[CfgHttpCorsAllowedOrigins]),
+		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
+		AllowedHeaders: []string{"Authorization", "Content-Type"},
+		ExposedHeaders: splitList(values[CfgHttpCorsExposedHeaders]),
+	}
+	if value := values[CfgHttpCorsAllowedMethods]; value != "" {
+		opts.AllowedMethods = splitList(value)
+	}
+	if value := values[CfgHttpCorsAllowedHeaders]; value != "" {
+		opts.AllowedHeaders = splitList(value)
+	}
+	err := config.ParseBools(values, map[string]*bool{CfgHttpCorsAllowCredentials: &opts.AllowCredentials})
+	if err != nil {
+		return nil, err
+	}
+	if value := values[CfgHttpCorsMaxAge]; value != "" {
+		maxAge, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", CfgHttpCorsMaxAge, err)
+		}
+		opts.MaxAge = maxAge
+	}
+	return opts, nil
+}
+
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,128 @@
+package fanout
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nuid"
+	"github.com/thumperq/golib/logging"
+	"github.com/thumperq/golib/messaging"
+	httpserver "github.com/thumperq/golib/servers/http"
+	"github.com/thumperq/golib/servers/http/auth"
+)
+
+// Authorize decides whether the client of the request receives the message, the identity of authenticated requests
+// is in the request context.
+type Authorize func(r *http.Request, msg messaging.Message) bool
+
+// Bridge fans the messages of broker subjects out to the connected HTTP clients, as server-sent events or WebSocket
+// messages. Every replica needs the messages of all subjects for its own clients, so subscribe with
+// messaging.NewBroadcastSubscriber.
+type Bridge struct {
+	opts      httpserver.StreamOptions
+	authorize Authorize
+	mu        sync.RWMutex
+	clients   map[*client]struct{}
+}
+
+type client struct {
+	r      *http.Request
+	stream httpserver.Stream
+}
+
+// NewBridge returns a bridge sending every message to every client, restrict them with WithAuthorization.
+func NewBridge(opts httpserver.StreamOptions) *Bridge {
+	return &Bridge{
+		opts:      opts,
+		authorize: func(*http.Request, messaging.Message) bool { return true },
+		clients:   map[*client]struct{}{},
+	}
+}
+
+// WithAuthorization sends the messages only to the clients the function authorizes.
+func (b *Bridge) WithAuthorization(authorize Authorize) *Bridge {
+	b.authorize = authorize
+	return b
+}
+
+// RequireScopes authorizes the clients whose identity has all scopes.
+func RequireScopes(scopes ...string) Authorize {
+	return func(r *http.Request, msg messaging.Message) bool {
+		id, ok := auth.IdentityFromContext(r.Context())
+		if !ok {
+			return false
+		}
+		for _, scope := range scopes {
+			if !id.HasScope(scope) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Subscribe fans the messages of the topic out to the clients until the context is done.
+func (b *Bridge) Subscribe(ctx context.Context, subscriber messaging.MessageSubscriber, domain string, service string, topic string) error {
+	return subscriber.Subscribe(ctx, domain, service, topic, func(ctx context.Context, msg messaging.Message) error {
+		b.Broadcast(msg)
+		return nil
+	})
+}
+
+// Broadcast sends the message to the authorized clients with a unique event ID. It does not block, clients which fell
+// behind are disconnected. Reconnecting clients miss the messages broadcast in between.
+func (b *Bridge) Broadcast(msg messaging.Message) {
+	event := httpserver.Event{ID: nuid.Next(), Name: msg.Name, Data: msg.Data}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for c := range b.clients {
+		if !b.authorize(c.r, msg) {
+			continue
+		}
+		_ = c.stream.Send(event)
+	}
+}
+
+// Clients returns the number of connected clients.
+func (b *Bridge) Clients() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.clients)
+}
+
+// Handler streams the messages to the client, over a WebSocket for upgrade requests and as server-sent events
+// otherwise. Authenticate the route so the authorization sees the identity.
+func (b *Bridge) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := logging.TraceLogger(r.Context())
+		var stream httpserver.Stream
+		var err error
+		if websocket.IsWebSocketUpgrade(r) {
+			stream, err = httpserver.UpgradeWebSocket(w, r, b.opts)
+		} else {
+			stream, err = httpserver.NewSSE(w, r, b.opts)
+		}
+		if err != nil {
+			logger.Warn().Err(err).Msg("stream not opened")
+			return
+		}
+		c := &client{r: r, stream: stream}
+		b.mu.Lock()
+		b.clients[c] = struct{}{}
+		b.mu.Unlock()
+		defer func() {
+			b.mu.Lock()
+			delete(b.clients, c)
+			b.mu.Unlock()
+		}()
+		err = stream.Serve()
+		if errors.Is(err, httpserver.ErrSlowClient) {
+			logger.Warn().Str("remoteAddr", r.RemoteAddr).Msg("slow stream client disconnected")
+		} else if err != nil {
+			logger.Debug().Err(err).Msg("stream ended")
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package fanout_test
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thumperq/golib/messaging"
+	httpserver "github.com/thumperq/golib/servers/http"
+	"github.com/thumperq/golib/servers/http/auth"
+	"github.com/thumperq/golib/servers/http/fanout"
+)
+
+type orderCreated struct {
+	EventName string `json:"eventName"`
+	OrderId   string `json:"orderId"`
+}
+
+func (e *orderCreated) Name() string {
+	return e.EventName
+}
+
+func TestBridgeSendsMessagesToAuthorizedClients(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker, err := messaging.NewBrokerWithTransport(messaging.NewChannelTransport(), "wms", "ordering")
+	require.NoError(t, err)
+	bridge := fanout.NewBridge(httpserver.StreamOptions{}).WithAuthorization(fanout.RequireScopes("orders:read"))
+	err = bridge.Subscribe(ctx, messaging.NewBroadcastSubscriber(broker), "wms", "ordering", "order")
+	require.NoError(t, err)
+
+	opts := httpserver.DefaultOptions()
+	opts.RoutePrefix = "/wms/ordering"
+	srv, err := httpserver.NewApiServer(opts)
+	require.NoError(t, err)
+	keys := auth.APIKeys{
+		"reader": {Subject: "reader", Scopes: []string{"orders:read"}},
+		"other":  {Subject: "other"},
+	}
+	srv.Group("/events", auth.Authenticate(auth.NewAPIKeyAuthenticator("", keys))).Handle("GET /orders", bridge.Handler())
+	server := httptest.NewServer(srv.Handler())
+	// closed after the clients disconnected, it waits for the streams
+	t.Cleanup(server.Close)
+
+	connect := func(key string) *bufio.Reader {
+		r, err := http.NewRequest(http.MethodGet, server.URL+"/wms/ordering/events/orders", nil)
+		require.NoError(t, err)
+		r.Header.Set(auth.HeaderAPIKey, key)
+		resp, err := http.DefaultClient.Do(r)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return bufio.NewReader(resp.Body)
+	}
+	reader := connect("reader")
+	other := connect("other")
+	require.Eventually(t, func() bool { return bridge.Clients() == 2 }, time.Second, 10*time.Millisecond)
+
+	err = broker.Publish("order", &orderCreated{EventName: "orderCreated", OrderId: "123"})
+	require.NoError(t, err)
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- strings.TrimSuffix(line, "\n")
+		}
+	}()
+	require.True(t, strings.HasPrefix(<-lines, "id: "))
+	require.Equal(t, "event: orderCreated", <-lines)
+	require.Equal(t, `data: {"eventName":"orderCreated","orderId":"123"}`, <-lines)
+
+	// the client without the scope gets nothing, its read only ends when the server closes the connection
+	received := make(chan string, 1)
+	go func() {
+		line, _ := other.ReadString('\n')
+		received <- line
+	}()
+	select {
+	case line := <-received:
+		require.Fail(t, "unauthorized client received a message", line)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,136 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/thumperq/golib/logging"
+)
+
+var validate = validator.New(validator.WithRequiredStructEnabled())
+
+// NoContent is the response of handlers answering 204 No Content.
+type NoContent struct{}
+
+type errorStatus struct {
+	match  func(error) bool
+	status int
+}
+
+var (
+	errorsMu      sync.RWMutex
+	errorStatuses = []errorStatus{
+		{match: func(err error) bool { var e *BindError; return errors.As(err, &e) }, status: http.StatusBadRequest},
+		{match: func(err error) bool { var e validator.ValidationErrors; return errors.As(err, &e) }, status: http.StatusBadRequest},
+		{match: func(err error) bool { var e *http.MaxBytesError; return errors.As(err, &e) }, status: http.StatusRequestEntityTooLarge},
+		{match: func(err error) bool { return errors.Is(err, context.DeadlineExceeded) }, status: http.StatusServiceUnavailable},
+	}
+)
+
+// RegisterError maps handler errors matching target with errors.Is onto the status code.
+func RegisterError(target error, status int) {
+	registerErrorStatus(func(err error) bool {
+		return errors.Is(err, target)
+	}, status)
+}
+
+// RegisterErrorType maps handler errors of type T, found with errors.As, onto the status code.
+func RegisterErrorType[T error](status int) {
+	registerErrorStatus(func(err error) bool {
+		var target T
+		return errors.As(err, &target)
+	}, status)
+}
+
+func registerErrorStatus(match func(error) bool, status int) {
+	errorsMu.Lock()
+	defer errorsMu.Unlock()
+	errorStatuses = append(errorStatuses, errorStatus{match: match, status: status})
+}
+
+// StatusOf returns the status of a *Problem or the status code registered for the error, the latest registration wins.
+// Unregistered errors are 500.
+func StatusOf(err error) int {
+	var problem *Problem
+	if errors.As(err, &problem) {
+		return problem.withDefaults().Status
+	}
+	errorsMu.RLock()
+	defer errorsMu.RUnlock()
+	for i := len(errorStatuses) - 1; i >= 0; i-- {
+		if errorStatuses[i].match(err) {
+			return errorStatuses[i].status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// Handle adapts a typed handler, the request is bound with Bind and validated before the handler is called.
+// The response is written as json with status 200, or 204 for NoContent. Errors are written with the status of StatusOf.
+func Handle[Req any, Resp any](handler func(ctx context.Context, req Req) (Resp, error)) http.HandlerFunc {
+	return HandleStatus(http.StatusOK, handler)
+}
+
+// HandleStatus is Handle answering successful requests with the status code, e.g. 201 Created.
+func HandleStatus[Req any, Resp any](status int, handler func(ctx context.Context, req Req) (Resp, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req Req
+		err := Bind(r, &req)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		err = validateRequest(req)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		resp, err := handler(r.Context(), req)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if _, ok := any(resp).(NoContent); ok {
+			Status(http.StatusNoContent, w)
+			return
+		}
+		err = Json(status, w, resp)
+		if err != nil {
+			logging.TraceLogger(r.Context()).
+				Err(err).
+				Msgf("failed to write response of %s %s", r.Method, r.URL.Path)
+		}
+	}
+}
+
+func validateRequest(req any) error {
+	err := validate.Struct(req)
+	var invalid *validator.InvalidValidationError
+	if errors.As(err, &invalid) {
+		// requests which are not structs, e.g. NoContent or maps, have nothing to validate
+		return nil
+	}
+	return err
+}
+
+// WriteError writes the problem of the error, internal server errors are logged.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	problem := *ProblemOf(err)
+	if problem.Status >= http.StatusInternalServerError {
+		logging.TraceLogger(r.Context()).
+			Err(err).
+			Msgf("%s %s failed", r.Method, r.URL.Path)
+	}
+	if problem.Instance == "" {
+		problem.Instance = r.URL.Path
+	}
+	err = WriteProblem(w, &problem)
+	if err != nil {
+		logging.TraceLogger(r.Context()).
+			Err(err).
+			Msgf("failed to write problem of %s %s", r.Method, r.URL.Path)
+	}
+}
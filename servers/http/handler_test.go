@@ -0,0 +1,154 @@
+package httpserver_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	httpserver "github.com/thumperq/golib/servers/http"
+)
+
+var errOrderNotFound = errors.New("order not found")
+
+type orderConflict struct {
+	OrderId string
+}
+
+func (e orderConflict) Error() string {
+	return "order " + e.OrderId + " already exists"
+}
+
+type updateOrder struct {
+	OrderId  string   `path:"id" validate:"required"`
+	Tenant   string   `header:"X-Tenant" validate:"required"`
+	Expand   []string `query:"expand"`
+	Quantity int      `json:"quantity" validate:"gte=1"`
+	DryRun   *bool    `query:"dryRun"`
+}
+
+type order struct {
+	OrderId  string   `json:"orderId"`
+	Tenant   string   `json:"tenant"`
+	Expand   []string `json:"expand"`
+	Quantity int      `json:"quantity"`
+	DryRun   bool     `json:"dryRun"`
+}
+
+func TestHandleBindsValidatesAndMapsErrors(t *testing.T) {
+	httpserver.RegisterError(errOrderNotFound, http.StatusNotFound)
+	httpserver.RegisterErrorType[orderConflict](http.StatusConflict)
+	mux := http.NewServeMux()
+	mux.Handle("PUT /orders/{id}", httpserver.Handle(func(ctx context.Context, req updateOrder) (order, error) {
+		switch req.OrderId {
+		case "missing":
+			return order{}, errOrderNotFound
+		case "duplicate":
+			return order{}, orderConflict{OrderId: req.OrderId}
+		case "broken":
+			return order{}, errors.New("database is down")
+		}
+		return order{OrderId: req.OrderId, Tenant: req.Tenant, Expand: req.Expand, Quantity: req.Quantity, DryRun: *req.DryRun}, nil
+	}))
+
+	do := func(id string, query string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/orders/"+id+query, strings.NewReader(body))
+		r.Header.Set("X-Tenant", "acme")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("123", "?expand=lines&expand=customer&dryRun=true", `{"quantity": 2}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp order
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Equal(t, order{OrderId: "123", Tenant: "acme", Expand: []string{"lines", "customer"}, Quantity: 2, DryRun: true}, resp)
+
+	require.Equal(t, http.StatusBadRequest, do("123", "?dryRun=maybe", `{"quantity": 2}`).Code)
+	require.Equal(t, http.StatusBadRequest, do("123", "?dryRun=true", `{"quantity": 0}`).Code)
+	require.Equal(t, http.StatusBadRequest, do("123", "?dryRun=true", `{"quantity":`).Code)
+	require.Equal(t, http.StatusNotFound, do("missing", "?dryRun=true", `{"quantity": 1}`).Code)
+	require.Equal(t, http.StatusConflict, do("duplicate", "?dryRun=true", `{"quantity": 1}`).Code)
+	w = do("broken", "?dryRun=true", `{"quantity": 1}`)
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.NotContains(t, w.Body.String(), "database")
+}
+
+func TestHandleStatusNoContent(t *testing.T) {
+	handler := httpserver.HandleStatus(http.StatusCreated, func(ctx context.Context, req struct{}) (httpserver.NoContent, error) {
+		return httpserver.NoContent{}, nil
+	})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodDelete, "/orders/1", nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+}
+
+type orderLine struct {
+	Sku      string `json:"sku" validate:"required"`
+	Quantity int    `json:"quantity" validate:"gte=1"`
+}
+
+type createOrder struct {
+	CustomerEmail string      `json:"customerEmail" validate:"required,email"`
+	Lines         []orderLine `json:"lines" validate:"min=1,dive"`
+}
+
+func TestProblemResponses(t *testing.T) {
+	handler := httpserver.HandleStatus(http.StatusCreated, func(ctx context.Context, req createOrder) (order, error) {
+		if req.CustomerEmail == "unknown@example.com" {
+			return order{}, &httpserver.Problem{}
+		}
+		if req.CustomerEmail == "blocked@example.com" {
+			return order{}, &httpserver.Problem{
+				Type:   "https://example.com/problems/customer-blocked",
+				Title:  "Customer blocked",
+				Status: http.StatusForbidden,
+			}
+		}
+		return order{OrderId: "1"}, nil
+	})
+	do := func(body string) (*httptest.ResponseRecorder, httpserver.Problem) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body)))
+		var problem httpserver.Problem
+		if w.Code >= http.StatusBadRequest {
+			require.Equal(t, httpserver.ProblemContentType, w.Header().Get("Content-Type"))
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+			require.Equal(t, w.Code, problem.Status)
+		}
+		return w, problem
+	}
+
+	_, problem := do(`{"customerEmail": "nope", "lines": [{"sku": "", "quantity": 0}]}`)
+	require.Equal(t, "/orders", problem.Instance)
+	require.Equal(t, []httpserver.FieldError{
+		{Field: "customerEmail", Message: "must be a valid email address"},
+		{Field: "lines[0].sku", Message: "is required"},
+		{Field: "lines[0].quantity", Message: "must be at least 1"},
+	}, problem.Errors)
+
+	_, problem = do(`{"customerEmail": "a@example.com", "lines": []}`)
+	require.Equal(t, []httpserver.FieldError{{Field: "lines", Message: "must be at least 1 items"}}, problem.Errors)
+
+	_, problem = do(`{"customerEmail": "a@example.com", "lines": [{"sku": "a", "quantity": "one"}]}`)
+	require.Equal(t, http.StatusBadRequest, problem.Status)
+	require.Equal(t, []httpserver.FieldError{{Field: "lines[0].quantity", Message: "must be of type number"}}, problem.Errors)
+
+	w, problem := do(`{"customerEmail": "blocked@example.com", "lines": [{"sku": "a", "quantity": 1}]}`)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Equal(t, "https://example.com/problems/customer-blocked", problem.Type)
+
+	// problems without status are internal server errors
+	w, problem = do(`{"customerEmail": "unknown@example.com", "lines": [{"sku": "a", "quantity": 1}]}`)
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.Equal(t, "Internal Server Error", problem.Title)
+	require.Equal(t, http.StatusInternalServerError, httpserver.StatusOf(&httpserver.Problem{}))
+
+	w, _ = do(`{"customerEmail": "a@example.com", "lines": [{"sku": "a", "quantity": 1}]}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+}
@@ -0,0 +1,26 @@
+package httpserver
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/thumperq/golib/health"
+)
+
+// Health returns the registry of the checks reported by the liveness and readiness routes.
+func (srv *ApiServer) Health() *health.Registry {
+	return srv.health
+}
+
+// healthHandler answers 200 with the report while the service is up or degraded and 503 when it is down.
+func healthHandler(report func(ctx context.Context) health.Report) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result := report(r.Context())
+		status := http.StatusOK
+		if !result.Up() {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		_ = Json(status, w, result)
+	}
+}
@@ -0,0 +1,49 @@
+package httpserver_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thumperq/golib/health"
+	httpserver "github.com/thumperq/golib/servers/http"
+)
+
+func TestHealthRoutes(t *testing.T) {
+	opts := httpserver.DefaultOptions()
+	opts.RoutePrefix = "/wms/ordering"
+	srv, err := httpserver.NewApiServer(opts)
+	require.NoError(t, err)
+	var dbErr error
+	srv.Health().Register(health.Check{Name: "postgres", Check: func(ctx context.Context) error { return dbErr }})
+	probe := func(path string) (int, health.Report) {
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var report health.Report
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		return w.Code, report
+	}
+
+	status, report := probe("/wms/ordering/health/ready")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, health.StatusUp, report.Checks["postgres"].Status)
+
+	dbErr = errors.New("connection refused")
+	status, report = probe("/wms/ordering/health/ready")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, "connection refused", report.Checks["postgres"].Error)
+	status, _ = probe("/wms/ordering/health-check")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	status, _ = probe("/wms/ordering/health/live")
+	require.Equal(t, http.StatusOK, status)
+
+	dbErr = nil
+	srv.Health().ShutDown()
+	status, report = probe("/wms/ordering/health/ready")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, health.StatusDown, report.Status)
+}
@@ -0,0 +1,268 @@
+package httpserver
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nuid"
+	"github.com/rs/zerolog"
+	"github.com/thumperq/golib/logging"
+)
+
+const HeaderRequestID = "X-Request-Id"
+
+// Middleware wraps a handler, e.g. to authenticate requests or to log them.
+type Middleware func(next http.Handler) http.Handler
+
+type requestIDKey struct{}
+
+// Chain composes the middlewares into one, the first middleware is the outermost.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next http.Handler) http.Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// RouteGroup registers routes below a common path which share middlewares.
+type RouteGroup struct {
+	srv        *ApiServer
+	prefix     string
+	middleware []Middleware
+}
+
+// Group returns a route group below the path, e.g. /admin, wrapping its routes with the middlewares.
+func (srv *ApiServer) Group(path string, middlewares ...Middleware) *RouteGroup {
+	return &RouteGroup{
+		srv:        srv,
+		prefix:     strings.TrimSuffix(path, "/"),
+		middleware: middlewares,
+	}
+}
+
+// Group returns a nested route group, its routes are wrapped by the middlewares of both groups.
+func (g *RouteGroup) Group(path string, middlewares ...Middleware) *RouteGroup {
+	return &RouteGroup{
+		srv:        g.srv,
+		prefix:     g.prefix + strings.TrimSuffix(path, "/"),
+		middleware: append(append([]Middleware{}, g.middleware...), middlewares...),
+	}
+}
+
+// Use adds middlewares to the routes registered afterwards.
+func (g *RouteGroup) Use(middlewares ...Middleware) *RouteGroup {
+	g.middleware = append(g.middleware, middlewares...)
+	return g
+}
+
+func (g *RouteGroup) Handle(pattern string, handler http.Handler) {
+	g.srv.Handle(g.pattern(pattern), Chain(g.middleware...)(handler))
+}
+
+func (g *RouteGroup) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	g.Handle(pattern, http.HandlerFunc(handler))
+}
+
+// pattern prepends the path of the group to the path of the pattern.
+func (g *RouteGroup) pattern(pattern string) string {
+	method, path, found := strings.Cut(pattern, " ")
+	if found {
+		return method + " " + g.prefix + path
+	}
+	return g.prefix + pattern
+}
+
+// Recover writes a 500 problem when a handler panics, http.ErrAbortHandler is passed on to abort the response.
+func Recover() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				recovered := recover()
+				if recovered == nil {
+					return
+				}
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+				WriteError(w, r, fmt.Errorf("panic: %v", recovered))
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequestID passes on the X-Request-Id header of the request or generates one, it is set on the response and in the context.
+func RequestID() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(HeaderRequestID)
+			if id == "" {
+				id = nuid.Next()
+			}
+			w.Header().Set(HeaderRequestID, id)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+		})
+	}
+}
+
+// RequestIDFromContext returns the request id set by the RequestID middleware.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// AccessLog logs method, path, status, response size and duration of every request.
+func AccessLog() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+			level := zerolog.InfoLevel
+			if recorder.status >= http.StatusInternalServerError {
+				level = zerolog.ErrorLevel
+			}
+			logging.TraceLogger(r.Context()).
+				WithLevel(level).
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Str("route", r.Pattern).
+				Int("status", recorder.status).
+				Int64("bytes", recorder.bytes).
+				Dur("duration", time.Since(start)).
+				Str("remoteAddr", r.RemoteAddr).
+				Str("requestId", RequestIDFromContext(r.Context())).
+				Msg("http request")
+		})
+	}
+}
+
+// Gzip compresses responses for clients accepting gzip.
+func Gzip() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") || r.Header.Get("Upgrade") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			gw := &gzipWriter{ResponseWriter: w}
+			defer gw.close()
+			next.ServeHTTP(gw, r)
+		})
+	}
+}
+
+// Timeout cancels the request context after the duration, handlers returning the context error answer 503.
+// Handlers have to respect the context, unlike http.TimeoutHandler the response is not buffered so streaming keeps working.
+func Timeout(d time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// BodyLimit limits the size of request bodies, larger bodies fail with 413.
+func BodyLimit(bytes int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.MaxBytesHandler(next, bytes)
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	_ = http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+type gzipWriter struct {
+	http.ResponseWriter
+	writer      *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if status != http.StatusNoContent && status != http.StatusNotModified && w.Header().Get("Content-Encoding") == "" {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		w.writer = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.writer == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.writer.Write(b)
+}
+
+func (w *gzipWriter) Flush() {
+	if w.writer != nil {
+		_ = w.writer.Flush()
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *gzipWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipWriter) close() {
+	if w.writer != nil {
+		_ = w.writer.Close()
+	}
+}
@@ -0,0 +1,85 @@
+package httpserver_test
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	httpserver "github.com/thumperq/golib/servers/http"
+)
+
+func header(name string, value string) httpserver.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add(name, value)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestServerMiddlewarePipeline(t *testing.T) {
+	opts := httpserver.DefaultOptions()
+	opts.RoutePrefix = "/wms/ordering"
+	opts.MaxBodyBytes = 16
+	opts.CORS = &httpserver.CORSOptions{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"GET", "POST"},
+		AllowedHeaders: []string{"Authorization", "Content-Type"},
+	}
+	srv, err := httpserver.NewApiServer(opts)
+	require.NoError(t, err)
+	srv.Use(httpserver.RequestID(), httpserver.AccessLog(), httpserver.Gzip())
+	admin := srv.Group("/admin", header("X-Layer", "admin"))
+	admin.Group("/reports", header("X-Layer", "reports")).HandleFunc("GET /daily", func(w http.ResponseWriter, r *http.Request) {
+		_ = httpserver.Json(http.StatusOK, w, httpserver.H{"requestId": httpserver.RequestIDFromContext(r.Context())})
+	})
+	srv.HandleFunc("GET /panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	srv.Handle("POST /orders", httpserver.Handle(func(ctx context.Context, req order) (order, error) {
+		return req, nil
+	}))
+	handler := srv.Handler()
+	do := func(r *http.Request) *http.Response {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/wms/ordering/admin/reports/daily", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set(httpserver.HeaderRequestID, "req-1")
+	resp := do(r)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, []string{"admin", "reports"}, resp.Header.Values("X-Layer"))
+	require.Equal(t, "req-1", resp.Header.Get(httpserver.HeaderRequestID))
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	body, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	data, err := io.ReadAll(body)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"requestId": "req-1"}`, string(data))
+
+	r = httptest.NewRequest(http.MethodOptions, "/wms/ordering/orders", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	resp = do(r)
+	require.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	r = httptest.NewRequest(http.MethodOptions, "/wms/ordering/orders", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	require.Empty(t, do(r).Header.Get("Access-Control-Allow-Origin"))
+
+	resp = do(httptest.NewRequest(http.MethodGet, "/wms/ordering/panic", nil))
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	require.Equal(t, httpserver.ProblemContentType, resp.Header.Get("Content-Type"))
+
+	resp = do(httptest.NewRequest(http.MethodPost, "/wms/ordering/orders", strings.NewReader(`{"orderId": "a-very-long-order-id"}`)))
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	require.Equal(t, http.StatusOK, do(httptest.NewRequest(http.MethodGet, "/wms/ordering/health-check", nil)).StatusCode)
+}
@@ -0,0 +1,303 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const openAPIVersion = "3.0.3"
+
+var noContentType = reflect.TypeFor[NoContent]()
+
+// Router registers routes, it is implemented by ApiServer and RouteGroup.
+type Router interface {
+	Handle(pattern string, handler http.Handler)
+	handleOperation(pattern string, handler http.Handler, op *Operation)
+}
+
+// Operation documents a route registered with Route in the generated OpenAPI spec.
+type Operation struct {
+	method      string
+	path        string
+	status      int
+	summary     string
+	description string
+	tags        []string
+	request     reflect.Type
+	response    reflect.Type
+}
+
+// Route registers a typed handler like Handle and documents it in the generated OpenAPI spec. The parameters are
+// taken from the path, query and header tags of the request, its other fields are the json body. Constraints of
+// validate tags like required, min, max or oneof become part of the schemas.
+func Route[Req any, Resp any](router Router, pattern string, handler func(ctx context.Context, req Req) (Resp, error)) *Operation {
+	op := &Operation{
+		status:   http.StatusOK,
+		request:  reflect.TypeFor[Req](),
+		response: reflect.TypeFor[Resp](),
+	}
+	router.handleOperation(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleStatus(op.status, handler)(w, r)
+	}), op)
+	return op
+}
+
+// WithStatus sets the status code of successful responses, 200 by default.
+func (op *Operation) WithStatus(status int) *Operation {
+	op.status = status
+	return op
+}
+
+func (op *Operation) WithSummary(summary string) *Operation {
+	op.summary = summary
+	return op
+}
+
+func (op *Operation) WithDescription(description string) *Operation {
+	op.description = description
+	return op
+}
+
+func (op *Operation) WithTags(tags ...string) *Operation {
+	op.tags = append(op.tags, tags...)
+	return op
+}
+
+// WithAPIInfo sets the title and version of the generated OpenAPI spec, by default the SERVICE, or api, and 1.0.0.
+func (srv *ApiServer) WithAPIInfo(title string, version string) *ApiServer {
+	srv.apiTitle = title
+	srv.apiVersion = version
+	return srv
+}
+
+func (srv *ApiServer) handleOperation(pattern string, handler http.Handler, op *Operation) {
+	pattern = srv.route(pattern)
+	srv.Engine.Handle(pattern, handler)
+	method, path, found := strings.Cut(pattern, " ")
+	if !found {
+		// routes matching every method are not documented
+		return
+	}
+	op.method = strings.ToLower(method)
+	op.path = path
+	srv.operations = append(srv.operations, op)
+}
+
+func (g *RouteGroup) handleOperation(pattern string, handler http.Handler, op *Operation) {
+	g.srv.handleOperation(g.pattern(pattern), Chain(g.middleware...)(handler), op)
+}
+
+// OpenAPI returns the spec of Options.OpenAPISpec, or the spec generated from the routes registered with Route.
+func (srv *ApiServer) OpenAPI() ([]byte, error) {
+	if srv.options.OpenAPISpec != nil {
+		return srv.options.OpenAPISpec, nil
+	}
+	data, err := json.Marshal(srv.openAPIDocument())
+	if err != nil {
+		return nil, err
+	}
+	// converting through a yaml node keeps the order of the json fields
+	var node yaml.Node
+	err = yaml.Unmarshal(data, &node)
+	if err != nil {
+		return nil, err
+	}
+	var spec bytes.Buffer
+	encoder := yaml.NewEncoder(&spec)
+	encoder.SetIndent(2)
+	err = encoder.Encode(&node)
+	if err != nil {
+		return nil, err
+	}
+	return spec.Bytes(), nil
+}
+
+func (srv *ApiServer) serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	spec, err := srv.OpenAPI()
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	Status(http.StatusOK, w)
+	_, _ = w.Write(spec)
+}
+
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components,omitempty"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIComponents struct {
+	Schemas map[string]*schema `json:"schemas,omitempty"`
+}
+
+type openAPIOperation struct {
+	Summary     string                      `json:"summary,omitempty"`
+	Description string                      `json:"description,omitempty"`
+	Tags        []string                    `json:"tags,omitempty"`
+	Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *openAPIBody                `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required,omitempty"`
+	Schema   *schema `json:"schema"`
+}
+
+type openAPIBody struct {
+	Required bool                    `json:"required,omitempty"`
+	Content  map[string]openAPIMedia `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                  `json:"description"`
+	Content     map[string]openAPIMedia `json:"content,omitempty"`
+}
+
+type openAPIMedia struct {
+	Schema *schema `json:"schema"`
+}
+
+func (srv *ApiServer) openAPIDocument() openAPIDocument {
+	title := srv.apiTitle
+	if title == "" {
+		title = os.Getenv("SERVICE")
+	}
+	if title == "" {
+		// the title is required
+		title = "api"
+	}
+	version := srv.apiVersion
+	if version == "" {
+		version = "1.0.0"
+	}
+	generator := newSchemaGenerator()
+	doc := openAPIDocument{
+		OpenAPI: openAPIVersion,
+		Info:    openAPIInfo{Title: title, Version: version},
+		Paths:   map[string]map[string]*openAPIOperation{},
+	}
+	for _, op := range srv.operations {
+		path := openAPIPath(op.path)
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]*openAPIOperation{}
+		}
+		doc.Paths[path][op.method] = op.document(generator)
+	}
+	doc.Components.Schemas = generator.components
+	return doc
+}
+
+// openAPIPath removes the ServeMux specific parts of a path, {path...} wildcards and the {$} end anchor.
+func openAPIPath(path string) string {
+	path = strings.TrimSuffix(path, "{$}")
+	return strings.ReplaceAll(path, "...}", "}")
+}
+
+func (op *Operation) document(generator *schemaGenerator) *openAPIOperation {
+	doc := &openAPIOperation{
+		Summary:     op.summary,
+		Description: op.description,
+		Tags:        op.tags,
+		Responses: map[string]*openAPIResponse{
+			"default": {
+				Description: "problem details",
+				Content:     map[string]openAPIMedia{ProblemContentType: {Schema: generator.schemaOf(reflect.TypeFor[Problem]())}},
+			},
+		},
+	}
+	request := op.request
+	for request.Kind() == reflect.Pointer {
+		request = request.Elem()
+	}
+	if request.Kind() == reflect.Struct {
+		doc.Parameters = parameters(generator, request)
+		if hasBody(op.method) && len(bodyFields(request)) > 0 {
+			doc.RequestBody = &openAPIBody{
+				Required: requiresBody(request),
+				Content:  map[string]openAPIMedia{"application/json": {Schema: generator.schemaOf(request)}},
+			}
+		}
+	}
+	if op.response == noContentType {
+		doc.Responses["204"] = &openAPIResponse{Description: http.StatusText(http.StatusNoContent)}
+		return doc
+	}
+	doc.Responses[strconv.Itoa(op.status)] = &openAPIResponse{
+		Description: http.StatusText(op.status),
+		Content:     map[string]openAPIMedia{"application/json": {Schema: generator.schemaOf(op.response)}},
+	}
+	return doc
+}
+
+// parameters describes the fields bound from path, query or header, see Bind.
+func parameters(generator *schemaGenerator, t reflect.Type) []openAPIParameter {
+	var params []openAPIParameter
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			params = append(params, parameters(generator, field.Type)...)
+			continue
+		}
+		for _, in := range []string{"path", "query", "header"} {
+			name, ok := field.Tag.Lookup(in)
+			if !ok {
+				continue
+			}
+			s := generator.schemaOf(field.Type)
+			s.Nullable = false
+			required := applyValidation(s, field)
+			params = append(params, openAPIParameter{
+				Name:     name,
+				In:       in,
+				Required: required || in == "path",
+				Schema:   s,
+			})
+			break
+		}
+	}
+	return params
+}
+
+func hasBody(method string) bool {
+	switch method {
+	case "get", "head", "delete", "options":
+		return false
+	}
+	return true
+}
+
+// requiresBody reports whether a field of the body is required, requests with optional fields only may omit the body.
+func requiresBody(t reflect.Type) bool {
+	for _, field := range bodyFields(t) {
+		rules, _, _ := strings.Cut(field.Tag.Get("validate"), ",dive")
+		for _, rule := range strings.Split(rules, ",") {
+			if rule == "required" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,325 @@
+package openapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/thumperq/golib/config"
+	"github.com/thumperq/golib/logging"
+	httpserver "github.com/thumperq/golib/servers/http"
+)
+
+const CfgHttpOpenAPIResponseValidation = "HTTP_OPENAPI_RESPONSE_VALIDATION"
+
+// ResponseValidation selects what happens to responses not matching the spec.
+type ResponseValidation int
+
+const (
+	// ResponsesOff does not validate responses.
+	ResponsesOff ResponseValidation = iota
+	// ResponsesLog logs responses not matching the spec and sends them anyway.
+	ResponsesLog
+	// ResponsesReject replaces responses not matching the spec with a 500 problem.
+	ResponsesReject
+)
+
+// ParseResponseValidation parses off, log or reject.
+func ParseResponseValidation(value string) (ResponseValidation, error) {
+	switch strings.ToLower(value) {
+	case "off", "":
+		return ResponsesOff, nil
+	case "log":
+		return ResponsesLog, nil
+	case "reject":
+		return ResponsesReject, nil
+	}
+	return ResponsesOff, fmt.Errorf("unknown response validation %q, expected off, log or reject", value)
+}
+
+// Validator validates requests, and optionally responses, against the OpenAPI spec served by the ApiServer.
+type Validator struct {
+	spec      func() ([]byte, error)
+	responses ResponseValidation
+	once      sync.Once
+	router    routers.Router
+	err       error
+}
+
+// NewValidator validates against the spec of srv.OpenAPI. The spec is loaded on the first request, so routes registered
+// after the middleware was added are part of it, call Load to fail at startup instead.
+func NewValidator(srv *httpserver.ApiServer) *Validator {
+	return &Validator{spec: srv.OpenAPI}
+}
+
+// WithResponseValidation validates the responses too, the responses are buffered until they are validated.
+func (v *Validator) WithResponseValidation(mode ResponseValidation) *Validator {
+	v.responses = mode
+	return v
+}
+
+// WithConfig applies HTTP_OPENAPI_RESPONSE_VALIDATION, off, log or reject, when set.
+func (v *Validator) WithConfig(ctx context.Context, cfg config.CfgManager) error {
+	value, err := config.GetOptionalValue(ctx, cfg, CfgHttpOpenAPIResponseValidation)
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		return nil
+	}
+	mode, err := ParseResponseValidation(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", CfgHttpOpenAPIResponseValidation, err)
+	}
+	v.responses = mode
+	return nil
+}
+
+// Load loads and validates the spec.
+func (v *Validator) Load() error {
+	v.once.Do(func() {
+		v.router, v.err = newRouter(v.spec)
+	})
+	return v.err
+}
+
+func newRouter(spec func() ([]byte, error)) (routers.Router, error) {
+	data, err := spec()
+	if err != nil {
+		return nil, err
+	}
+	doc, err := openapi3.NewLoader().LoadFromData(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid openapi spec: %w", err)
+	}
+	err = doc.Validate(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("invalid openapi spec: %w", err)
+	}
+	doc.Servers, err = pathServers(doc.Servers)
+	if err != nil {
+		return nil, err
+	}
+	return gorillamux.NewRouter(doc)
+}
+
+// pathServers keeps only the paths of the server urls, behind proxies and load balancers the host and scheme of
+// requests differ from the public urls in the spec.
+func pathServers(servers openapi3.Servers) (openapi3.Servers, error) {
+	var paths openapi3.Servers
+	for _, server := range servers {
+		rawURL := server.URL
+		for name, variable := range server.Variables {
+			rawURL = strings.ReplaceAll(rawURL, "{"+name+"}", variable.Default)
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server url %s: %w", server.URL, err)
+		}
+		paths = append(paths, &openapi3.Server{URL: strings.TrimSuffix(u.Path, "/")})
+	}
+	return paths, nil
+}
+
+// Middleware answers requests not matching the spec with a 400 problem listing the invalid parameters and body fields.
+// Requests of routes missing in the spec are passed on, e.g. the health routes. Authentication is left to the auth
+// middlewares, the security requirements of the spec are not checked. Add it inside of Gzip when validating responses.
+func (v *Validator) Middleware() httpserver.Middleware {
+	options := &openapi3filter.Options{
+		MultiError:         true,
+		AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			err := v.Load()
+			if err != nil {
+				httpserver.WriteError(w, r, err)
+				return
+			}
+			route, pathParams, err := v.router.FindRoute(r)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			input := &openapi3filter.RequestValidationInput{
+				Request:    r,
+				PathParams: pathParams,
+				Route:      route,
+				Options:    options,
+			}
+			err = openapi3filter.ValidateRequest(r.Context(), input)
+			if err != nil {
+				httpserver.WriteError(w, r, requestProblem(err))
+				return
+			}
+			// upgraded connections are hijacked, they have no response to validate
+			if v.responses == ResponsesOff || r.Header.Get("Upgrade") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+			if !recorder.streaming {
+				v.validateResponse(w, r, input, recorder)
+			}
+		})
+	}
+}
+
+// validateResponse writes the recorded response, unless it does not match the spec and responses are rejected.
+func (v *Validator) validateResponse(w http.ResponseWriter, r *http.Request, input *openapi3filter.RequestValidationInput, recorder *responseRecorder) {
+	err := openapi3filter.ValidateResponse(r.Context(), (&openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 recorder.status,
+		Header:                 w.Header(),
+		Options:                input.Options,
+	}).SetBodyBytes(recorder.body.Bytes()))
+	if err != nil {
+		err = fmt.Errorf("response %d of %s %s does not match the openapi spec: %w", recorder.status, r.Method, r.URL.Path, err)
+		if v.responses == ResponsesReject {
+			w.Header().Del("Content-Length")
+			httpserver.WriteError(w, r, err)
+			return
+		}
+		logging.TraceLogger(r.Context()).
+			Warn().
+			Err(err).
+			Msg("invalid response")
+	}
+	w.WriteHeader(recorder.status)
+	_, err = w.Write(recorder.body.Bytes())
+	if err != nil {
+		logging.TraceLogger(r.Context()).
+			Err(err).
+			Msgf("failed to write response of %s %s", r.Method, r.URL.Path)
+	}
+}
+
+// requestProblem lists the invalid parameters and body fields, Field is named like in the problems of Bind.
+func requestProblem(err error) *httpserver.Problem {
+	problem := httpserver.NewProblem(http.StatusBadRequest, "request validation failed")
+	problem.Errors = fieldErrors(err)
+	return problem
+}
+
+func fieldErrors(err error) []httpserver.FieldError {
+	var requestErr *openapi3filter.RequestError
+	switch e := err.(type) {
+	case openapi3.MultiError:
+		var fields []httpserver.FieldError
+		for _, err := range e {
+			fields = append(fields, fieldErrors(err)...)
+		}
+		return fields
+	case *openapi3filter.RequestError:
+		requestErr = e
+	default:
+		return []httpserver.FieldError{{Message: err.Error()}}
+	}
+	field := "body"
+	if requestErr.Parameter != nil {
+		field = requestErr.Parameter.Name
+	}
+	var schemaErrs openapi3.MultiError
+	var schemaErr *openapi3.SchemaError
+	switch {
+	case errors.As(requestErr.Err, &schemaErrs):
+		var fields []httpserver.FieldError
+		for _, e := range schemaErrs {
+			if errors.As(e, &schemaErr) {
+				fields = append(fields, schemaFieldError(field, requestErr.Parameter != nil, schemaErr))
+			}
+		}
+		if len(fields) > 0 {
+			return fields
+		}
+	case errors.As(requestErr.Err, &schemaErr):
+		return []httpserver.FieldError{schemaFieldError(field, requestErr.Parameter != nil, schemaErr)}
+	}
+	message := requestErr.Reason
+	if message == "" && requestErr.Err != nil {
+		message = requestErr.Err.Error()
+	}
+	return []httpserver.FieldError{{Field: field, Message: message}}
+}
+
+// schemaFieldError names body fields by their path, e.g. lines[0].sku, and parameters by their name.
+func schemaFieldError(field string, parameter bool, err *openapi3.SchemaError) httpserver.FieldError {
+	if !parameter {
+		field = ""
+	}
+	for _, segment := range err.JSONPointer() {
+		switch _, e := strconv.Atoi(segment); {
+		case e == nil:
+			field += "[" + segment + "]"
+		case field == "":
+			field = segment
+		default:
+			field += "." + segment
+		}
+	}
+	if field == "" {
+		field = "body"
+	}
+	return httpserver.FieldError{Field: field, Message: err.Reason}
+}
+
+// responseRecorder buffers the response until it is validated, the headers are written to the ResponseWriter.
+// Server-sent events are written through unvalidated, their responses never end.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	streaming   bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	r.status = status
+	mediaType, _, _ := mime.ParseMediaType(r.Header().Get("Content-Type"))
+	if mediaType == "text/event-stream" {
+		r.streaming = true
+		r.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	if r.streaming {
+		return r.ResponseWriter.Write(b)
+	}
+	return r.body.Write(b)
+}
+
+// FlushError flushes streams, other responses are written once they are validated.
+func (r *responseRecorder) FlushError() error {
+	r.WriteHeader(http.StatusOK)
+	if !r.streaming {
+		return nil
+	}
+	return http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+func (r *responseRecorder) Flush() {
+	_ = r.FlushError()
+}
+
+// Unwrap gives http.ResponseController access to the ResponseWriter, e.g. to set write deadlines.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
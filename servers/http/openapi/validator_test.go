@@ -0,0 +1,226 @@
+package openapi_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	httpserver "github.com/thumperq/golib/servers/http"
+	"github.com/thumperq/golib/servers/http/openapi"
+)
+
+const spec = `
+openapi: 3.0.3
+info:
+  title: ordering
+  version: 1.0.0
+servers:
+  - url: https://api.example.com/wms/ordering
+paths:
+  /orders/{id}:
+    put:
+      parameters:
+        - name: id
+          in: path
+          required: true
+          schema:
+            type: integer
+        - name: X-Tenant
+          in: header
+          required: true
+          schema:
+            type: string
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [status, lines]
+              properties:
+                status:
+                  type: string
+                  enum: [open, closed]
+                lines:
+                  type: array
+                  items:
+                    type: object
+                    required: [sku]
+                    properties:
+                      sku:
+                        type: string
+      responses:
+        "200":
+          description: OK
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [id, status]
+                properties:
+                  id:
+                    type: integer
+                  status:
+                    type: string
+  /orders/{id}/events:
+    get:
+      parameters:
+        - name: id
+          in: path
+          required: true
+          schema:
+            type: integer
+      responses:
+        "200":
+          description: OK
+          content:
+            text/event-stream:
+              schema:
+                type: string
+`
+
+func newServer(t *testing.T, mode openapi.ResponseValidation, response string) *httpserver.ApiServer {
+	opts := httpserver.DefaultOptions()
+	opts.RoutePrefix = "/wms/ordering"
+	opts.OpenAPISpec = []byte(spec)
+	srv, err := httpserver.NewApiServer(opts)
+	require.NoError(t, err)
+	validator := openapi.NewValidator(srv).WithResponseValidation(mode)
+	require.NoError(t, validator.Load())
+	srv.Use(validator.Middleware())
+	srv.HandleFunc("PUT /orders/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(response))
+	})
+	return srv
+}
+
+func put(srv *httpserver.ApiServer, path string, tenant string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if tenant != "" {
+		r.Header.Set("X-Tenant", tenant)
+	}
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, r)
+	return w
+}
+
+func TestValidateRequest(t *testing.T) {
+	srv := newServer(t, openapi.ResponsesOff, `{"id":42,"status":"open"}`)
+
+	w := put(srv, "/wms/ordering/orders/42", "acme", `{"status":"open","lines":[{"sku":"a"}]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = put(srv, "/wms/ordering/orders/abc", "", `{"status":"pending","lines":[{}]}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Equal(t, httpserver.ProblemContentType, w.Header().Get("Content-Type"))
+	var problem httpserver.Problem
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	require.Equal(t, "request validation failed", problem.Detail)
+	var fields []string
+	for _, e := range problem.Errors {
+		fields = append(fields, e.Field)
+	}
+	require.ElementsMatch(t, []string{"id", "X-Tenant", "status", "lines[0].sku"}, fields)
+
+	// routes missing in the spec are not validated
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/wms/ordering/health/live", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestValidateResponse(t *testing.T) {
+	body := `{"status":"open","lines":[{"sku":"a"}]}`
+
+	srv := newServer(t, openapi.ResponsesReject, `{"id":"42"}`)
+	w := put(srv, "/wms/ordering/orders/42", "acme", body)
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.Equal(t, httpserver.ProblemContentType, w.Header().Get("Content-Type"))
+
+	srv = newServer(t, openapi.ResponsesLog, `{"id":"42"}`)
+	w = put(srv, "/wms/ordering/orders/42", "acme", body)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, `{"id":"42"}`, w.Body.String())
+
+	srv = newServer(t, openapi.ResponsesReject, `{"id":42,"status":"open"}`)
+	w = put(srv, "/wms/ordering/orders/42", "acme", body)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"id":42,"status":"open"}`, w.Body.String())
+}
+
+func TestValidateResponseStreamsEvents(t *testing.T) {
+	srv := newServer(t, openapi.ResponsesReject, `{"id":42,"status":"open"}`)
+	srv.HandleFunc("GET /orders/{id}/events", func(w http.ResponseWriter, r *http.Request) {
+		stream, err := httpserver.NewSSE(w, r, httpserver.StreamOptions{})
+		if err != nil {
+			httpserver.WriteError(w, r, err)
+			return
+		}
+		_ = stream.Send(httpserver.Event{Name: "orderCreated", Data: []byte(`{"id":42}`)})
+		_ = stream.Serve()
+	})
+	server := httptest.NewServer(srv.Handler())
+	t.Cleanup(server.Close)
+
+	// the events are flushed while the response is still open, without the client asking for an event stream
+	resp, err := http.Get(server.URL + "/wms/ordering/orders/42/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "event: orderCreated\n", line)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "data: {\"id\":42}\n", line)
+}
+
+type renameOrder struct {
+	ID   int    `path:"id"`
+	Name string `json:"name" validate:"required,max=10"`
+}
+
+func TestValidateGeneratedSpec(t *testing.T) {
+	opts := httpserver.DefaultOptions()
+	opts.RoutePrefix = "/wms/ordering"
+	srv, err := httpserver.NewApiServer(opts)
+	require.NoError(t, err)
+	srv.Use(openapi.NewValidator(srv).Middleware())
+	httpserver.Route(srv, "PATCH /orders/{id}", func(ctx context.Context, req renameOrder) (httpserver.NoContent, error) {
+		return httpserver.NoContent{}, nil
+	})
+
+	r := httptest.NewRequest(http.MethodPatch, "/wms/ordering/orders/1", strings.NewReader(`{"name":"far too long a name"}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, r)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), `"field":"name"`)
+
+	require.Error(t, openapi.NewValidator(newInvalidSpecServer(t)).Load())
+}
+
+func newInvalidSpecServer(t *testing.T) *httpserver.ApiServer {
+	opts := httpserver.DefaultOptions()
+	opts.RoutePrefix = "/wms/ordering"
+	opts.OpenAPISpec = []byte("openapi: 3.0.3\npaths: {}\n")
+	srv, err := httpserver.NewApiServer(opts)
+	require.NoError(t, err)
+	return srv
+}
+
+func TestParseResponseValidation(t *testing.T) {
+	mode, err := openapi.ParseResponseValidation("Reject")
+	require.NoError(t, err)
+	require.Equal(t, openapi.ResponsesReject, mode)
+	_, err = openapi.ParseResponseValidation("strict")
+	require.Error(t, err)
+}
@@ -0,0 +1,124 @@
+package httpserver_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	httpserver "github.com/thumperq/golib/servers/http"
+	"gopkg.in/yaml.v3"
+)
+
+type shipmentLine struct {
+	Sku      string `json:"sku" validate:"required"`
+	Quantity int    `json:"quantity" validate:"min=1"`
+}
+
+type updateShipment struct {
+	ID     string         `path:"id"`
+	DryRun bool           `query:"dryRun"`
+	Status string         `json:"status" validate:"required,oneof=open closed"`
+	Note   *string        `json:"note" validate:"omitempty,max=200"`
+	Lines  []shipmentLine `json:"lines" validate:"required,min=1,dive"`
+}
+
+type shipment struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+func TestOpenAPIGenerated(t *testing.T) {
+	opts := httpserver.DefaultOptions()
+	opts.RoutePrefix = "/wms/ordering"
+	srv, err := httpserver.NewApiServer(opts)
+	require.NoError(t, err)
+	srv.WithAPIInfo("shipping", "2.1.0")
+	httpserver.Route(srv, "PUT /shipments/{id}", func(ctx context.Context, req updateShipment) (shipment, error) {
+		return shipment{ID: req.ID, Status: req.Status}, nil
+	}).WithSummary("update an shipment").WithTags("shipments")
+	httpserver.Route(srv.Group("/admin"), "DELETE /shipments/{id}", func(ctx context.Context, req struct {
+		ID string `path:"id"`
+	}) (httpserver.NoContent, error) {
+		return httpserver.NoContent{}, nil
+	})
+
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.yaml", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/yaml", w.Header().Get("Content-Type"))
+	var spec map[string]any
+	require.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &spec))
+	require.Equal(t, "3.0.3", spec["openapi"])
+	require.Equal(t, map[string]any{"title": "shipping", "version": "2.1.0"}, spec["info"])
+
+	paths := spec["paths"].(map[string]any)
+	update := paths["/wms/ordering/shipments/{id}"].(map[string]any)["put"].(map[string]any)
+	require.Equal(t, "update an shipment", update["summary"])
+	require.Equal(t, []any{
+		map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}},
+		map[string]any{"name": "dryRun", "in": "query", "schema": map[string]any{"type": "boolean"}},
+	}, update["parameters"])
+	require.Contains(t, update["responses"], "200")
+	require.Contains(t, update["responses"], "default")
+
+	schemas := spec["components"].(map[string]any)["schemas"].(map[string]any)
+	body := schemas["updateShipment"].(map[string]any)
+	require.Equal(t, []any{"status", "lines"}, body["required"])
+	properties := body["properties"].(map[string]any)
+	require.NotContains(t, properties, "ID")
+	require.Equal(t, []any{"open", "closed"}, properties["status"].(map[string]any)["enum"])
+	require.Equal(t, map[string]any{"type": "string", "nullable": true, "maxLength": 200}, properties["note"])
+	lines := properties["lines"].(map[string]any)
+	require.Equal(t, 1, lines["minItems"])
+	require.Equal(t, map[string]any{"$ref": "#/components/schemas/shipmentLine"}, lines["items"])
+	line := schemas["shipmentLine"].(map[string]any)
+	require.Equal(t, []any{"sku"}, line["required"])
+	require.Equal(t, 1, line["properties"].(map[string]any)["quantity"].(map[string]any)["minimum"])
+
+	remove := paths["/wms/ordering/admin/shipments/{id}"].(map[string]any)["delete"].(map[string]any)
+	require.NotContains(t, remove, "requestBody")
+	require.Contains(t, remove["responses"], "204")
+
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/wms/ordering/shipments/42",
+		strings.NewReader(`{"status":"open","lines":[{"sku":"a","quantity":1}]}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"id":"42","status":"open"}`, w.Body.String())
+}
+
+func TestOpenAPIProvided(t *testing.T) {
+	opts := httpserver.DefaultOptions()
+	opts.RoutePrefix = "/wms/ordering"
+	opts.OpenAPISpec = []byte("openapi: 3.0.3\n")
+	srv, err := httpserver.NewApiServer(opts)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.yaml", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "openapi: 3.0.3\n", w.Body.String())
+}
+
+func TestSwaggerUI(t *testing.T) {
+	for environment, enabled := range map[string]bool{"dev": true, "staging": true, "prod": false, "production": false} {
+		t.Run(environment, func(t *testing.T) {
+			t.Setenv("ENVIRONMENT", environment)
+			opts := httpserver.DefaultOptions()
+			opts.RoutePrefix = "/wms/ordering"
+			require.Equal(t, enabled, opts.SwaggerUI)
+			srv, err := httpserver.NewApiServer(opts)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/swagger/index.html", nil))
+			if enabled {
+				require.Equal(t, http.StatusOK, w.Code)
+			} else {
+				require.Equal(t, http.StatusNotFound, w.Code)
+			}
+		})
+	}
+}
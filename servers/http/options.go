@@ -0,0 +1,171 @@
+package httpserver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/thumperq/golib/config"
+)
+
+const (
+	CfgHttpPort              = "HTTP_PORT"
+	CfgHttpReadTimeout       = "HTTP_READ_TIMEOUT"
+	CfgHttpReadHeaderTimeout = "HTTP_READ_HEADER_TIMEOUT"
+	CfgHttpWriteTimeout      = "HTTP_WRITE_TIMEOUT"
+	CfgHttpIdleTimeout       = "HTTP_IDLE_TIMEOUT"
+	CfgHttpShutdownTimeout   = "HTTP_SHUTDOWN_TIMEOUT"
+	CfgHttpMaxHeaderBytes    = "HTTP_MAX_HEADER_BYTES"
+	CfgHttpMaxBodyBytes      = "HTTP_MAX_BODY_BYTES"
+	CfgHttpTLSCertFile       = "HTTP_TLS_CERT_FILE"
+	CfgHttpTLSKeyFile        = "HTTP_TLS_KEY_FILE"
+	CfgHttpTLSClientCAFile   = "HTTP_TLS_CLIENT_CA_FILE"
+	CfgHttpRoutePrefix       = "HTTP_ROUTE_PREFIX"
+	CfgHttpSwaggerUI         = "HTTP_SWAGGER_UI"
+	CfgHttpMetrics           = "HTTP_METRICS"
+	CfgHttpAccessLog         = "HTTP_ACCESS_LOG"
+)
+
+// Options configures the ApiServer, zero values disable the corresponding limit.
+type Options struct {
+	Port              uint16
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration
+	MaxHeaderBytes    int
+	// MaxBodyBytes limits the size of request bodies, larger bodies fail with 413.
+	MaxBodyBytes int64
+	// TLSCertFile and TLSKeyFile enable TLS, with TLSClientCAFile clients have to present a certificate signed by it.
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+	// RoutePrefix is prepended to the routes registered with ApiServer.Handle and HandleFunc.
+	RoutePrefix string
+	// CORS is applied to every request when set.
+	CORS *CORSOptions
+	// OpenAPISpec is served at /openapi.yaml, e.g. embedded with go:embed. Without it the spec is generated from the
+	// routes registered with Route.
+	OpenAPISpec []byte
+	// SwaggerUI serves Swagger UI at /swagger/, it is enabled outside of production by default.
+	SwaggerUI bool
+	// Metrics serves the metrics of the server in Prometheus format at /metrics.
+	Metrics bool
+	// AccessLog logs every request with the trace fields of its span.
+	AccessLog bool
+}
+
+// DefaultOptions listens on port 8080 and prefixes routes with /DOMAIN/SERVICE from the environment. Swagger UI is
+// enabled unless ENVIRONMENT is prod or production, metrics and access logs are enabled.
+func DefaultOptions() Options {
+	return Options{
+		Port:              8080,
+		ReadTimeout:       30 * time.Second,
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		ShutdownTimeout:   10 * time.Second,
+		MaxHeaderBytes:    1 << 20,
+		MaxBodyBytes:      10 << 20,
+		RoutePrefix:       fmt.Sprintf("/%s/%s", os.Getenv("DOMAIN"), os.Getenv("SERVICE")),
+		SwaggerUI:         !config.IsProduction(),
+		Metrics:           true,
+		AccessLog:         true,
+	}
+}
+
+// OptionsFromConfig overrides the default options with the values of the HTTP_* config keys which are set.
+// Timeouts are durations like 30s, sizes are numbers of bytes.
+func OptionsFromConfig(ctx context.Context, cfg config.CfgManager) (Options, error) {
+	opts := DefaultOptions()
+	values := map[string]string{}
+	for _, key := range []string{
+		CfgHttpPort, CfgHttpReadTimeout, CfgHttpReadHeaderTimeout, CfgHttpWriteTimeout, CfgHttpIdleTimeout,
+		CfgHttpShutdownTimeout, CfgHttpMaxHeaderBytes, CfgHttpMaxBodyBytes, CfgHttpTLSCertFile, CfgHttpTLSKeyFile,
+		CfgHttpTLSClientCAFile, CfgHttpRoutePrefix, CfgHttpSwaggerUI, CfgHttpMetrics, CfgHttpAccessLog,
+	} {
+		value, err := config.GetOptionalValue(ctx, cfg, key)
+		if err != nil {
+			return opts, err
+		}
+		if value != "" {
+			values[key] = value
+		}
+	}
+	if value, ok := values[CfgHttpPort]; ok {
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s: %w", CfgHttpPort, err)
+		}
+		opts.Port = uint16(port)
+	}
+	for key, target := range map[string]*time.Duration{
+		CfgHttpReadTimeout:       &opts.ReadTimeout,
+		CfgHttpReadHeaderTimeout: &opts.ReadHeaderTimeout,
+		CfgHttpWriteTimeout:      &opts.WriteTimeout,
+		CfgHttpIdleTimeout:       &opts.IdleTimeout,
+		CfgHttpShutdownTimeout:   &opts.ShutdownTimeout,
+	} {
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		*target = d
+	}
+	if value, ok := values[CfgHttpMaxHeaderBytes]; ok {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s: %w", CfgHttpMaxHeaderBytes, err)
+		}
+		opts.MaxHeaderBytes = n
+	}
+	if value, ok := values[CfgHttpMaxBodyBytes]; ok {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s: %w", CfgHttpMaxBodyBytes, err)
+		}
+		opts.MaxBodyBytes = n
+	}
+	if value, ok := values[CfgHttpRoutePrefix]; ok {
+		opts.RoutePrefix = value
+	}
+	err := config.ParseBools(values, map[string]*bool{
+		CfgHttpSwaggerUI: &opts.SwaggerUI,
+		CfgHttpMetrics:   &opts.Metrics,
+		CfgHttpAccessLog: &opts.AccessLog,
+	})
+	if err != nil {
+		return opts, err
+	}
+	opts.TLSCertFile = values[CfgHttpTLSCertFile]
+	opts.TLSKeyFile = values[CfgHttpTLSKeyFile]
+	opts.TLSClientCAFile = values[CfgHttpTLSClientCAFile]
+	err = opts.validateTLS()
+	if err != nil {
+		return opts, err
+	}
+	cors, err := CORSOptionsFromConfig(ctx, cfg)
+	if err != nil {
+		return opts, err
+	}
+	opts.CORS = cors
+	return opts, nil
+}
+
+// validateTLS rejects incomplete TLS options, which would serve plain HTTP and skip the client certificates.
+func (opts Options) validateTLS() error {
+	if (opts.TLSCertFile == "") != (opts.TLSKeyFile == "") {
+		return fmt.Errorf("%s and %s have to be set together", CfgHttpTLSCertFile, CfgHttpTLSKeyFile)
+	}
+	if opts.TLSClientCAFile != "" && opts.TLSCertFile == "" {
+		return fmt.Errorf("%s requires %s and %s", CfgHttpTLSClientCAFile, CfgHttpTLSCertFile, CfgHttpTLSKeyFile)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package httpserver_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	configTest "github.com/thumperq/golib/config/test"
+	httpserver "github.com/thumperq/golib/servers/http"
+)
+
+func TestOptionsFromConfig(t *testing.T) {
+	t.Setenv("DOMAIN", "wms")
+	t.Setenv("SERVICE", "ordering")
+	cfg := configTest.NewConfigManager()
+	cfg.WithKeyValue(httpserver.CfgHttpPort, "9090").
+		WithKeyValue(httpserver.CfgHttpWriteTimeout, "1m").
+		WithKeyValue(httpserver.CfgHttpMaxBodyBytes, "1024").
+		WithKeyValue(httpserver.CfgHttpTLSCertFile, "/etc/tls/tls.crt").
+		WithKeyValue(httpserver.CfgHttpTLSKeyFile, "/etc/tls/tls.key").
+		WithKeyValue(httpserver.CfgHttpTLSClientCAFile, "/etc/tls/ca.pem").
+		WithKeyValue(httpserver.CfgHttpAccessLog, "false")
+	opts, err := httpserver.OptionsFromConfig(context.Background(), cfg)
+	require.NoError(t, err)
+	require.Equal(t, uint16(9090), opts.Port)
+	require.Equal(t, time.Minute, opts.WriteTimeout)
+	require.Equal(t, 10*time.Second, opts.ReadHeaderTimeout)
+	require.Equal(t, int64(1024), opts.MaxBodyBytes)
+	require.Equal(t, "/etc/tls/ca.pem", opts.TLSClientCAFile)
+	require.Equal(t, "/wms/ordering", opts.RoutePrefix)
+	require.False(t, opts.AccessLog)
+	require.True(t, opts.Metrics)
+
+	cfg.WithKeyValue(httpserver.CfgHttpIdleTimeout, "forever")
+	_, err = httpserver.OptionsFromConfig(context.Background(), cfg)
+	require.ErrorContains(t, err, httpserver.CfgHttpIdleTimeout)
+}
+
+func TestOptionsFromConfigRejectsClientCAWithoutCertificate(t *testing.T) {
+	cfg := configTest.NewConfigManager()
+	cfg.WithKeyValue(httpserver.CfgHttpTLSClientCAFile, "/etc/tls/ca.pem")
+	_, err := httpserver.OptionsFromConfig(context.Background(), cfg)
+	require.ErrorContains(t, err, httpserver.CfgHttpTLSClientCAFile)
+
+	cfg = configTest.NewConfigManager()
+	cfg.WithKeyValue(httpserver.CfgHttpTLSCertFile, "/etc/tls/tls.crt")
+	_, err = httpserver.OptionsFromConfig(context.Background(), cfg)
+	require.ErrorContains(t, err, httpserver.CfgHttpTLSKeyFile)
+}
+
+func TestCORSOptionsFromConfig(t *testing.T) {
+	cfg := configTest.NewConfigManager()
+	cfg.WithKeyValue(httpserver.CfgHttpCorsAllowedOrigins, "https://app.example.com, https://admin.example.com").
+		WithKeyValue(httpserver.CfgHttpCorsAllowCredentials, "true").
+		WithKeyValue(httpserver.CfgHttpCorsMaxAge, "600")
+	opts, err := httpserver.CORSOptionsFromConfig(context.Background(), cfg)
+	require.NoError(t, err)
+	require.Equal(t, []string{"https://app.example.com", "https://admin.example.com"}, opts.AllowedOrigins)
+	require.True(t, opts.AllowCredentials)
+	require.Equal(t, 600, opts.MaxAge)
+
+	// invalid values name their config key
+	cfg.WithKeyValue(httpserver.CfgHttpCorsAllowCredentials, "sometimes")
+	_, err = httpserver.CORSOptionsFromConfig(context.Background(), cfg)
+	require.ErrorContains(t, err, "invalid "+httpserver.CfgHttpCorsAllowCredentials)
+	cfg.WithKeyValue(httpserver.CfgHttpCorsAllowCredentials, "false").
+		WithKeyValue(httpserver.CfgHttpCorsMaxAge, "10m")
+	_, err = httpserver.CORSOptionsFromConfig(context.Background(), cfg)
+	require.ErrorContains(t, err, "invalid "+httpserver.CfgHttpCorsMaxAge)
+}
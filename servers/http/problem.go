@@ -0,0 +1,201 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+const ProblemContentType = "application/problem+json"
+
+// Problem is an RFC 9457 problem details response. Handlers can return a *Problem, or an error wrapping one,
+// to control the response completely.
+type Problem struct {
+	Type     string       `json:"type,omitempty"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError describes an invalid request field, Field is the json path of the field, e.g. lines[0].sku.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func NewProblem(status int, detail string) *Problem {
+	return &Problem{
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// withDefaults returns a copy of problems without status as internal server error, the problem itself is not changed.
+func (p *Problem) withDefaults() *Problem {
+	if p.Status != 0 {
+		return p
+	}
+	problem := *p
+	problem.Status = http.StatusInternalServerError
+	if problem.Title == "" {
+		problem.Title = http.StatusText(problem.Status)
+	}
+	return &problem
+}
+
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return fmt.Sprintf("%s: %s", p.Title, p.Detail)
+	}
+	return p.Title
+}
+
+func init() {
+	validate.RegisterTagNameFunc(fieldName)
+}
+
+// fieldName names struct fields in validation errors by their json, path, query or header name.
+func fieldName(field reflect.StructField) string {
+	for _, tag := range []string{"json", "path", "query", "header"} {
+		name, _, _ := strings.Cut(field.Tag.Get(tag), ",")
+		if name == "-" {
+			return ""
+		}
+		if name != "" {
+			return name
+		}
+	}
+	return field.Name
+}
+
+// ProblemOf converts an error into a problem with the status of StatusOf. Bind and validation errors list the
+// invalid fields, the details of internal server errors are not exposed.
+func ProblemOf(err error) *Problem {
+	var problem *Problem
+	if errors.As(err, &problem) {
+		return problem.withDefaults()
+	}
+	status := StatusOf(err)
+	if status >= http.StatusInternalServerError {
+		return NewProblem(status, "")
+	}
+	problem = NewProblem(status, err.Error())
+	var validationErrors validator.ValidationErrors
+	if errors.As(err, &validationErrors) {
+		problem.Detail = "request validation failed"
+		for _, e := range validationErrors {
+			problem.Errors = append(problem.Errors, FieldError{
+				Field:   fieldPath(e.Namespace()),
+				Message: validationMessage(e),
+			})
+		}
+	}
+	var bindError *BindError
+	if errors.As(err, &bindError) {
+		var typeError *json.UnmarshalTypeError
+		switch {
+		case errors.As(bindError.Err, &typeError):
+			problem.Detail = "invalid request body"
+			problem.Errors = []FieldError{{Field: jsonFieldPath(typeError.Field), Message: "must be of type " + jsonType(typeError.Type)}}
+		case bindError.Field != "":
+			problem.Detail = fmt.Sprintf("invalid %s parameter", bindError.Source)
+			problem.Errors = []FieldError{{Field: bindError.Field, Message: bindError.Err.Error()}}
+		}
+	}
+	return problem
+}
+
+// WriteProblem writes the problem as application/problem+json, problems without status are internal server errors.
+func WriteProblem(w http.ResponseWriter, problem *Problem) error {
+	problem = problem.withDefaults()
+	w.Header().Set("Content-Type", ProblemContentType)
+	Status(problem.Status, w)
+	return json.NewEncoder(w).Encode(problem)
+}
+
+// fieldPath strips the name of the validated struct from the namespace of a validation error.
+func fieldPath(namespace string) string {
+	_, path, found := strings.Cut(namespace, ".")
+	if !found {
+		return namespace
+	}
+	return path
+}
+
+// jsonFieldPath writes the array indexes of json decoding errors like validation errors, lines.0.sku becomes lines[0].sku.
+func jsonFieldPath(field string) string {
+	var path strings.Builder
+	for i, segment := range strings.Split(field, ".") {
+		if _, err := strconv.Atoi(segment); err == nil {
+			path.WriteString("[" + segment + "]")
+			continue
+		}
+		if i > 0 {
+			path.WriteString(".")
+		}
+		path.WriteString(segment)
+	}
+	return path.String()
+}
+
+func validationMessage(e validator.FieldError) string {
+	switch e.Tag() {
+	case "required", "required_if", "required_unless", "required_with", "required_without":
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "url", "uri":
+		return "must be a valid url"
+	case "uuid", "uuid4":
+		return "must be a valid uuid"
+	case "oneof":
+		return "must be one of " + e.Param()
+	case "min", "gte":
+		return "must be at least " + e.Param() + unitOf(e.Kind())
+	case "max", "lte":
+		return "must be at most " + e.Param() + unitOf(e.Kind())
+	case "gt":
+		return "must be greater than " + e.Param()
+	case "lt":
+		return "must be less than " + e.Param()
+	case "len":
+		return "must have a length of " + e.Param() + unitOf(e.Kind())
+	}
+	return fmt.Sprintf("failed the %s validation", e.Tag())
+}
+
+// unitOf returns the unit of length based validations, which count characters of strings and items of collections.
+func unitOf(kind reflect.Kind) string {
+	switch kind {
+	case reflect.String:
+		return " characters"
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return " items"
+	}
+	return ""
+}
+
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	}
+	return "object"
+}
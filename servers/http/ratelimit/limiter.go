@@ -0,0 +1,189 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	// maxConflicts bounds the retries of concurrent updates of the same key in a shared store
+	maxConflicts    = 20
+	conflictBackoff = 2 * time.Millisecond
+)
+
+// Decision is the outcome of a request against a limit.
+type Decision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is the time until the quota is fully available again.
+	Reset time.Duration
+	// RetryAfter is the time until a denied request would be allowed.
+	RetryAfter time.Duration
+}
+
+// Algorithm decides about a request given the state stored for the client, the returned state replaces it.
+type Algorithm interface {
+	take(state []byte, now time.Time) ([]byte, Decision)
+	// policy describes the limit for the RateLimit-Policy header.
+	policy() string
+	// ttl is how long the state has to be kept after the last request.
+	ttl() time.Duration
+}
+
+type tokenBucket struct {
+	rate  float64
+	burst int
+	every time.Duration
+}
+
+// TokenBucket allows requests per period on average with bursts of up to burst requests, burst defaults to requests.
+func TokenBucket(requests int, per time.Duration, burst int) Algorithm {
+	if burst <= 0 {
+		burst = requests
+	}
+	return &tokenBucket{
+		rate:  float64(requests) / per.Seconds(),
+		burst: burst,
+		every: per,
+	}
+}
+
+func (b *tokenBucket) take(state []byte, now time.Time) ([]byte, Decision) {
+	tokens := float64(b.burst)
+	if len(state) == 16 {
+		last := time.Unix(0, int64(binary.BigEndian.Uint64(state[8:])))
+		tokens = math.Float64frombits(binary.BigEndian.Uint64(state))
+		tokens = math.Min(float64(b.burst), tokens+now.Sub(last).Seconds()*b.rate)
+	}
+	decision := Decision{Limit: b.burst}
+	if tokens >= 1 {
+		decision.Allowed = true
+		tokens--
+	} else {
+		decision.RetryAfter = b.duration(1 - tokens)
+	}
+	decision.Remaining = int(tokens)
+	decision.Reset = b.duration(float64(b.burst) - tokens)
+	state = make([]byte, 16)
+	binary.BigEndian.PutUint64(state, math.Float64bits(tokens))
+	binary.BigEndian.PutUint64(state[8:], uint64(now.UnixNano()))
+	return state, decision
+}
+
+// duration returns the time it takes to refill the tokens.
+func (b *tokenBucket) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) policy() string {
+	return fmt.Sprintf("%d;w=%d;burst=%d", int(math.Round(b.rate*b.every.Seconds())), int(b.every.Seconds()), b.burst)
+}
+
+func (b *tokenBucket) ttl() time.Duration {
+	return b.duration(float64(b.burst)) + time.Second
+}
+
+type slidingWindow struct {
+	limit  int
+	window time.Duration
+}
+
+// SlidingWindow allows requests per window, the count of the previous window is weighted by its overlap with the
+// window ending now.
+func SlidingWindow(requests int, window time.Duration) Algorithm {
+	return &slidingWindow{limit: requests, window: window}
+}
+
+func (w *slidingWindow) take(state []byte, now time.Time) ([]byte, Decision) {
+	start := now.Truncate(w.window)
+	var previous, current float64
+	if len(state) == 24 {
+		stateStart := time.Unix(0, int64(binary.BigEndian.Uint64(state)))
+		switch start.Sub(stateStart) {
+		case 0:
+			previous = float64(binary.BigEndian.Uint64(state[8:]))
+			current = float64(binary.BigEndian.Uint64(state[16:]))
+		case w.window:
+			previous = float64(binary.BigEndian.Uint64(state[16:]))
+		}
+	}
+	elapsed := now.Sub(start)
+	weight := 1 - float64(elapsed)/float64(w.window)
+	estimate := previous*weight + current
+	decision := Decision{Limit: w.limit}
+	if estimate+1 <= float64(w.limit) {
+		decision.Allowed = true
+		current++
+		estimate++
+	} else {
+		decision.RetryAfter = w.retryAfter(previous, current, elapsed)
+	}
+	decision.Remaining = max(0, int(float64(w.limit)-estimate))
+	decision.Reset = w.window - elapsed
+	state = make([]byte, 24)
+	binary.BigEndian.PutUint64(state, uint64(start.UnixNano()))
+	binary.BigEndian.PutUint64(state[8:], uint64(previous))
+	binary.BigEndian.PutUint64(state[16:], uint64(current))
+	return state, decision
+}
+
+// retryAfter returns when the estimate leaves room for another request, either later in the current window as the
+// weight of the previous window declines or in the next window.
+func (w *slidingWindow) retryAfter(previous float64, current float64, elapsed time.Duration) time.Duration {
+	room := float64(w.limit - 1)
+	if current <= room {
+		return time.Duration((1-(room-current)/previous)*float64(w.window)) - elapsed
+	}
+	return w.window - elapsed + time.Duration((1-room/current)*float64(w.window))
+}
+
+func (w *slidingWindow) policy() string {
+	return fmt.Sprintf("%d;w=%d", w.limit, int(w.window.Seconds()))
+}
+
+func (w *slidingWindow) ttl() time.Duration {
+	return 2 * w.window
+}
+
+// Limiter applies an algorithm to the requests of clients, the state of each client is kept in a store.
+type Limiter struct {
+	store     Store
+	algorithm Algorithm
+}
+
+func NewLimiter(store Store, algorithm Algorithm) *Limiter {
+	return &Limiter{
+		store:     store,
+		algorithm: algorithm,
+	}
+}
+
+// Allow takes a request of the client identified by key. Keys are prefixed with the policy of the algorithm, so
+// limiters with different limits can share a store.
+func (l *Limiter) Allow(ctx context.Context, key string) (Decision, error) {
+	key = l.algorithm.policy() + " " + key
+	for i := 0; i < maxConflicts; i++ {
+		state, revision, err := l.store.Get(ctx, key)
+		if err != nil {
+			return Decision{}, err
+		}
+		state, decision := l.algorithm.take(state, time.Now())
+		err = l.store.Set(ctx, key, state, revision, l.algorithm.ttl())
+		if !errors.Is(err, ErrConflict) {
+			return decision, err
+		}
+		// back off randomly so the competing replicas do not collide again
+		select {
+		case <-ctx.Done():
+			return Decision{}, ctx.Err()
+		case <-time.After(rand.N(conflictBackoff * time.Duration(i+1))):
+		}
+	}
+	return Decision{}, fmt.Errorf("rate limit state of %s changed concurrently %d times", key, maxConflicts)
+}
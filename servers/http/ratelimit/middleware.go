@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/thumperq/golib/logging"
+	httpserver "github.com/thumperq/golib/servers/http"
+	"github.com/thumperq/golib/servers/http/auth"
+)
+
+const (
+	HeaderRateLimitLimit     = "RateLimit-Limit"
+	HeaderRateLimitRemaining = "RateLimit-Remaining"
+	HeaderRateLimitReset     = "RateLimit-Reset"
+	HeaderRateLimitPolicy    = "RateLimit-Policy"
+	HeaderRetryAfter         = "Retry-After"
+)
+
+// KeyFunc identifies the client of a request.
+type KeyFunc func(r *http.Request) string
+
+// ByIP identifies clients by their remote address, put the server behind proxies setting it to the client address.
+func ByIP() KeyFunc {
+	return func(r *http.Request) string {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		return "ip:" + host
+	}
+}
+
+// ByAPIKey identifies clients by the api key in the header, requests without key by their remote address.
+// Only a hash of the key is stored.
+func ByAPIKey(header string) KeyFunc {
+	if header == "" {
+		header = auth.HeaderAPIKey
+	}
+	byIP := ByIP()
+	return func(r *http.Request) string {
+		key := r.Header.Get(header)
+		if key == "" {
+			return byIP(r)
+		}
+		hash := sha256.Sum256([]byte(key))
+		return "apikey:" + hex.EncodeToString(hash[:16])
+	}
+}
+
+// BySubject identifies clients by the subject of the identity set by auth.Authenticate, anonymous requests by their
+// remote address.
+func BySubject() KeyFunc {
+	byIP := ByIP()
+	return func(r *http.Request) string {
+		id, ok := auth.IdentityFromContext(r.Context())
+		if !ok || id.Subject == "" {
+			return byIP(r)
+		}
+		return id.Method + ":" + id.Subject
+	}
+}
+
+// RateLimit answers requests exceeding the limit with 429 and sets the RateLimit-* headers on every response.
+// Every route has its own limit per client, requests not matching any route share one. Requests are let through when
+// the store fails.
+func RateLimit(limiter *Limiter, key KeyFunc) httpserver.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			decision, err := limiter.Allow(r.Context(), r.Pattern+" "+key(r))
+			if err != nil {
+				logging.TraceLogger(r.Context()).
+					Err(err).
+					Msgf("rate limit of %s %s failed", r.Method, r.URL.Path)
+				next.ServeHTTP(w, r)
+				return
+			}
+			header := w.Header()
+			header.Set(HeaderRateLimitLimit, strconv.Itoa(decision.Limit))
+			header.Set(HeaderRateLimitRemaining, strconv.Itoa(decision.Remaining))
+			header.Set(HeaderRateLimitReset, strconv.Itoa(seconds(decision.Reset)))
+			header.Set(HeaderRateLimitPolicy, limiter.algorithm.policy())
+			if !decision.Allowed {
+				header.Set(HeaderRetryAfter, strconv.Itoa(max(1, seconds(decision.RetryAfter))))
+				httpserver.WriteError(w, r, httpserver.NewProblem(http.StatusTooManyRequests, "rate limit exceeded"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Concurrency sheds load with 503 while limit requests are in flight.
+func Concurrency(limit int) httpserver.Middleware {
+	slots := make(chan struct{}, limit)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+				next.ServeHTTP(w, r)
+			default:
+				w.Header().Set(HeaderRetryAfter, "1")
+				problem := httpserver.NewProblem(http.StatusServiceUnavailable, "too many concurrent requests")
+				problem.Instance = r.URL.Path
+				// shed requests are not logged as failures, logging them would add to the load
+				_ = httpserver.WriteProblem(w, problem)
+			}
+		})
+	}
+}
+
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,120 @@
+package ratelimit_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thumperq/golib/messaging/test"
+	httpserver "github.com/thumperq/golib/servers/http"
+	"github.com/thumperq/golib/servers/http/ratelimit"
+)
+
+func ok(w http.ResponseWriter, r *http.Request) {
+	httpserver.Status(http.StatusOK, w)
+}
+
+func request(handler http.Handler, path string, remoteAddr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestRateLimitHeadersPerRouteAndClient(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	mux := http.NewServeMux()
+	limit := ratelimit.RateLimit(ratelimit.NewLimiter(store, ratelimit.TokenBucket(1, time.Hour, 2)), ratelimit.ByIP())
+	mux.Handle("GET /orders", limit(http.HandlerFunc(ok)))
+	mux.Handle("GET /invoices", limit(http.HandlerFunc(ok)))
+
+	for i := 0; i < 2; i++ {
+		w := request(mux, "/orders", "10.0.0.1:5000")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "2", w.Header().Get(ratelimit.HeaderRateLimitLimit))
+		require.Equal(t, strconv.Itoa(1-i), w.Header().Get(ratelimit.HeaderRateLimitRemaining))
+		require.Equal(t, "1;w=3600;burst=2", w.Header().Get(ratelimit.HeaderRateLimitPolicy))
+	}
+	w := request(mux, "/orders", "10.0.0.1:5001")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, httpserver.ProblemContentType, w.Header().Get("Content-Type"))
+	require.Equal(t, "0", w.Header().Get(ratelimit.HeaderRateLimitRemaining))
+	require.Equal(t, "3600", w.Header().Get(ratelimit.HeaderRetryAfter))
+	require.Equal(t, "7200", w.Header().Get(ratelimit.HeaderRateLimitReset))
+
+	require.Equal(t, http.StatusOK, request(mux, "/invoices", "10.0.0.1:5000").Code, "routes are limited separately")
+	require.Equal(t, http.StatusOK, request(mux, "/orders", "10.0.0.2:5000").Code, "clients are limited separately")
+
+	window := ratelimit.RateLimit(ratelimit.NewLimiter(store, ratelimit.SlidingWindow(3, 24*time.Hour)), ratelimit.ByAPIKey(""))
+	handler := window(http.HandlerFunc(ok))
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/reports", nil)
+		req.Header.Set("X-Api-Key", "secret-1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, strconv.Itoa(2-i), w.Header().Get(ratelimit.HeaderRateLimitRemaining))
+	}
+	req := httptest.NewRequest(http.MethodGet, "/reports", nil)
+	req.Header.Set("X-Api-Key", "secret-1")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	retryAfter, err := strconv.Atoi(w.Header().Get(ratelimit.HeaderRetryAfter))
+	require.NoError(t, err)
+	require.Positive(t, retryAfter)
+}
+
+func TestKVStoreLimitsAcrossReplicas(t *testing.T) {
+	srv := test.NewNatsServer(t)
+	broker := test.ConnectBroker(t, srv.ClientURL(), "wms", "ordering")
+	kv, err := broker.NewKeyValue("ratelimit", time.Hour)
+	require.NoError(t, err)
+
+	replicas := []*ratelimit.Limiter{
+		ratelimit.NewLimiter(ratelimit.NewKVStore(kv), ratelimit.SlidingWindow(10, 24*time.Hour)),
+		ratelimit.NewLimiter(ratelimit.NewKVStore(kv), ratelimit.SlidingWindow(10, 24*time.Hour)),
+	}
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(limiter *ratelimit.Limiter) {
+			defer wg.Done()
+			decision, err := limiter.Allow(context.Background(), "ip:[2001:db8::1]")
+			require.NoError(t, err)
+			if decision.Allowed {
+				allowed.Add(1)
+			}
+		}(replicas[i%2])
+	}
+	wg.Wait()
+	require.Equal(t, int32(10), allowed.Load())
+}
+
+func TestConcurrencyShedsLoad(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := ratelimit.Concurrency(1)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		ok(w, r)
+	}))
+	done := make(chan int)
+	go func() {
+		done <- request(handler, "/orders", "10.0.0.1:5000").Code
+	}()
+	<-started
+	w := request(handler, "/orders", "10.0.0.2:5000")
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, "1", w.Header().Get(ratelimit.HeaderRetryAfter))
+	close(release)
+	require.Equal(t, http.StatusOK, <-done)
+}
@@ -0,0 +1,126 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// memorySweepInterval is how often expired entries are removed from the memory store
+const memorySweepInterval = time.Minute
+
+// ErrConflict is returned by Store.Set when the state was changed since it was read.
+var ErrConflict = errors.New("rate limit state changed concurrently")
+
+// Store keeps the rate limit state of clients. Set stores the state only if the revision of the key is still the
+// one returned by Get, which returns revision 0 for missing keys.
+type Store interface {
+	Get(ctx context.Context, key string) ([]byte, uint64, error)
+	Set(ctx context.Context, key string, state []byte, revision uint64, ttl time.Duration) error
+}
+
+type memoryEntry struct {
+	state    []byte
+	revision uint64
+	expires  time.Time
+}
+
+type memoryStore struct {
+	mu        sync.Mutex
+	entries   map[string]memoryEntry
+	lastSweep time.Time
+}
+
+// NewMemoryStore keeps the state in memory, limits apply per replica.
+func NewMemoryStore() Store {
+	return &memoryStore{
+		entries:   map[string]memoryEntry{},
+		lastSweep: time.Now(),
+	}
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string) ([]byte, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, 0, nil
+	}
+	if time.Now().After(entry.expires) {
+		// keep counting revisions so a concurrent Set of the expired state still conflicts
+		return nil, entry.revision, nil
+	}
+	return entry.state, entry.revision, nil
+}
+
+func (s *memoryStore) Set(ctx context.Context, key string, state []byte, revision uint64, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastSweep) > memorySweepInterval {
+		for k, entry := range s.entries {
+			if now.After(entry.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	entry, ok := s.entries[key]
+	if (ok && entry.revision != revision) || (!ok && revision != 0) {
+		return ErrConflict
+	}
+	s.entries[key] = memoryEntry{
+		state:    state,
+		revision: revision + 1,
+		expires:  now.Add(ttl),
+	}
+	return nil
+}
+
+type kvStore struct {
+	kv nats.KeyValue
+}
+
+// NewKVStore keeps the state in a JetStream key value bucket shared by the replicas, see Broker.NewKeyValue.
+// The ttl of the bucket has to exceed the window of the limits, entries do not expire individually.
+func NewKVStore(kv nats.KeyValue) Store {
+	return &kvStore{kv: kv}
+}
+
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, uint64, error) {
+	entry, err := s.kv.Get(kvKey(key))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return entry.Value(), entry.Revision(), nil
+}
+
+func (s *kvStore) Set(ctx context.Context, key string, state []byte, revision uint64, ttl time.Duration) error {
+	var err error
+	if revision == 0 {
+		_, err = s.kv.Create(kvKey(key), state)
+		if errors.Is(err, nats.ErrKeyExists) {
+			return ErrConflict
+		}
+		return err
+	}
+	_, err = s.kv.Update(kvKey(key), state, revision)
+	var apiErr *nats.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode == nats.JSErrCodeStreamWrongLastSequence {
+		return ErrConflict
+	}
+	return err
+}
+
+// kvKey encodes the key with the characters allowed in key value keys, client keys contain e.g. colons of ipv6
+// addresses or the slashes of routes.
+func kvKey(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
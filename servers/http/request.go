@@ -3,8 +3,6 @@ package httpserver
 import (
 	"encoding/json"
 	"net/http"
-
-	"github.com/go-playground/validator/v10"
 )
 
 type H map[string]any
@@ -12,7 +10,7 @@ type H map[string]any
 func BindJson[T any](r *http.Request, v T) error {
 	err := json.NewDecoder(r.Body).Decode(v)
 	if err != nil {
-		return err
+		return &BindError{Source: "body", Err: err}
 	}
 	return nil
 }
@@ -22,7 +20,6 @@ func ShouldBindJson[T any](r *http.Request, v T) error {
 	if err != nil {
 		return err
 	}
-	validate := validator.New(validator.WithRequiredStructEnabled())
 	err = validate.Struct(v)
 	if err != nil {
 		return err
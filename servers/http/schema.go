@@ -0,0 +1,258 @@
+package httpserver
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	timeType          = reflect.TypeFor[time.Time]()
+	rawMessageType    = reflect.TypeFor[json.RawMessage]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+	unsafeSchemaName  = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+)
+
+// schema is an OpenAPI 3.0 schema object.
+type schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	ExclusiveMinimum     bool               `json:"exclusiveMinimum,omitempty"`
+	ExclusiveMaximum     bool               `json:"exclusiveMaximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Items                *schema            `json:"items,omitempty"`
+	Properties           map[string]*schema `json:"properties,omitempty"`
+	AdditionalProperties *schema            `json:"additionalProperties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+}
+
+// schemaGenerator derives schemas from go types, named struct types become components referenced with $ref.
+type schemaGenerator struct {
+	components map[string]*schema
+	names      map[reflect.Type]string
+}
+
+func newSchemaGenerator() *schemaGenerator {
+	return &schemaGenerator{
+		components: map[string]*schema{},
+		names:      map[reflect.Type]string{},
+	}
+}
+
+func (g *schemaGenerator) schemaOf(t reflect.Type) *schema {
+	if t.Kind() == reflect.Pointer {
+		s := g.schemaOf(t.Elem())
+		if s.Ref != "" {
+			// siblings of $ref are ignored in OpenAPI 3.0
+			return s
+		}
+		s.Nullable = true
+		return s
+	}
+	switch {
+	case t == timeType:
+		return &schema{Type: "string", Format: "date-time"}
+	case t == rawMessageType:
+		return &schema{}
+	case t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textUnmarshalerType):
+		return &schema{Type: "string"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return &schema{Type: "string"}
+	case reflect.Bool:
+		return &schema{Type: "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return &schema{Type: "integer", Format: "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return &schema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &schema{Type: "number", Format: "double"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &schema{Type: "string", Format: "byte"}
+		}
+		return &schema{Type: "array", Items: g.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &schema{Type: "object", AdditionalProperties: g.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		return g.ref(t)
+	}
+	return &schema{}
+}
+
+// ref registers the struct as component before its fields are generated, so recursive types terminate.
+func (g *schemaGenerator) ref(t reflect.Type) *schema {
+	name, ok := g.names[t]
+	if !ok {
+		name = unsafeSchemaName.ReplaceAllString(t.Name(), "_")
+		if _, taken := g.components[name]; taken {
+			name = unsafeSchemaName.ReplaceAllString(t.PkgPath()+"."+t.Name(), "_")
+		}
+		g.names[t] = name
+		g.components[name] = &schema{}
+		*g.components[name] = *g.structSchema(t)
+	}
+	return &schema{Ref: "#/components/schemas/" + name}
+}
+
+// structSchema describes the json body fields of the struct, fields bound from path, query or header are left out.
+func (g *schemaGenerator) structSchema(t reflect.Type) *schema {
+	s := &schema{Type: "object", Properties: map[string]*schema{}}
+	for _, field := range bodyFields(t) {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" {
+			name = field.Name
+		}
+		property := g.schemaOf(field.Type)
+		if applyValidation(property, field) {
+			s.Required = append(s.Required, name)
+		}
+		s.Properties[name] = property
+	}
+	return s
+}
+
+// bodyFields returns the exported json fields of the struct including the fields of embedded structs.
+func bodyFields(t reflect.Type) []reflect.StructField {
+	var fields []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() || isParameter(field) || field.Tag.Get("json") == "-" {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && field.Tag.Get("json") == "" {
+			fields = append(fields, bodyFields(field.Type)...)
+			continue
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func isParameter(field reflect.StructField) bool {
+	for _, tag := range []string{"path", "query", "header"} {
+		if _, ok := field.Tag.Lookup(tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// applyValidation adds the constraints of the validate tag to the schema and reports whether the field is required.
+// Rules after dive apply to the items of collections.
+func applyValidation(s *schema, field reflect.StructField) bool {
+	tag := field.Tag.Get("validate")
+	if tag == "" {
+		return false
+	}
+	rules, itemRules, _ := strings.Cut(tag, ",dive")
+	if s.Items != nil && itemRules != "" {
+		applyRules(s.Items, strings.TrimPrefix(itemRules, ","))
+	}
+	return applyRules(s, rules)
+}
+
+func applyRules(s *schema, rules string) bool {
+	required := false
+	for _, rule := range strings.Split(rules, ",") {
+		name, param, _ := strings.Cut(rule, "=")
+		if s.Ref != "" && name != "required" {
+			// siblings of $ref are ignored in OpenAPI 3.0
+			continue
+		}
+		switch name {
+		case "required":
+			required = true
+		case "email":
+			s.Format = "email"
+		case "url", "uri":
+			s.Format = "uri"
+		case "uuid", "uuid4":
+			s.Format = "uuid"
+		case "oneof":
+			for _, value := range strings.Fields(param) {
+				s.Enum = append(s.Enum, enumValue(s.Type, value))
+			}
+		case "min", "gte":
+			setBound(s, param, true, false)
+		case "max", "lte":
+			setBound(s, param, false, false)
+		case "gt":
+			setBound(s, param, true, true)
+		case "lt":
+			setBound(s, param, false, true)
+		case "len":
+			setBound(s, param, true, false)
+			setBound(s, param, false, false)
+		}
+	}
+	return required
+}
+
+// setBound limits the length of strings, the items of arrays or the value of numbers.
+func setBound(s *schema, param string, lower bool, exclusive bool) {
+	n, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return
+	}
+	count := int(n)
+	if exclusive && lower {
+		count++
+	} else if exclusive {
+		count--
+	}
+	switch s.Type {
+	case "string":
+		if lower {
+			s.MinLength = &count
+		} else {
+			s.MaxLength = &count
+		}
+	case "array":
+		if lower {
+			s.MinItems = &count
+		} else {
+			s.MaxItems = &count
+		}
+	case "integer", "number":
+		if lower {
+			s.Minimum = &n
+			s.ExclusiveMinimum = exclusive
+		} else {
+			s.Maximum = &n
+			s.ExclusiveMaximum = exclusive
+		}
+	}
+}
+
+func enumValue(typ string, value string) any {
+	switch typ {
+	case "integer", "number":
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			return n
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
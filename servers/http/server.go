@@ -2,113 +2,269 @@ package httpserver
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
+	"strings"
 	"time"
 
-	"github.com/rs/cors"
 	httpSwagger "github.com/swaggo/http-swagger"
+	"github.com/thumperq/golib/health"
+	"github.com/thumperq/golib/lifecycle"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type ApiServer struct {
 	HttpPort   uint16
 	Engine     *http.ServeMux
-	interrupt  chan os.Signal
+	options    Options
 	httpServer *http.Server
+	listener   net.Listener
+	middleware []Middleware
+	health     *health.Registry
+	operations []*Operation
+	apiTitle   string
+	apiVersion string
+
+	meterProvider *sdkmetric.MeterProvider
+	grpc          http.Handler
+}
+
+// NewApiServer returns a server with the liveness and readiness, OpenAPI, Swagger UI and metrics routes. Requests are
+// traced, measured and logged, panics in handlers are recovered and CORS is applied when configured. Run creates,
+// starts and stops it.
+func NewApiServer(opts Options) (*ApiServer, error) {
+	srv := &ApiServer{
+		HttpPort: opts.Port,
+		options:  opts,
+	}
+	err := srv.initialize()
+	if err != nil {
+		return nil, err
+	}
+	return srv, nil
 }
 
 func (srv *ApiServer) initialize() error {
 	srv.Engine = http.NewServeMux()
-	domain := os.Getenv("DOMAIN")
-	service := os.Getenv("SERVICE")
-	srv.Engine.HandleFunc(fmt.Sprintf("GET /%s/%s/health-check", domain, service), func(w http.ResponseWriter, r *http.Request) {
-		Status(http.StatusOK, w)
-	})
+	srv.health = health.NewRegistry()
+	srv.HandleFunc("GET /health/live", healthHandler(srv.health.Liveness))
+	srv.HandleFunc("GET /health/ready", healthHandler(srv.health.Readiness))
+	// kept for the probes of existing deployments
+	srv.HandleFunc("GET /health-check", healthHandler(srv.health.Readiness))
 
-	// Serve the OpenAPI spec at /openapi.yaml
-	srv.Engine.HandleFunc("/openapi.yaml", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "../api/openapi.yaml")
-	})
-
-	// Serve Swagger UI at /swagger/
-	srv.Engine.Handle("/swagger/", httpSwagger.Handler(
-		httpSwagger.URL("/openapi.yaml"), // The URL where the OpenAPI YAML file is served
-	))
-
-	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowCredentials: true,
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
-		// Enable Debugging for testing, consider disabling in production
-		// Debug: true,
-	})
+	srv.Engine.HandleFunc("GET /openapi.yaml", srv.serveOpenAPI)
+	if srv.options.SwaggerUI {
+		srv.Engine.Handle("GET /swagger/", httpSwagger.Handler(httpSwagger.URL("/openapi.yaml")))
+	}
 
-	c.Handler(srv.Engine)
+	var metrics *ServerMetrics
+	if srv.options.Metrics {
+		handler, err := srv.initializeMetrics()
+		if err != nil {
+			return err
+		}
+		srv.Engine.Handle("GET /metrics", handler)
+		metrics, err = NewServerMetrics(srv.meterProvider)
+		if err != nil {
+			return err
+		}
+	}
 
-	srv.interrupt = make(chan os.Signal, 1)
-	signal.Notify(srv.interrupt, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	srv.Use(srv.matchRoute(), Telemetry(nil, metrics))
+	if srv.options.AccessLog {
+		srv.Use(AccessLog())
+	}
+	srv.Use(Recover())
+	if srv.options.CORS != nil {
+		srv.Use(CORS(*srv.options.CORS))
+	}
 	return nil
 }
 
-func (srv *ApiServer) start() error {
+// Use wraps every request of the server with the middlewares, including requests not matching any route.
+// It has to be called before the server is started.
+func (srv *ApiServer) Use(middlewares ...Middleware) {
+	srv.middleware = append(srv.middleware, middlewares...)
+}
+
+// Handle registers the handler below the route prefix, e.g. GET /orders/{id} is served at GET /wms/ordering/orders/{id}.
+func (srv *ApiServer) Handle(pattern string, handler http.Handler) {
+	srv.Engine.Handle(srv.route(pattern), handler)
+}
+
+// HandleFunc registers the handler func below the route prefix.
+func (srv *ApiServer) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	srv.Engine.HandleFunc(srv.route(pattern), handler)
+}
+
+func (srv *ApiServer) route(pattern string) string {
+	prefix := strings.TrimSuffix(srv.options.RoutePrefix, "/")
+	method, path, found := strings.Cut(pattern, " ")
+	if !found {
+		return prefix + pattern
+	}
+	return method + " " + prefix + path
+}
+
+// Addr returns the address the server listens on, it is only set once the server is started.
+func (srv *ApiServer) Addr() net.Addr {
+	if srv.listener == nil {
+		return nil
+	}
+	return srv.listener.Addr()
+}
+
+// Handler returns the routes wrapped by the middlewares of the server.
+func (srv *ApiServer) Handler() http.Handler {
+	var handler http.Handler = srv.Engine
+	if srv.options.MaxBodyBytes > 0 {
+		handler = http.MaxBytesHandler(handler, srv.options.MaxBodyBytes)
+	}
+	handler = Chain(srv.middleware...)(handler)
+	if srv.grpc != nil {
+		handler = grpcHandler(srv.grpc, handler)
+	}
+	return handler
+}
+
+// HandleGRPC serves gRPC calls on the port of the server with the handler, e.g. a grpc.Server. The calls bypass the
+// routes and middlewares, they are served over HTTP/2 with TLS and over cleartext HTTP/2 (h2c) without.
+// The read and write timeouts of the options do not apply to the calls, which would end long running streams, bound
+// them with the deadlines of the calls.
+func (srv *ApiServer) HandleGRPC(handler http.Handler) {
+	srv.grpc = handler
+}
+
+func grpcHandler(grpc http.Handler, next http.Handler) http.Handler {
+	return h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			rc := http.NewResponseController(w)
+			_ = rc.SetReadDeadline(time.Time{})
+			_ = rc.SetWriteDeadline(time.Time{})
+			grpc.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), &http2.Server{})
+}
+
+func (srv *ApiServer) tlsConfig() (*tls.Config, error) {
+	err := srv.options.validateTLS()
+	if err != nil {
+		return nil, err
+	}
+	if srv.options.TLSClientCAFile == "" {
+		return nil, nil
+	}
+	ca, err := os.ReadFile(srv.options.TLSClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("client ca file contains no certificates")
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// Start listens and serves in the background, the shutdown hooks are registered with the manager. The readiness fails
+// in its StopAccepting phase and in-flight requests are drained within the shutdown timeout in its DrainHTTP phase.
+// Serve failures shut the manager down with exit code 1.
+func (srv *ApiServer) Start(m *lifecycle.Manager) error {
+	tlsConfig, err := srv.tlsConfig()
+	if err != nil {
+		return err
+	}
 	srv.httpServer = &http.Server{
-		Handler:           srv.Engine,
-		ReadHeaderTimeout: 10 * time.Second,
+		Handler:           srv.Handler(),
+		ReadTimeout:       srv.options.ReadTimeout,
+		ReadHeaderTimeout: srv.options.ReadHeaderTimeout,
+		WriteTimeout:      srv.options.WriteTimeout,
+		IdleTimeout:       srv.options.IdleTimeout,
+		MaxHeaderBytes:    srv.options.MaxHeaderBytes,
+		TLSConfig:         tlsConfig,
+	}
+	shutdown := make(chan struct{})
+	srv.httpServer.RegisterOnShutdown(func() { close(shutdown) })
+	srv.httpServer.BaseContext = func(net.Listener) context.Context {
+		return context.WithValue(context.Background(), shutdownKey{}, (<-chan struct{})(shutdown))
 	}
 	httpListener, err := net.Listen("tcp", fmt.Sprintf(":%d", srv.HttpPort))
 	if err != nil {
 		return err
 	}
+	srv.listener = httpListener
+	m.OnStop(lifecycle.StopAccepting, "http readiness", func(ctx context.Context) error {
+		srv.health.ShutDown()
+		return nil
+	})
+	m.OnStop(lifecycle.DrainHTTP, "http server", func(ctx context.Context) error {
+		if srv.options.ShutdownTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, srv.options.ShutdownTimeout)
+			defer cancel()
+		}
+		return srv.httpServer.Shutdown(ctx)
+	})
 	go func() {
-		if err := srv.httpServer.Serve(httpListener); err != nil && err != http.ErrServerClosed {
-			panic(err)
+		var err error
+		if srv.options.TLSCertFile != "" {
+			err = srv.httpServer.ServeTLS(httpListener, srv.options.TLSCertFile, srv.options.TLSKeyFile)
+		} else {
+			err = srv.httpServer.Serve(httpListener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			m.Fail(fmt.Errorf("http server failed: %w", err))
 		}
 	}()
 	return nil
 }
 
-func (srv *ApiServer) stop() int {
-	<-srv.interrupt
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	if err := srv.httpServer.Shutdown(ctx); err != nil {
-		return 1
-	}
-	return 1
+func ListenAndServe(callback func(*ApiServer) error) <-chan int {
+	return ListenAndServeWithOptions(DefaultOptions(), callback)
 }
 
-func ListenAndServe(callback func(*ApiServer) error) <-chan int {
-	var httpPort uint16 = 8080
+// ListenAndServeWithOptions is ListenAndServe with the port, timeouts, limits, TLS and route prefix of the options.
+// The exit code is sent once the server shut down on SIGINT or SIGTERM.
+func ListenAndServeWithOptions(opts Options, callback func(*ApiServer) error) <-chan int {
 	exitCode := make(chan int, 1)
-	apiServer := ApiServer{
-		HttpPort: httpPort,
-	}
-	err := apiServer.initialize()
-	if err != nil {
-		exitCode <- 1
+	go func() {
+		exitCode <- Run(context.Background(), lifecycle.NewManager(), opts, callback)
 		close(exitCode)
-		return exitCode
+	}()
+	return exitCode
+}
+
+// Run creates the server, registers the routes with the callback and serves until the manager shuts down, either on a
+// signal or when the context is done. It returns the exit code of the manager, 1 when the server could not be started.
+func Run(ctx context.Context, m *lifecycle.Manager, opts Options, callback func(*ApiServer) error) int {
+	err := start(m, opts, callback)
+	if err != nil {
+		// the hooks registered so far still run, e.g. to close the connections of the callback
+		m.Fail(fmt.Errorf("failed to start http server: %w", err))
 	}
-	err = callback(&apiServer)
+	return m.Run(ctx)
+}
+
+func start(m *lifecycle.Manager, opts Options, callback func(*ApiServer) error) error {
+	apiServer, err := NewApiServer(opts)
 	if err != nil {
-		exitCode <- 1
-		close(exitCode)
-		return exitCode
+		return err
 	}
-	err = apiServer.start()
+	err = callback(apiServer)
 	if err != nil {
-		exitCode <- 1
-		close(exitCode)
-		return exitCode
+		return err
 	}
-	go func() {
-		exitCode <- apiServer.stop()
-		close(exitCode)
-	}()
-	return exitCode
+	return apiServer.Start(m)
 }
@@ -0,0 +1,198 @@
+package httpserver_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thumperq/golib/lifecycle"
+	messagingTest "github.com/thumperq/golib/messaging/test"
+	httpserver "github.com/thumperq/golib/servers/http"
+)
+
+func TestRunDrainsRequestsAndExitsCleanly(t *testing.T) {
+	opts := httpserver.DefaultOptions()
+	opts.Port = uint16(messagingTest.FreePort(t))
+	opts.RoutePrefix = "/wms/ordering"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan struct{})
+	exitCode := make(chan int, 1)
+	go func() {
+		exitCode <- httpserver.Run(ctx, lifecycle.NewManager().WithSignals().WithDrainDelay(0), opts, func(srv *httpserver.ApiServer) error {
+			srv.HandleFunc("GET /slow", func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				time.Sleep(200 * time.Millisecond)
+				httpserver.Status(http.StatusOK, w)
+			})
+			return nil
+		})
+	}()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/wms/ordering", opts.Port)
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(url + "/health/ready")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 20*time.Millisecond)
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-started
+	cancel()
+	require.Equal(t, http.StatusOK, <-status, "in-flight requests are drained")
+	require.Equal(t, 0, <-exitCode)
+}
+
+func TestRunFailsWhenPortIsTaken(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	defer listener.Close()
+	opts := httpserver.DefaultOptions()
+	opts.Port = uint16(listener.Addr().(*net.TCPAddr).Port)
+	opts.RoutePrefix = "/wms/ordering"
+	m := lifecycle.NewManager().WithSignals().WithDrainDelay(0)
+	closed := false
+	m.OnStop(lifecycle.Close, "broker", func(ctx context.Context) error {
+		closed = true
+		return nil
+	})
+	require.Equal(t, 1, httpserver.Run(context.Background(), m, opts, func(srv *httpserver.ApiServer) error {
+		return nil
+	}))
+	require.True(t, closed)
+}
+
+// issue returns a certificate for the template signed by the parent, a nil parent self-signs it.
+func issue(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+}
+
+func TestRunServesMutualTLS(t *testing.T) {
+	ca := issue(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "ordering"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	client := issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "billing"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+	dir := t.TempDir()
+	serverKey, err := x509.MarshalPKCS8PrivateKey(server.PrivateKey)
+	require.NoError(t, err)
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.Certificate[0])
+	writePEM(t, filepath.Join(dir, "tls.crt"), "CERTIFICATE", server.Certificate[0])
+	writePEM(t, filepath.Join(dir, "tls.key"), "PRIVATE KEY", serverKey)
+
+	opts := httpserver.DefaultOptions()
+	opts.Port = uint16(messagingTest.FreePort(t))
+	opts.RoutePrefix = "/wms/ordering"
+	opts.TLSCertFile = filepath.Join(dir, "tls.crt")
+	opts.TLSKeyFile = filepath.Join(dir, "tls.key")
+	opts.TLSClientCAFile = filepath.Join(dir, "ca.pem")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exitCode := make(chan int, 1)
+	go func() {
+		exitCode <- httpserver.Run(ctx, lifecycle.NewManager().WithSignals().WithDrainDelay(0), opts, func(srv *httpserver.ApiServer) error {
+			srv.HandleFunc("GET /whoami", func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+			})
+			return nil
+		})
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	get := func(certificates []tls.Certificate) (*http.Response, error) {
+		httpClient := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certificates},
+		}}
+		return httpClient.Get(fmt.Sprintf("https://127.0.0.1:%d/wms/ordering/whoami", opts.Port))
+	}
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		resp, err = get([]tls.Certificate{client})
+		return err == nil
+	}, 5*time.Second, 20*time.Millisecond)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "billing", string(body))
+
+	// clients without certificate and plain http are rejected
+	_, err = get(nil)
+	require.Error(t, err)
+	resp, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d/wms/ordering/whoami", opts.Port))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	cancel()
+	require.Equal(t, 0, <-exitCode)
+}
+
+func TestRunFailsWithClientCAWithoutCertificate(t *testing.T) {
+	opts := httpserver.DefaultOptions()
+	opts.Port = uint16(messagingTest.FreePort(t))
+	opts.RoutePrefix = "/wms/ordering"
+	opts.TLSClientCAFile = "/etc/tls/ca.pem"
+	require.Equal(t, 1, httpserver.Run(context.Background(), lifecycle.NewManager().WithSignals().WithDrainDelay(0), opts, func(srv *httpserver.ApiServer) error {
+		return nil
+	}))
+}
@@ -0,0 +1,101 @@
+package httpserver
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type sseStream struct {
+	*eventQueue
+	w        http.ResponseWriter
+	rc       *http.ResponseController
+	r        *http.Request
+	opts     StreamOptions
+	shutdown <-chan struct{}
+}
+
+// NewSSE answers the request with a server-sent events stream, the events are written by Serve. It fails when the
+// response writer cannot be flushed.
+//
+//	stream, err := httpserver.NewSSE(w, r, httpserver.StreamOptions{})
+//	if err != nil {
+//		return err
+//	}
+//	go publishOrders(stream)
+//	return stream.Serve()
+func NewSSE(w http.ResponseWriter, r *http.Request, opts StreamOptions) (Stream, error) {
+	opts = opts.withDefaults()
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	// disables the response buffering of nginx
+	header.Set("X-Accel-Buffering", "no")
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	err := rc.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return &sseStream{
+		eventQueue: newEventQueue(opts.Buffer),
+		w:          w,
+		rc:         rc,
+		r:          r,
+		opts:       opts,
+		shutdown:   shutdownFromContext(r.Context()),
+	}, nil
+}
+
+func (s *sseStream) Serve() error {
+	defer s.Close()
+	heartbeat := time.NewTicker(s.opts.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event := <-s.events:
+			err := s.write(sseFrame(event))
+			if err != nil {
+				return err
+			}
+		case <-heartbeat.C:
+			err := s.write([]byte(": heartbeat\n\n"))
+			if err != nil {
+				return err
+			}
+		case <-s.done:
+			return s.err
+		case <-s.shutdown:
+			return nil
+		case <-s.r.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (s *sseStream) write(frame []byte) error {
+	// ignored when the writer does not support deadlines, e.g. in tests
+	_ = s.rc.SetWriteDeadline(time.Now().Add(s.opts.WriteTimeout))
+	_, err := s.w.Write(frame)
+	if err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// sseFrame formats the event, every line of the data gets its own data field.
+func sseFrame(event Event) []byte {
+	var frame bytes.Buffer
+	if event.ID != "" {
+		frame.WriteString("id: " + event.ID + "\n")
+	}
+	if event.Name != "" {
+		frame.WriteString("event: " + event.Name + "\n")
+	}
+	for _, line := range strings.Split(string(event.Data), "\n") {
+		frame.WriteString("data: " + strings.TrimSuffix(line, "\r") + "\n")
+	}
+	frame.WriteString("\n")
+	return frame.Bytes()
+}
@@ -0,0 +1,124 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSlowClient closes streams whose client does not keep up with the events.
+	ErrSlowClient = errors.New("client too slow")
+	// ErrStreamClosed is returned when sending to a closed stream.
+	ErrStreamClosed = errors.New("stream closed")
+)
+
+const (
+	defaultHeartbeat          = 15 * time.Second
+	defaultStreamBuffer       = 64
+	defaultStreamWriteTimeout = 10 * time.Second
+)
+
+// Event is sent to the clients of streams.
+type Event struct {
+	// ID is the id field of server-sent events. Streams do not replay missed events, so the Last-Event-ID header of
+	// reconnecting clients is ignored.
+	ID   string
+	Name string
+	Data []byte
+}
+
+// Stream sends events to a connected client, it is implemented by the SSE and WebSocket streams.
+type Stream interface {
+	// Send queues the event without blocking. When the client fell behind by more events than the buffer holds, the
+	// stream is closed with ErrSlowClient, so one slow client never holds up the others.
+	Send(event Event) error
+	// Serve writes the events and the heartbeats until the client disconnects, the stream is closed or the server
+	// shuts down. It returns the error closing the stream, nil when the client disconnected or Close was called.
+	Serve() error
+	// Done is closed when the stream is closed.
+	Done() <-chan struct{}
+	Close()
+}
+
+// StreamOptions configures SSE and WebSocket streams, zero values take the defaults.
+type StreamOptions struct {
+	// Heartbeat keeps idle connections open through proxies and detects disconnected clients, 15 seconds by default.
+	Heartbeat time.Duration
+	// Buffer is the number of events queued per client, 64 by default.
+	Buffer int
+	// WriteTimeout bounds every write, 10 seconds by default. It replaces the write timeout of the server, which
+	// would end the stream.
+	WriteTimeout time.Duration
+	// CheckOrigin allows the origin of WebSocket upgrades, by default it has to match the host.
+	CheckOrigin func(r *http.Request) bool
+}
+
+func (opts StreamOptions) withDefaults() StreamOptions {
+	if opts.Heartbeat <= 0 {
+		opts.Heartbeat = defaultHeartbeat
+	}
+	if opts.Buffer <= 0 {
+		opts.Buffer = defaultStreamBuffer
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = defaultStreamWriteTimeout
+	}
+	return opts
+}
+
+// eventQueue is the buffer of events and the closing shared by the streams.
+type eventQueue struct {
+	events chan Event
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+func newEventQueue(buffer int) *eventQueue {
+	return &eventQueue{
+		events: make(chan Event, buffer),
+		done:   make(chan struct{}),
+	}
+}
+
+func (q *eventQueue) Send(event Event) error {
+	select {
+	case <-q.done:
+		return ErrStreamClosed
+	default:
+	}
+	select {
+	case q.events <- event:
+		return nil
+	default:
+		q.closeWith(ErrSlowClient)
+		return ErrSlowClient
+	}
+}
+
+func (q *eventQueue) Done() <-chan struct{} {
+	return q.done
+}
+
+func (q *eventQueue) Close() {
+	q.closeWith(nil)
+}
+
+func (q *eventQueue) closeWith(err error) {
+	q.once.Do(func() {
+		q.err = err
+		close(q.done)
+	})
+}
+
+type shutdownKey struct{}
+
+// shutdownFromContext returns the channel closed when the server of the request shuts down, streams end then so they
+// do not hold up the drain.
+func shutdownFromContext(ctx context.Context) <-chan struct{} {
+	shutdown, _ := ctx.Value(shutdownKey{}).(<-chan struct{})
+	return shutdown
+}
@@ -0,0 +1,190 @@
+package httpserver_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"github.com/thumperq/golib/lifecycle"
+	messagingTest "github.com/thumperq/golib/messaging/test"
+	httpserver "github.com/thumperq/golib/servers/http"
+)
+
+func streamServer(t *testing.T, open func(w http.ResponseWriter, r *http.Request) (httpserver.Stream, error)) (*httptest.Server, <-chan httpserver.Stream, <-chan error) {
+	t.Helper()
+	opts := httpserver.DefaultOptions()
+	opts.RoutePrefix = "/wms/ordering"
+	srv, err := httpserver.NewApiServer(opts)
+	require.NoError(t, err)
+	streams := make(chan httpserver.Stream, 1)
+	served := make(chan error, 1)
+	srv.HandleFunc("GET /events", func(w http.ResponseWriter, r *http.Request) {
+		stream, err := open(w, r)
+		if err != nil {
+			served <- err
+			return
+		}
+		streams <- stream
+		served <- stream.Serve()
+	})
+	server := httptest.NewServer(srv.Handler())
+	t.Cleanup(server.Close)
+	return server, streams, served
+}
+
+func readLine(t *testing.T, reader *bufio.Reader) string {
+	t.Helper()
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	return strings.TrimSuffix(line, "\n")
+}
+
+func TestSSE(t *testing.T) {
+	opts := httpserver.StreamOptions{Heartbeat: 50 * time.Millisecond, Buffer: 2}
+	server, streams, served := streamServer(t, func(w http.ResponseWriter, r *http.Request) (httpserver.Stream, error) {
+		return httpserver.NewSSE(w, r, opts)
+	})
+
+	resp, err := http.Get(server.URL + "/wms/ordering/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	stream := <-streams
+	reader := bufio.NewReader(resp.Body)
+
+	require.NoError(t, stream.Send(httpserver.Event{ID: "1", Name: "orderCreated", Data: []byte("{\"orderId\":\"123\"}\nsecond line")}))
+	require.Equal(t, "id: 1", readLine(t, reader))
+	require.Equal(t, "event: orderCreated", readLine(t, reader))
+	require.Equal(t, `data: {"orderId":"123"}`, readLine(t, reader))
+	require.Equal(t, "data: second line", readLine(t, reader))
+	require.Equal(t, "", readLine(t, reader))
+	require.Equal(t, ": heartbeat", readLine(t, reader))
+
+	// the client disconnects
+	resp.Body.Close()
+	select {
+	case err := <-served:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		require.Fail(t, "stream not ended after the client disconnected")
+	}
+	require.ErrorIs(t, stream.Send(httpserver.Event{Data: []byte("late")}), httpserver.ErrStreamClosed)
+}
+
+func TestSSESlowClientIsDisconnected(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/events", nil)
+	stream, err := httpserver.NewSSE(w, r, httpserver.StreamOptions{Buffer: 2})
+	require.NoError(t, err)
+
+	// nothing is written before Serve, so the buffer fills up
+	require.NoError(t, stream.Send(httpserver.Event{Data: []byte("1")}))
+	require.NoError(t, stream.Send(httpserver.Event{Data: []byte("2")}))
+	require.ErrorIs(t, stream.Send(httpserver.Event{Data: []byte("3")}), httpserver.ErrSlowClient)
+	require.ErrorIs(t, stream.Serve(), httpserver.ErrSlowClient)
+	select {
+	case <-stream.Done():
+	default:
+		require.Fail(t, "stream not closed")
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	opts := httpserver.StreamOptions{Heartbeat: 50 * time.Millisecond, Buffer: 1}
+	server, streams, served := streamServer(t, func(w http.ResponseWriter, r *http.Request) (httpserver.Stream, error) {
+		return httpserver.UpgradeWebSocket(w, r, opts)
+	})
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/wms/ordering/events", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	pinged := make(chan struct{}, 1)
+	conn.SetPingHandler(func(data string) error {
+		select {
+		case pinged <- struct{}{}:
+		default:
+		}
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	stream := <-streams
+
+	require.NoError(t, stream.Send(httpserver.Event{ID: "1", Name: "orderCreated", Data: []byte(`{"orderId":"123"}`)}))
+	_, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.JSONEq(t, `{"id":"1","event":"orderCreated","data":{"orderId":"123"}}`, string(message))
+	require.NoError(t, stream.Send(httpserver.Event{Data: []byte("plain text")}))
+	_, message, err = conn.ReadMessage()
+	require.NoError(t, err)
+	require.JSONEq(t, `{"data":"plain text"}`, string(message))
+
+	// reading handles the pings, a close frame ends the read
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-pinged:
+	case <-time.After(time.Second):
+		require.Fail(t, "no heartbeat ping")
+	}
+
+	stream.Close()
+	select {
+	case err := <-served:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		require.Fail(t, "stream not ended after Close")
+	}
+}
+
+func TestRunEndsStreamsOnShutdown(t *testing.T) {
+	opts := httpserver.DefaultOptions()
+	opts.Port = uint16(messagingTest.FreePort(t))
+	opts.RoutePrefix = "/wms/ordering"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exitCode := make(chan int, 1)
+	go func() {
+		exitCode <- httpserver.Run(ctx, lifecycle.NewManager().WithSignals().WithDrainDelay(0), opts, func(srv *httpserver.ApiServer) error {
+			srv.HandleFunc("GET /events", func(w http.ResponseWriter, r *http.Request) {
+				stream, err := httpserver.NewSSE(w, r, httpserver.StreamOptions{})
+				if err != nil {
+					return
+				}
+				_ = stream.Serve()
+			})
+			return nil
+		})
+	}()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/wms/ordering/events", opts.Port)
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		var err error
+		resp, err = http.Get(url)
+		return err == nil
+	}, 5*time.Second, 20*time.Millisecond)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	cancel()
+	select {
+	case code := <-exitCode:
+		require.Equal(t, 0, code, "open streams do not hold up the drain")
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "shutdown blocked by the open stream")
+	}
+	_, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+}
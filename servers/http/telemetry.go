@@ -0,0 +1,154 @@
+package httpserver
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/thumperq/golib/servers/http"
+
+// durationBuckets are the bucket boundaries in seconds recommended for http.server.request.duration.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.25, 0.5, 0.75, 1, 2.5, 5, 7.5, 10}
+
+// ServerMetrics records the RED metrics of the server, the rate and errors are the count of the duration histogram
+// by status code and error. Every measurement is labelled by method and route.
+type ServerMetrics struct {
+	duration metric.Float64Histogram
+	active   metric.Int64UpDownCounter
+}
+
+func NewServerMetrics(provider metric.MeterProvider) (*ServerMetrics, error) {
+	if provider == nil {
+		provider = otel.GetMeterProvider()
+	}
+	meter := provider.Meter(instrumentationName)
+	m := &ServerMetrics{}
+	var err error
+	m.duration, err = meter.Float64Histogram("http.server.request.duration",
+		metric.WithDescription("Duration of http requests"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(durationBuckets...))
+	if err != nil {
+		return nil, err
+	}
+	m.active, err = meter.Int64UpDownCounter("http.server.active_requests",
+		metric.WithDescription("Number of http requests in flight"))
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Telemetry continues the W3C trace context of the request in a server span per route and records the metrics.
+// The span is in the request context, so logging.TraceLogger logs its trace fields. The route is the pattern of the
+// request, ApiServer sets it before its middlewares run. Without tracer provider the global one is used.
+func Telemetry(provider trace.TracerProvider, metrics *ServerMetrics) Middleware {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	tracer := provider.Tracer(instrumentationName)
+	propagator := propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			attrs := []attribute.KeyValue{
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route(r.Pattern)),
+			}
+			ctx, span := tracer.Start(ctx, spanName(r),
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(attrs...),
+				trace.WithAttributes(attribute.String("url.path", r.URL.Path)))
+			defer span.End()
+			if metrics != nil {
+				metrics.active.Add(ctx, 1, metric.WithAttributes(attrs...))
+				defer metrics.active.Add(ctx, -1, metric.WithAttributes(attrs...))
+			}
+
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r.WithContext(ctx))
+
+			span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+			if recorder.status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(recorder.status))
+			}
+			if metrics != nil {
+				metrics.duration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(append(attrs,
+					attribute.Int("http.response.status_code", recorder.status),
+					attribute.Bool("error", recorder.status >= http.StatusInternalServerError))...))
+			}
+		})
+	}
+}
+
+// route strips the method of the pattern, e.g. GET /orders/{id} becomes /orders/{id}.
+func route(pattern string) string {
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		return pattern[i+1:]
+	}
+	return pattern
+}
+
+// spanName is the method and route of the request, requests not matching any route are named by their method only,
+// naming them by path would create a span name per url.
+func spanName(r *http.Request) string {
+	if r.Pattern == "" {
+		return r.Method
+	}
+	return r.Method + " " + route(r.Pattern)
+}
+
+// matchRoute sets the pattern of the route matching the request, which the ServeMux only sets after the middlewares
+// ran. Middlewares like Telemetry, AccessLog and RateLimit depend on it.
+func (srv *ApiServer) matchRoute() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, pattern := srv.Engine.Handler(r)
+			r = r.WithContext(r.Context())
+			r.Pattern = pattern
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// MeterProvider returns the provider of the metrics served at /metrics, e.g. for messaging.NewBrokerMetrics. Without
+// Options.Metrics it is the global provider.
+func (srv *ApiServer) MeterProvider() metric.MeterProvider {
+	if srv.meterProvider == nil {
+		return otel.GetMeterProvider()
+	}
+	return srv.meterProvider
+}
+
+// initializeMetrics exports the metrics of a dedicated provider together with the go runtime and process metrics.
+func (srv *ApiServer) initializeMetrics() (http.Handler, error) {
+	registry := prometheus.NewRegistry()
+	err := registry.Register(collectors.NewGoCollector())
+	if err != nil {
+		return nil, err
+	}
+	err = registry.Register(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	if err != nil {
+		return nil, err
+	}
+	exporter, err := otelprometheus.New(otelprometheus.WithRegisterer(registry))
+	if err != nil {
+		return nil, err
+	}
+	srv.meterProvider = sdkmetric.NewMeterProvider(sdkmetric.WithReader(exporter))
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{}), nil
+}
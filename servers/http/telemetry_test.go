@@ -0,0 +1,75 @@
+package httpserver_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/require"
+	httpserver "github.com/thumperq/golib/servers/http"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTelemetry(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	previousProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	t.Cleanup(func() { otel.SetTracerProvider(previousProvider) })
+	var logs bytes.Buffer
+	previousLogger := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = previousLogger })
+
+	opts := httpserver.DefaultOptions()
+	opts.RoutePrefix = "/wms/ordering"
+	srv, err := httpserver.NewApiServer(opts)
+	require.NoError(t, err)
+	srv.HandleFunc("GET /orders/{id}", func(w http.ResponseWriter, r *http.Request) {
+		httpserver.Status(http.StatusInternalServerError, w)
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/wms/ordering/orders/42", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, r)
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+
+	ended := spans.Ended()
+	require.Len(t, ended, 1)
+	span := ended[0]
+	require.Equal(t, "GET /wms/ordering/orders/{id}", span.Name())
+	require.Equal(t, trace.SpanKindServer, span.SpanKind())
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String())
+	require.Equal(t, "00f067aa0ba902b7", span.Parent().SpanID().String())
+	require.Contains(t, span.Attributes(), attribute.Int("http.response.status_code", http.StatusInternalServerError))
+	require.Contains(t, logs.String(), `"route":"GET /wms/ordering/orders/{id}"`)
+	require.Contains(t, logs.String(), `"logging.googleapis.com/trace":"project/trace/4bf92f3577b34da6a3ce929d0e0e4736"`)
+	require.Contains(t, logs.String(), `"logging.googleapis.com/spanId":"`+span.SpanContext().SpanID().String()+`"`)
+
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	metrics := w.Body.String()
+	require.Contains(t, metrics, "http_server_request_duration_seconds_count{")
+	require.Regexp(t, `http_server_request_duration_seconds_count\{error="true",http_request_method="GET",http_response_status_code="500",http_route="/wms/ordering/orders/\{id\}"[^}]*\} 1`, metrics)
+	require.Contains(t, metrics, "go_goroutines")
+}
+
+func TestTelemetryDisabled(t *testing.T) {
+	opts := httpserver.DefaultOptions()
+	opts.RoutePrefix = "/wms/ordering"
+	opts.Metrics = false
+	srv, err := httpserver.NewApiServer(opts)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,110 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxClientMessage limits the messages of the clients, streams only read them to detect disconnects.
+const maxClientMessage = 4096
+
+type webSocketStream struct {
+	*eventQueue
+	conn     *websocket.Conn
+	opts     StreamOptions
+	shutdown <-chan struct{}
+	closed   chan struct{}
+}
+
+// webSocketFrame is the JSON message of an event, data is embedded as is when it is JSON and as a string otherwise.
+type webSocketFrame struct {
+	ID    string          `json:"id,omitempty"`
+	Event string          `json:"event,omitempty"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// UpgradeWebSocket upgrades the request to a WebSocket stream, the events are written by Serve as JSON text messages.
+// Messages of the client are discarded. When the upgrade fails the client is answered with an error.
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request, opts StreamOptions) (Stream, error) {
+	opts = opts.withDefaults()
+	upgrader := websocket.Upgrader{CheckOrigin: opts.CheckOrigin}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &webSocketStream{
+		eventQueue: newEventQueue(opts.Buffer),
+		conn:       conn,
+		opts:       opts,
+		shutdown:   shutdownFromContext(r.Context()),
+		closed:     make(chan struct{}),
+	}, nil
+}
+
+func (s *webSocketStream) Serve() error {
+	defer s.conn.Close()
+	defer s.Close()
+	go s.read()
+	heartbeat := time.NewTicker(s.opts.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event := <-s.events:
+			err := s.write(event)
+			if err != nil {
+				return err
+			}
+		case <-heartbeat.C:
+			err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.opts.WriteTimeout))
+			if err != nil {
+				return err
+			}
+		case <-s.done:
+			if errors.Is(s.err, ErrSlowClient) {
+				s.writeClose(websocket.ClosePolicyViolation, s.err.Error())
+			} else {
+				s.writeClose(websocket.CloseNormalClosure, "")
+			}
+			return s.err
+		case <-s.shutdown:
+			s.writeClose(websocket.CloseGoingAway, "server shutting down")
+			return nil
+		case <-s.closed:
+			return nil
+		}
+	}
+}
+
+// read consumes the messages of the client so pongs and close frames are handled. A client which does not answer
+// the pings within two heartbeats is disconnected.
+func (s *webSocketStream) read() {
+	defer close(s.closed)
+	s.conn.SetReadLimit(maxClientMessage)
+	_ = s.conn.SetReadDeadline(time.Now().Add(2 * s.opts.Heartbeat))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(2 * s.opts.Heartbeat))
+	})
+	for {
+		_, _, err := s.conn.NextReader()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *webSocketStream) write(event Event) error {
+	data := json.RawMessage(event.Data)
+	if !json.Valid(event.Data) {
+		data, _ = json.Marshal(string(event.Data))
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(s.opts.WriteTimeout))
+	return s.conn.WriteJSON(webSocketFrame{ID: event.ID, Event: event.Name, Data: data})
+}
+
+func (s *webSocketStream) writeClose(code int, reason string) {
+	_ = s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(s.opts.WriteTimeout))
+}